@@ -0,0 +1,154 @@
+/*
+File Name:  ACME.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Optional built-in ACME client to obtain and renew certificates (for example from Let's Encrypt) without external tools.
+Both the HTTP-01 and TLS-ALPN-01 challenges are supported. HTTP-01 challenges are answered by the statistics router and
+the optional ACMEHTTPListen listeners, TLS-ALPN-01 challenges by any TLS listener using the ACME certificates.
+
+Certificates are stored in the ACMEFolder and renewed automatically 30 days before expiry.
+For testing, the directory URL can point to a local ACME test server such as pebble. Its self-signed CA can be set via ACMEDirectoryCA.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeManager is the ACME certificate manager. Nil if ACME is disabled.
+var acmeManager *autocert.Manager
+
+// initACME creates the ACME certificate manager if domains are configured.
+func initACME() {
+	if len(config.ACMEDomains) == 0 {
+		return
+	}
+
+	folder := config.ACMEFolder
+	if folder == "" {
+		folder = "certificates"
+	}
+
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		log.Printf("Error creating ACME certificate folder '%s': %v\n", folder, err)
+		return
+	}
+
+	client := &acme.Client{DirectoryURL: config.ACMEDirectory}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	// A custom CA is required for test servers that use self-signed certificates for the directory.
+	if config.ACMEDirectoryCA != "" {
+		httpClient, err := acmeHTTPClient(config.ACMEDirectoryCA)
+		if err != nil {
+			log.Printf("Error loading ACME directory CA '%s': %v\n", config.ACMEDirectoryCA, err)
+			return
+		}
+		client.HTTPClient = httpClient
+	}
+
+	acmeManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(folder),
+		HostPolicy: autocert.HostWhitelist(config.ACMEDomains...),
+		Client:     client,
+		Email:      config.ACMEEmail,
+	}
+
+	// Request the certificates right away instead of waiting for the first TLS handshake. This also starts the renewal timers.
+	go func() {
+		// Give the listeners some time to start since they are needed for the challenges.
+		time.Sleep(5 * time.Second)
+
+		for _, domain := range config.ACMEDomains {
+			if _, err := acmeManager.GetCertificate(&tls.ClientHelloInfo{ServerName: domain}); err != nil {
+				log.Printf("Error obtaining ACME certificate for '%s': %v\n", domain, err)
+			}
+		}
+	}()
+}
+
+// acmeHTTPClient returns an HTTP client that trusts the CA from the PEM file in addition to the system CAs.
+func acmeHTTPClient(caFile string) (client *http.Client, err error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no valid certificate found")
+	}
+
+	return &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}, nil
+}
+
+// acmeHTTPHandler returns a handler answering HTTP-01 challenges. All other requests are passed to the fallback handler.
+// If ACME is disabled, the fallback handler is returned as is.
+func acmeHTTPHandler(fallback http.Handler) http.Handler {
+	if acmeManager == nil {
+		return fallback
+	}
+
+	return acmeManager.HTTPHandler(fallback)
+}
+
+// startACMEHTTPListeners starts the plain HTTP listeners for HTTP-01 challenges. All other requests are redirected to HTTPS.
+func startACMEHTTPListeners() {
+	if acmeManager == nil {
+		return
+	}
+
+	for _, listen := range config.ACMEHTTPListen {
+		go startWebServer(listen, false, "", "", acmeManager.HTTPHandler(nil), "ACME", 10*time.Second, 10*time.Second)
+	}
+}
+
+// acmeCertificateStatus returns the expiry date of the ACME certificate for the domain. It does not request a new certificate.
+func acmeCertificateStatus(domain string) (expires time.Time, err error) {
+	if acmeManager == nil {
+		return expires, errors.New("ACME disabled")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	data, err := acmeManager.Cache.Get(ctx, domain)
+	if err != nil {
+		return expires, err
+	}
+
+	// The cache entry contains the private key followed by the certificate chain, all PEM encoded.
+	certificate, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return expires, err
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return expires, err
+	}
+
+	return leaf.NotAfter, nil
+}
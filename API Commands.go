@@ -0,0 +1,588 @@
+/*
+File Name:  API Commands.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+HTTP endpoints mirroring the root specific console commands. They use the same authentication and roles as the /console websocket.
+Each endpoint requires the permission of the corresponding console command and is recorded in the audit log.
+
+Long operations (file transfer probe, block fetch and hash monitoring) start a job and return its ID. The job output is polled via /root/job.
+Each API key can have up to 16 running jobs. Monitor jobs keep running until the hash is removed.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/PeernetOfficial/core/webapi"
+	"github.com/google/uuid"
+)
+
+// Limits of jobs.
+const (
+	apiJobOutputMax  = 1024 * 1024   // Max size of the output of a single job. Further output is discarded.
+	apiJobExpire     = 1 * time.Hour // Finished jobs are removed after this time.
+	apiJobRunningMax = 16            // Max count of running jobs per API key. Monitor jobs keep running until the hash is removed.
+)
+
+// apiJob is a long running operation started via the API.
+type apiJob struct {
+	ID       uuid.UUID
+	Type     string // Console command that started the job
+	Key      string // Name of the API key that started the job
+	Started  time.Time
+	Finished time.Time // Zero if running
+
+	sync.Mutex
+	output    bytes.Buffer
+	truncated bool
+}
+
+// Write appends to the job output. It implements io.Writer and never fails, so the job never blocks.
+func (job *apiJob) Write(p []byte) (n int, err error) {
+	job.Lock()
+	defer job.Unlock()
+
+	if job.output.Len()+len(p) > apiJobOutputMax {
+		job.truncated = true
+		return len(p), nil
+	}
+
+	return job.output.Write(p)
+}
+
+func (job *apiJob) finish() {
+	job.Lock()
+	job.Finished = time.Now()
+	job.Unlock()
+}
+
+var (
+	apiJobs      = make(map[uuid.UUID]*apiJob)
+	apiJobsMutex sync.Mutex
+)
+
+// apiJobStart registers a new job and removes expired ones. Nil is returned if the key has reached the max count of running jobs.
+func apiJobStart(jobType string, session *consoleSession) (job *apiJob) {
+	apiJobsMutex.Lock()
+	defer apiJobsMutex.Unlock()
+
+	running := 0
+	for id, existing := range apiJobs {
+		existing.Lock()
+		if !existing.Finished.IsZero() && time.Since(existing.Finished) > apiJobExpire {
+			delete(apiJobs, id)
+		} else if existing.Finished.IsZero() && existing.Key == session.Key {
+			running++
+		}
+		existing.Unlock()
+	}
+
+	if running >= apiJobRunningMax {
+		return nil
+	}
+
+	job = &apiJob{ID: uuid.New(), Type: jobType, Key: session.Key, Started: time.Now()}
+	apiJobs[job.ID] = job
+
+	return job
+}
+
+// apiJobGet returns the job. Only the key that started the job and admins can access it.
+func apiJobGet(id uuid.UUID, session *consoleSession) (job *apiJob) {
+	apiJobsMutex.Lock()
+	defer apiJobsMutex.Unlock()
+
+	if job = apiJobs[id]; job != nil && job.Key != session.Key && session.Role != roleAdmin {
+		return nil
+	}
+	return job
+}
+
+// jsonAPIJobStart is returned when a job is started.
+type jsonAPIJobStart struct {
+	ID uuid.UUID `json:"id"` // Job ID
+}
+
+// jsonAPIJob is the status and output of a job.
+type jsonAPIJob struct {
+	ID        uuid.UUID `json:"id"`        // Job ID
+	Type      string    `json:"type"`      // Console command that started the job
+	Status    string    `json:"status"`    // "running" or "finished"
+	Started   time.Time `json:"started"`   // Start time
+	Finished  time.Time `json:"finished"`  // Finish time. Zero if running.
+	Output    string    `json:"output"`    // Output starting at the requested offset
+	Offset    int       `json:"offset"`    // Offset of the output. Use as &offset= parameter to poll new output only.
+	Truncated bool      `json:"truncated"` // Whether output was discarded because the limit was reached
+}
+
+// jsonAPIMonitor is the response of /root/monitor.
+type jsonAPIMonitor struct {
+	Hash    string    `json:"hash"`    // Hash
+	Added   bool      `json:"added"`   // Whether the hash is monitored
+	JobID   uuid.UUID `json:"jobid"`   // Job receiving the monitoring output. Only if added.
+	Removed int       `json:"removed"` // Count of jobs that were finished because the hash was removed: 1 or 0
+}
+
+func startAPICommands(backend *core.Backend, api *webapi.WebapiInstance) {
+	api.Router.HandleFunc("/root/peer/list", apiCommandPeerList(backend)).Methods("GET")
+	api.Router.HandleFunc("/root/net/list", apiCommandNetList(backend)).Methods("GET")
+	api.Router.HandleFunc("/root/transfer/list", apiCommandTransferList(backend)).Methods("GET")
+	api.Router.HandleFunc("/root/transfer/cancel", apiCommandTransferCancel(backend)).Methods("POST")
+	api.Router.HandleFunc("/root/probe/file", apiCommandProbeFile(backend)).Methods("POST")
+	api.Router.HandleFunc("/root/download", apiCommandDownload(backend)).Methods("POST")
+	api.Router.HandleFunc("/root/download/parallel", apiCommandDownloadParallel(backend)).Methods("POST")
+	api.Router.HandleFunc("/root/block/get", apiCommandGetBlock(backend)).Methods("POST")
+	api.Router.HandleFunc("/root/monitor", apiCommandMonitor(backend)).Methods("POST")
+	api.Router.HandleFunc("/root/job", apiCommandJob(backend)).Methods("GET")
+}
+
+// apiCommandAllowed checks the permission of the console command and writes the audit log. If not allowed, 403 is returned.
+func apiCommandAllowed(w http.ResponseWriter, r *http.Request, command string) (session *consoleSession, allowed bool) {
+	session = apiSession(r)
+	allowed = session.allowed(command)
+	auditCommand(session, command, auditQueryArgs(r.URL.Query()), allowed)
+
+	if !allowed {
+		http.Error(w, "", http.StatusForbidden)
+	}
+
+	return session, allowed
+}
+
+/*
+apiCommandPeerList returns the peers including their connections. Same as the console command "peer list".
+The filter options of the console command are supported as query parameters, for example ?root=1&sort=rtt&limit=20&page=2.
+
+Request:    GET /root/peer/list?[options]
+Response:   200 with JSON structure jsonConsolePeerList, or with the option count only the structure peerSummary
+
+	400 if an option is invalid
+*/
+func apiCommandPeerList(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, allowed := apiCommandAllowed(w, r, "peer list"); !allowed {
+			return
+		}
+
+		filter, err := parsePeerFilterQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		peers, summary := filter.apply(backend)
+		if filter.Count {
+			webapi.EncodeJSON(backend, w, r, summary)
+			return
+		}
+
+		webapi.EncodeJSON(backend, w, r, consolePeerListJSON(peers, summary))
+	}
+}
+
+/*
+apiCommandNetList returns the network interfaces and their IPs. Same as the console command "net list".
+
+Request:    GET /root/net/list
+Response:   200 with JSON structure jsonConsoleNetList
+
+	500 if the interfaces cannot be listed
+*/
+func apiCommandNetList(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, allowed := apiCommandAllowed(w, r, "net list"); !allowed {
+			return
+		}
+
+		list, err := consoleNetListJSON()
+		if err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		webapi.EncodeJSON(backend, w, r, list)
+	}
+}
+
+/*
+apiCommandTransferList returns all file and block transfers. Same as the console command "transfer list".
+
+Request:    GET /root/transfer/list
+Response:   200 with JSON structure jsonConsoleTransferList
+*/
+func apiCommandTransferList(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, allowed := apiCommandAllowed(w, r, "transfer list"); !allowed {
+			return
+		}
+
+		webapi.EncodeJSON(backend, w, r, consoleTransferListJSON(backend))
+	}
+}
+
+/*
+apiCommandTransferCancel terminates a transfer and returns the terminate reason. Same as the console command "transfer cancel".
+
+Request:    POST /root/transfer/cancel?id=[lite ID]
+Response:   200 with JSON structure jsonConsoleTransferCancel
+
+	404 if the transfer is not found or the lite ID is ambiguous
+*/
+func apiCommandTransferCancel(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, allowed := apiCommandAllowed(w, r, "transfer cancel"); !allowed {
+			return
+		}
+
+		session, virtualConn, err := findLiteSession(backend, r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+
+		reason, alreadyTerminated := cancelTransfer(virtualConn)
+		webapi.EncodeJSON(backend, w, r, transferCancelJSON(session, reason, alreadyTerminated))
+	}
+}
+
+/*
+apiCommandProbeFile starts a job that downloads a file from a remote peer and compares it with the local warehouse.
+Same as the console command "probe file transfer". If any of the benchmark parameters is set, the benchmark runs instead and writes the report.
+
+Request:    POST /root/probe/file?peer=[peer ID or node ID]&hash=[file hash]&runs=[n]&concurrency=[n]&warmup=[n]&limit=[bytes]&report=[name]
+Response:   200 with JSON structure jsonAPIJobStart
+
+	400 if the peer ID, hash or a benchmark parameter is invalid
+	429 if the key has too many running jobs
+*/
+func apiCommandProbeFile(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, allowed := apiCommandAllowed(w, r, "probe file transfer")
+		if !allowed {
+			return
+		}
+
+		peerID := r.URL.Query().Get("peer")
+		fileHash, valid := webapi.DecodeBlake3Hash(r.URL.Query().Get("hash"))
+		if !valid || !validPeerID(peerID) {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		options, err := parseBenchmarkOptionsQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		job := apiJobStart("probe file transfer", session)
+		if job == nil {
+			http.Error(w, "", http.StatusTooManyRequests)
+			return
+		}
+
+		go func() {
+			defer job.finish()
+
+			peer, err := connectPeer(backend, peerID, timeoutConnectPeer)
+			if err != nil {
+				job.Write([]byte("Could not connect to peer: " + err.Error() + "\n"))
+				return
+			}
+
+			if options.Enabled {
+				transferBenchmark(peer, fileHash, options, job, false)
+			} else {
+				transferCompareFile(peer, fileHash, job)
+			}
+		}()
+
+		webapi.EncodeJSON(backend, w, r, jsonAPIJobStart{ID: job.ID})
+	}
+}
+
+/*
+apiCommandDownload starts a job that downloads a file from a remote peer to the download folder. Same as the console command "download".
+The target is optional. If the partial file of a previous download exists, the download resumes.
+The optional parameters merkle, merkle-root and publisher enable the merkle verification of each fragment.
+
+Request:    POST /root/download?peer=[peer ID or node ID]&hash=[file hash]&target=[file name]&merkle=[merkle tree file]&merkle-root=[hash]&publisher=[peer ID]
+Response:   200 with JSON structure jsonAPIJobStart
+
+	400 if the peer ID, hash, target or merkle option is invalid
+	429 if the key has too many running jobs
+*/
+func apiCommandDownload(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, allowed := apiCommandAllowed(w, r, "download")
+		if !allowed {
+			return
+		}
+
+		peerID := r.URL.Query().Get("peer")
+		fileHash, valid := webapi.DecodeBlake3Hash(r.URL.Query().Get("hash"))
+		if !valid || !validPeerID(peerID) {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		target, err := downloadTargetPath(r.URL.Query().Get("target"), fileHash)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		merkleOptions, err := parseDownloadOptionsQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		job := apiJobStart("download", session)
+		if job == nil {
+			http.Error(w, "", http.StatusTooManyRequests)
+			return
+		}
+
+		go func() {
+			defer job.finish()
+
+			peer, err := connectPeer(backend, peerID, timeoutConnectPeer)
+			if err != nil {
+				job.Write([]byte("Could not connect to peer: " + err.Error() + "\n"))
+				return
+			}
+
+			if err := downloadFile(peer, fileHash, target, merkleOptions, job); err != nil {
+				job.Write([]byte("Download failed: " + err.Error() + "\n"))
+			}
+		}()
+
+		webapi.EncodeJSON(backend, w, r, jsonAPIJobStart{ID: job.ID})
+	}
+}
+
+/*
+apiCommandDownloadParallel starts a job that downloads a file from multiple peers in parallel. Same as the console command "download parallel".
+The options are passed as query parameters. Peer can be repeated. If the partial file of a previous parallel download exists, the missing segments are downloaded.
+
+Request:    POST /root/download/parallel?hash=[file hash]&target=[file name]&peer=[peer ID]&sources=[n]&discover=0&merkle=[merkle tree file]&merkle-root=[hash]&publisher=[peer ID]
+Response:   200 with JSON structure jsonAPIJobStart
+
+	400 if the hash, target or an option is invalid
+	429 if the key has too many running jobs
+*/
+func apiCommandDownloadParallel(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, allowed := apiCommandAllowed(w, r, "download parallel")
+		if !allowed {
+			return
+		}
+
+		fileHash, valid := webapi.DecodeBlake3Hash(r.URL.Query().Get("hash"))
+		if !valid {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		options, err := parseParallelOptionsQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		target, err := downloadTargetPath(options.Target, fileHash)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		job := apiJobStart("download parallel", session)
+		if job == nil {
+			http.Error(w, "", http.StatusTooManyRequests)
+			return
+		}
+
+		go func() {
+			defer job.finish()
+
+			if err := downloadParallel(backend, fileHash, target, options, job); err != nil {
+				job.Write([]byte("Download failed: " + err.Error() + "\n"))
+			}
+		}()
+
+		webapi.EncodeJSON(backend, w, r, jsonAPIJobStart{ID: job.ID})
+	}
+}
+
+/*
+apiCommandGetBlock starts a job that fetches a block from a remote peer. Same as the console command "get block".
+
+Request:    POST /root/block/get?peer=[peer ID or node ID]&block=[block number]
+Response:   200 with JSON structure jsonAPIJobStart
+
+	400 if the peer ID or block number is invalid
+	429 if the key has too many running jobs
+*/
+func apiCommandGetBlock(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, allowed := apiCommandAllowed(w, r, "get block")
+		if !allowed {
+			return
+		}
+
+		peerID := r.URL.Query().Get("peer")
+		blockNumber, err := strconv.ParseUint(r.URL.Query().Get("block"), 10, 64)
+		if err != nil || !validPeerID(peerID) {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		job := apiJobStart("get block", session)
+		if job == nil {
+			http.Error(w, "", http.StatusTooManyRequests)
+			return
+		}
+
+		go func() {
+			defer job.finish()
+
+			peer, err := connectPeer(backend, peerID, timeoutConnectPeer)
+			if err != nil {
+				job.Write([]byte("Could not connect to peer: " + err.Error() + "\n"))
+				return
+			}
+
+			blockTransfer(peer, blockNumber, job)
+		}()
+
+		webapi.EncodeJSON(backend, w, r, jsonAPIJobStart{ID: job.ID})
+	}
+}
+
+/*
+apiCommandMonitor adds or removes a hash from the monitoring list. Same as the console command "debug watch".
+When added, a job is started that receives the info requests and packets for the hash. The job finishes when the hash is removed.
+A hash can only be monitored by one session. Adding a hash already monitored by the same key returns its job. Only the same key or an admin can remove it.
+
+Request:    POST /root/monitor?hash=[hash]&action=[add or remove]
+Response:   200 with JSON structure jsonAPIMonitor
+
+	400 if the hash or action is invalid
+	409 if the hash is monitored by another key or console session
+	429 if the key has too many running jobs
+*/
+func apiCommandMonitor(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, allowed := apiCommandAllowed(w, r, "debug watch")
+		if !allowed {
+			return
+		}
+
+		hash, valid := webapi.DecodeBlake3Hash(r.URL.Query().Get("hash"))
+		if !valid {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		result := jsonAPIMonitor{Hash: hex.EncodeToString(hash)}
+
+		// The output of a hash monitored via the API is the job of the key that added it.
+		monitored, output := hashIsMonitored(hash)
+		current, isJob := output.(*apiJob)
+
+		switch r.URL.Query().Get("action") {
+		case "add":
+			if monitored && isJob && current.Key == session.Key {
+				result.Added = true
+				result.JobID = current.ID
+				break
+			} else if monitored {
+				http.Error(w, "", http.StatusConflict)
+				return
+			}
+
+			job := apiJobStart("debug watch", session)
+			if job == nil {
+				http.Error(w, "", http.StatusTooManyRequests)
+				return
+			}
+			if _, conflict := hashMonitorControl(hash, 0, job); conflict {
+				job.finish()
+				http.Error(w, "", http.StatusConflict)
+				return
+			}
+
+			result.Added = true
+			result.JobID = job.ID
+
+		case "remove":
+			if !monitored {
+				break
+			} else if !isJob || current.Key != session.Key && session.Role != roleAdmin {
+				http.Error(w, "", http.StatusConflict)
+				return
+			}
+
+			if _, conflict := hashMonitorControl(hash, 1, current); !conflict {
+				current.finish()
+				result.Removed = 1
+			}
+
+		default:
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		webapi.EncodeJSON(backend, w, r, result)
+	}
+}
+
+/*
+apiCommandJob returns the status and output of a job. Finished jobs are available for 1 hour.
+
+Request:    GET /root/job?id=[job ID]&offset=[output offset]
+
+	The offset is optional and allows to poll only new output. Use the offset returned by the previous call.
+
+Response:   200 with JSON structure jsonAPIJob
+
+	400 if the job ID is invalid
+	404 if the job does not exist or was started by another key
+*/
+func apiCommandJob(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+
+		job := apiJobGet(id, apiSession(r))
+		if job == nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+
+		job.Lock()
+		result := jsonAPIJob{ID: job.ID, Type: job.Type, Status: "running", Started: job.Started, Finished: job.Finished, Truncated: job.truncated, Offset: job.output.Len()}
+		if !job.Finished.IsZero() {
+			result.Status = "finished"
+		}
+		if offset >= 0 && offset < job.output.Len() {
+			result.Output = string(job.output.Bytes()[offset:])
+		}
+		job.Unlock()
+
+		webapi.EncodeJSON(backend, w, r, result)
+	}
+}
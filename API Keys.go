@@ -0,0 +1,138 @@
+/*
+File Name:  API Keys.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+API keys with roles. Each console command declares the minimum role required to run it:
+* readonly  Informational commands that do not change any state
+* operator  Additionally commands that query or store data, watch traffic and reload settings
+* admin     All commands including exit, log settings and printing the private key
+
+The key set via APIKey has the admin role. Additional keys are set via APIKeys. If no key is configured, the API is not authenticated
+and all clients have the admin role, which is the previous behavior.
+
+Roles apply to the console via /console and the console commands under /root/. All other API functions provided by the core (account,
+blockchain, profile, warehouse, files, search) have no permission checks of their own and require the admin role.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	roleReadOnly = "readonly"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+// apiKeyConfig is an API key with its role as defined in the config.
+type apiKeyConfig struct {
+	Key  uuid.UUID `yaml:"Key"`  // The API key
+	Name string    `yaml:"Name"` // Name of the key holder, used in the audit log
+	Role string    `yaml:"Role"` // Role: readonly, operator or admin
+}
+
+// consoleSession identifies the user of a console session for permission checks and the audit log.
+type consoleSession struct {
+	Key    string // Name or shortened ID of the API key. "local" for the terminal.
+	Role   string // Role of the key
+	Remote string // Remote address of the client. "stdin" for the terminal.
+	Batch  bool   // Batch mode: No banner and help, and commands end at the end of the input
+	JSON   bool   // Start in JSON mode
+}
+
+// localSession is the session of the local terminal. It has the admin role.
+var localSession = &consoleSession{Key: "local", Role: roleAdmin, Remote: "stdin"}
+
+// allowed checks if the session may run the command.
+func (session *consoleSession) allowed(command string) bool {
+	return roleAllowed(session.Role, command)
+}
+
+// apiKeysConfigured checks if any API key is configured.
+func apiKeysConfigured() bool {
+	return config.APIKey != uuid.Nil || len(config.APIKeys) > 0
+}
+
+// lookupAPIKey returns the name and role of the key. Found is false if the key is unknown.
+func lookupAPIKey(key uuid.UUID) (name, role string, found bool) {
+	if key == uuid.Nil {
+		return "", "", false
+	}
+
+	if key == config.APIKey {
+		return "APIKey", roleAdmin, true
+	}
+
+	for _, entry := range config.APIKeys {
+		if entry.Key == key {
+			name = entry.Name
+			if name == "" {
+				name = entry.Key.String()[:8]
+			}
+			return name, strings.ToLower(entry.Role), true
+		}
+	}
+
+	return "", "", false
+}
+
+type apiSessionContextKey struct{}
+
+// APIKeyMiddleware authenticates requests via the x-api-key header and stores the session in the request context.
+// The paths in AllowKeyInParam accept the key as &k= parameter, which is required for websockets in browsers.
+// If no key is configured, all requests are allowed with the admin role.
+func APIKeyMiddleware(AllowKeyInParam *[]string) func(http.Handler) http.Handler {
+	return (func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session := &consoleSession{Key: "anonymous", Role: roleAdmin, Remote: r.RemoteAddr}
+
+			if apiKeysConfigured() {
+				keyID, err := uuid.Parse(r.Header.Get("x-api-key"))
+				if err != nil { // special case for some paths
+					for _, exceptPath := range *AllowKeyInParam {
+						if exceptPath == r.URL.Path {
+							keyID, err = uuid.Parse(r.URL.Query().Get("k"))
+							break
+						}
+					}
+				}
+
+				name, role, found := lookupAPIKey(keyID)
+				if err != nil || !found {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				session.Key = name
+				session.Role = role
+			}
+
+			if !apiPathAllowed(session.Role, r.URL.Path) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiSessionContextKey{}, session)))
+		})
+	})
+}
+
+// apiPathAllowed checks if the role may access the API path. Other roles than admin are limited to the console and console commands.
+func apiPathAllowed(role, path string) bool {
+	return role == roleAdmin || path == "/console" || strings.HasPrefix(path, "/root/")
+}
+
+// apiSession returns the session of the authenticated request.
+func apiSession(r *http.Request) *consoleSession {
+	if session, ok := r.Context().Value(apiSessionContextKey{}).(*consoleSession); ok {
+		return session
+	}
+	return &consoleSession{Key: "anonymous", Role: roleReadOnly, Remote: r.RemoteAddr}
+}
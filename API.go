@@ -8,33 +8,64 @@ package main
 
 import (
 	"bytes"
+	"io"
 	"net/http"
 	"time"
 
 	"github.com/PeernetOfficial/core"
 	"github.com/PeernetOfficial/core/webapi"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+// apiNoListen is the address passed to webapi.Start. The port is invalid, no listener is started.
+const apiNoListen = "127.0.0.1:-1"
+
 func startAPI(backend *core.Backend) {
 	if len(config.APIListen) == 0 {
 		return
 	}
 
-	api := webapi.Start(backend, config.APIListen, config.APIUseSSL, config.APICertificateFile, config.APICertificateKey, parseDuration(config.APITimeoutRead), parseDuration(config.APITimeoutWrite), config.APIKey)
+	// webapi.Start always starts its own listeners which cannot be shut down. It is therefore passed an invalid address so that its listener
+	// fails immediately (the core logs the error once), and the configured API listeners are served by startWebServer instead.
+	// This allows certificate reloading and graceful shutdown, and all requests pass the access log and the authentication.
+	// Authentication is done by APIKeyMiddleware instead of webapi to support multiple keys with roles.
+	api := webapi.Start(backend, []string{apiNoListen}, false, "", "", parseDuration(config.APITimeoutRead), parseDuration(config.APITimeoutWrite), uuid.Nil)
+	api.Router.Use(APIKeyMiddleware(&api.AllowKeyInParam))
 
 	api.InitGeoIPDatabase(backend.Config.GeoIPDatabase)
 
 	api.AllowKeyInParam = append(api.AllowKeyInParam, "/console")
 
 	api.Router.HandleFunc("/console", apiConsole(backend)).Methods("GET")
+	startAPICommands(backend, api)
+
+	// The access log wraps the router so that requests rejected by the authentication are logged too.
+	handler := AccessLogMiddleware(accessLog, "API")(api.Router)
+
+	for _, listen := range config.APIListen {
+		go startWebServer(listen, config.APIUseSSL, config.APICertificateFile, config.APICertificateKey, handler, "API", parseDuration(config.APITimeoutRead), parseDuration(config.APITimeoutWrite))
+	}
 }
 
+// Settings of console websockets. A ping is sent every consolePingPeriod and the connection is closed if no pong or message is received within consolePongWait.
+const (
+	consolePongWait     = 60 * time.Second
+	consolePingPeriod   = consolePongWait * 9 / 10
+	consoleWriteWait    = 10 * time.Second
+	consoleMaxMessage   = 64 * 1024 // Max size of a single incoming message
+	consoleInputPending = 64        // Max count of incoming messages waiting to be processed
+)
+
 /*
 apiConsole provides a websocket to send/receive internal commands.
 
 Request:    GET /console
 Result:     Upgrade to websocket. The websocket message are texts to read/write.
+
+Each session has its own command handler connected via pipes. Output is forwarded to the websocket as soon as it is written.
+Output of other sessions and the backend log is not sent. The command handler is terminated when the websocket closes.
+The allowed commands depend on the role of the API key.
 */
 func apiConsole(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -45,53 +76,94 @@ func apiConsole(backend *core.Backend) func(w http.ResponseWriter, r *http.Reque
 		}
 		defer c.Close()
 
-		bufferR := bytes.NewBuffer(make([]byte, 0, 4096))
-		bufferW := bytes.NewBuffer(make([]byte, 0, 4096))
-
-		// subscribe to any output sent to backend.Stdout
-		subscribeID := backend.Stdout.Subscribe(bufferW)
-		defer backend.Stdout.Unsubscribe(subscribeID)
+		inputR, inputW := io.Pipe()
+		outputR, outputW := io.Pipe()
 
 		// the terminate signal is used to signal the command handler in case the websocket is closed
 		terminateSignal := make(chan struct{})
-		defer close(terminateSignal)
 
 		// start userCommands which handles the actual commands
-		go userCommands(backend, bufferR, bufferW, terminateSignal)
+		go func() {
+			userCommands(backend, inputR, outputW, terminateSignal, apiSession(r))
+			outputW.Close()
+		}()
 
-		// go routine to receive output from userCommands and forward to websocket
+		// forward output from userCommands to the websocket
 		go func() {
-			bufferW2 := make([]byte, 4096)
+			buffer := make([]byte, 4096)
 			for {
-				select {
-				case <-terminateSignal:
+				countRead, err := outputR.Read(buffer)
+				if countRead > 0 {
+					c.SetWriteDeadline(time.Now().Add(consoleWriteWait))
+					if err := c.WriteMessage(websocket.TextMessage, buffer[:countRead]); err != nil {
+						// Discard any further output so the command handler never blocks on a broken websocket.
+						io.Copy(io.Discard, outputR)
+						return
+					}
+				}
+				if err != nil { // closed after userCommands returns
 					return
-				default:
 				}
+			}
+		}()
 
-				countRead, err := bufferW.Read(bufferW2)
-				if err != nil || countRead == 0 {
-					time.Sleep(50 * time.Millisecond)
-					continue
+		// forward input to userCommands. A queue decouples the websocket from commands that take a long time, so pongs are still processed.
+		inputQueue := make(chan []byte, consoleInputPending)
+		go func() {
+			for message := range inputQueue {
+				if _, err := inputW.Write(message); err != nil {
+					return
 				}
+			}
+		}()
 
-				c.WriteMessage(websocket.TextMessage, bufferW2[:countRead])
+		// keepalive
+		go func() {
+			ticker := time.NewTicker(consolePingPeriod)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(consoleWriteWait)); err != nil {
+						return
+					}
+				case <-terminateSignal:
+					return
+				}
 			}
 		}()
 
+		c.SetReadLimit(consoleMaxMessage)
+		c.SetReadDeadline(time.Now().Add(consolePongWait))
+		c.SetPongHandler(func(string) error {
+			c.SetReadDeadline(time.Now().Add(consolePongWait))
+			return nil
+		})
+
 		// read from websocket loop and forward to the userCommands routine
 		for {
 			_, message, err := c.ReadMessage()
 			if err != nil { // when channel is closed, an error is returned here
 				break
 			}
+			c.SetReadDeadline(time.Now().Add(consolePongWait))
 
 			// make sure the message has the \n delimiter which is used to detect a line
 			if !bytes.HasSuffix(message, []byte{'\n'}) {
 				message = append(message, '\n')
 			}
 
-			bufferR.Write(message)
+			select {
+			case inputQueue <- message:
+			default:
+				outputW.Write([]byte("Input discarded: Too many commands pending.\n"))
+			}
 		}
+
+		// Terminate the command handler. Closing the input pipe unblocks a pending read.
+		close(terminateSignal)
+		close(inputQueue)
+		inputR.Close()
 	}
 }
@@ -0,0 +1,294 @@
+/*
+File Name:  Access Log.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+HTTP access log for the statistics web server and the API. Supported formats:
+* common    NCSA Common Log Format
+* combined  Common Log Format plus referer and user agent
+* json      One JSON object per line
+
+The log file is rotated when it exceeds the maximum size. Client IPs can be anonymized by zeroing the last IPv4 octet and the last 80 bits of IPv6 addresses.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accessLogFormatCommon   = "common"
+	accessLogFormatCombined = "combined"
+	accessLogFormatJSON     = "json"
+)
+
+// accessLogger writes access log records to a rotating file.
+type accessLogger struct {
+	format    string // Log format
+	anonymize bool   // Whether to anonymize client IPs
+
+	sync.Mutex
+	filename string   // Log file name
+	maxSize  int64    // Max size in bytes before rotation. 0 = no rotation.
+	maxFiles int      // Count of rotated files to keep.
+	file     *os.File // Current log file
+	size     int64    // Current size of the log file
+}
+
+// accessLog is the global access logger. Nil if disabled.
+var accessLog *accessLogger
+
+// initAccessLog opens the access log file if configured.
+func initAccessLog() {
+	if config.AccessLogFile == "" {
+		return
+	}
+
+	format := strings.ToLower(config.AccessLogFormat)
+	switch format {
+	case "":
+		format = accessLogFormatCombined
+	case accessLogFormatCommon, accessLogFormatCombined, accessLogFormatJSON:
+	default:
+		log.Printf("Unknown access log format '%s'. Valid formats are common, combined and json.\n", config.AccessLogFormat)
+		return
+	}
+
+	logger := &accessLogger{
+		format:    format,
+		anonymize: config.AccessLogAnonymize,
+		filename:  config.AccessLogFile,
+		maxSize:   int64(config.AccessLogMaxSize) * 1024 * 1024,
+		maxFiles:  config.AccessLogMaxFiles,
+	}
+
+	if err := logger.open(); err != nil {
+		log.Printf("Error opening access log file '%s': %v\n", config.AccessLogFile, err)
+		return
+	}
+
+	accessLog = logger
+}
+
+// open opens the log file for appending.
+func (logger *accessLogger) open() (err error) {
+	if logger.file, err = os.OpenFile(logger.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+
+	stat, err := logger.file.Stat()
+	if err != nil {
+		return err
+	}
+	logger.size = stat.Size()
+
+	return nil
+}
+
+// rotate renames the current log file to .1, shifting older files by one. The oldest file is deleted.
+func (logger *accessLogger) rotate() (err error) {
+	logger.file.Close()
+
+	if logger.maxFiles > 0 {
+		os.Remove(logger.filename + "." + strconv.Itoa(logger.maxFiles))
+
+		for n := logger.maxFiles - 1; n >= 1; n-- {
+			os.Rename(logger.filename+"."+strconv.Itoa(n), logger.filename+"."+strconv.Itoa(n+1))
+		}
+
+		os.Rename(logger.filename, logger.filename+".1")
+	} else {
+		os.Remove(logger.filename)
+	}
+
+	return logger.open()
+}
+
+// write writes a single line to the log file and rotates it if needed.
+func (logger *accessLogger) write(line []byte) {
+	logger.Lock()
+	defer logger.Unlock()
+
+	if logger.file == nil {
+		return
+	}
+
+	if logger.maxSize > 0 && logger.size+int64(len(line)) > logger.maxSize && logger.size > 0 {
+		if err := logger.rotate(); err != nil {
+			log.Printf("Error rotating access log file '%s': %v\n", logger.filename, err)
+			logger.file = nil
+			return
+		}
+	}
+
+	n, _ := logger.file.Write(line)
+	logger.size += int64(n)
+}
+
+// Close closes the log file.
+func (logger *accessLogger) Close() {
+	logger.Lock()
+	defer logger.Unlock()
+
+	if logger.file != nil {
+		logger.file.Close()
+		logger.file = nil
+	}
+}
+
+// anonymizeIP zeroes the last octet of IPv4 addresses and the last 80 bits of IPv6 addresses.
+func anonymizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32))
+	}
+	return ip.Mask(net.CIDRMask(48, 128))
+}
+
+// accessLogRecord is a single request in JSON format.
+type accessLogRecord struct {
+	Time      time.Time `json:"time"`      // Time the request was received
+	Server    string    `json:"server"`    // Name of the server that handled the request
+	Remote    string    `json:"remote"`    // Client IP
+	Method    string    `json:"method"`    // HTTP method
+	URI       string    `json:"uri"`       // Request URI
+	Protocol  string    `json:"protocol"`  // HTTP protocol version
+	Status    int       `json:"status"`    // Response status code
+	Bytes     int64     `json:"bytes"`     // Response body size in bytes
+	Duration  float64   `json:"duration"`  // Duration in milliseconds
+	Referer   string    `json:"referer"`   // Referer header
+	UserAgent string    `json:"useragent"` // User agent
+}
+
+// log writes the record in the configured format.
+func (logger *accessLogger) log(record *accessLogRecord) {
+	var line []byte
+
+	switch logger.format {
+	case accessLogFormatJSON:
+		line, _ = json.Marshal(record)
+		line = append(line, '\n')
+
+	default:
+		bytesA := "-"
+		if record.Bytes > 0 {
+			bytesA = strconv.FormatInt(record.Bytes, 10)
+		}
+
+		text := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s", record.Remote, record.Time.Format("02/Jan/2006:15:04:05 -0700"), record.Method, record.URI, record.Protocol, record.Status, bytesA)
+		if logger.format == accessLogFormatCombined {
+			text += fmt.Sprintf(" %s %s", strconv.Quote(record.Referer), strconv.Quote(record.UserAgent))
+		}
+		line = []byte(text + "\n")
+	}
+
+	logger.write(line)
+}
+
+// AccessLogMiddleware logs every request to the access log. Server is the name of the server logged in JSON format.
+// It returns a middleware function to be used with mux.Router.Use() or to wrap a handler. If the logger is nil, the handler is returned unchanged.
+func AccessLogMiddleware(logger *accessLogger, Server string) func(http.Handler) http.Handler {
+	return (func(next http.Handler) http.Handler {
+		if logger == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w}
+
+			next.ServeHTTP(recorder, r)
+
+			remote, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				remote = r.RemoteAddr
+			}
+			if ip := net.ParseIP(remote); ip != nil && logger.anonymize {
+				remote = anonymizeIP(ip).String()
+			}
+
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			logger.log(&accessLogRecord{
+				Time:      started,
+				Server:    Server,
+				Remote:    remote,
+				Method:    r.Method,
+				URI:       accessLogURI(r),
+				Protocol:  r.Proto,
+				Status:    status,
+				Bytes:     recorder.bytes,
+				Duration:  float64(time.Since(started).Microseconds()) / 1000,
+				Referer:   r.Referer(),
+				UserAgent: r.UserAgent(),
+			})
+		})
+	})
+}
+
+// accessLogURI returns the request URI without the API key, which may be passed via the query parameter k.
+func accessLogURI(r *http.Request) string {
+	query := r.URL.Query()
+	if !query.Has("k") {
+		return r.RequestURI
+	}
+
+	query.Del("k")
+	if len(query) == 0 {
+		return r.URL.EscapedPath()
+	}
+	return r.URL.EscapedPath() + "?" + query.Encode()
+}
+
+// statusRecorder records the status code and response size.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int   // Status code
+	bytes  int64 // Bytes written
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (n int, err error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	n, err = recorder.ResponseWriter.Write(data)
+	recorder.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher.
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker which is required for websockets. Hijacked connections are logged with status 101.
+func (recorder *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := recorder.ResponseWriter.(http.Hijacker); ok {
+		recorder.status = http.StatusSwitchingProtocols
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("hijacking not supported")
+}
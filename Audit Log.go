@@ -0,0 +1,124 @@
+/*
+File Name:  Audit Log.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Append-only audit log of console commands. Each command entered in the terminal or via the /console websocket is written as one JSON object per line,
+including commands that were denied. The arguments are recorded including answers to prompts (like the data for "hash"). Arguments longer
+than 64 characters are shortened to their start and length. API keys passed as parameter k to the JSON API are never recorded.
+The file is only ever appended to and never rotated or truncated by the root peer.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditArgLengthMax is the max length of an argument in the audit log. Longer arguments are shortened.
+const auditArgLengthMax = 64
+
+// auditRecord is a single entry in the audit log.
+type auditRecord struct {
+	Time    time.Time `json:"time"`    // Time the command was entered
+	Key     string    `json:"key"`     // Name of the API key. "local" for the terminal.
+	Role    string    `json:"role"`    // Role of the key
+	Remote  string    `json:"remote"`  // Remote address of the client
+	Command string    `json:"command"` // Command
+	Args    []string  `json:"args"`    // Arguments and options of the command
+	Allowed bool      `json:"allowed"` // Whether the command was executed or denied
+}
+
+// auditLogger writes the audit log.
+type auditLogger struct {
+	sync.Mutex
+	file *os.File
+}
+
+// auditLog is the global audit logger. Nil if disabled.
+var auditLog *auditLogger
+
+// initAuditLog opens the audit log file if configured.
+func initAuditLog() {
+	if config.AuditLogFile == "" {
+		return
+	}
+
+	file, err := os.OpenFile(config.AuditLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("Error opening audit log file '%s': %v\n", config.AuditLogFile, err)
+		return
+	}
+
+	auditLog = &auditLogger{file: file}
+}
+
+// auditCommand writes the command with its arguments to the audit log, if enabled.
+func auditCommand(session *consoleSession, command string, args []string, allowed bool) {
+	if auditLog == nil {
+		return
+	}
+
+	recordArgs := make([]string, 0, len(args))
+	for _, arg := range args {
+		recordArgs = append(recordArgs, auditShortenArg(arg))
+	}
+
+	line, _ := json.Marshal(auditRecord{Time: time.Now().UTC(), Key: session.Key, Role: session.Role, Remote: session.Remote, Command: command, Args: recordArgs, Allowed: allowed})
+	line = append(line, '\n')
+
+	auditLog.Lock()
+	defer auditLog.Unlock()
+
+	if auditLog.file == nil {
+		return
+	}
+
+	if _, err := auditLog.file.Write(line); err != nil {
+		log.Printf("Error writing audit log file '%s': %v\n", config.AuditLogFile, err)
+	}
+}
+
+// auditShortenArg shortens the argument to its start and its length in bytes, if it exceeds the max length.
+func auditShortenArg(arg string) string {
+	if len(arg) <= auditArgLengthMax {
+		return arg
+	}
+
+	start := strings.ToValidUTF8(arg[:auditArgLengthMax/2], "") // drop a UTF-8 sequence cut in the middle
+	return start + "... (" + strconv.Itoa(len(arg)) + " bytes)"
+}
+
+// auditQueryArgs returns the query parameters of an API request as "name=value" arguments sorted by name. The API key parameter k is omitted.
+func auditQueryArgs(query url.Values) (args []string) {
+	for name, values := range query {
+		if name == "k" {
+			continue
+		}
+		for _, value := range values {
+			args = append(args, name+"="+value)
+		}
+	}
+	sort.Strings(args)
+	return args
+}
+
+// Close closes the audit log file.
+func (logger *auditLogger) Close() {
+	logger.Lock()
+	defer logger.Unlock()
+
+	if logger.file != nil {
+		logger.file.Sync()
+		logger.file.Close()
+		logger.file = nil
+	}
+}
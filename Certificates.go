@@ -0,0 +1,196 @@
+/*
+File Name:  Certificates.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+TLS certificates are loaded via the tls.Config.GetCertificate callback. The certificate and key files are watched for changes
+and reloaded automatically, so renewed certificates (for example by win-acme) are picked up without restarting the process.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// certificateWatchInterval defines how often the certificate files are checked for changes.
+const certificateWatchInterval = time.Minute
+
+// certificateReloader holds a certificate loaded from a certificate and key file. It is safe for concurrent use.
+type certificateReloader struct {
+	CertificateFile string // Certificate file.
+	CertificateKey  string // Private key file.
+
+	sync.RWMutex
+	certificate *tls.Certificate // Current certificate.
+	modCert     time.Time        // Modification time of the certificate file when loaded.
+	modKey      time.Time        // Modification time of the key file when loaded.
+}
+
+// certificates contains all certificate reloaders, mapped by certificate file and key file.
+var certificates = make(map[[2]string]*certificateReloader)
+var certificatesMutex sync.Mutex
+
+// getCertificateReloader returns the reloader for the certificate and key file. It is created and loaded if it does not exist yet.
+// Listeners using the same files share the same reloader.
+func getCertificateReloader(CertificateFile, CertificateKey string) (reloader *certificateReloader, err error) {
+	certificatesMutex.Lock()
+	defer certificatesMutex.Unlock()
+
+	if reloader, ok := certificates[[2]string{CertificateFile, CertificateKey}]; ok {
+		return reloader, nil
+	}
+
+	reloader = &certificateReloader{CertificateFile: CertificateFile, CertificateKey: CertificateKey}
+	if err = reloader.Reload(); err != nil {
+		return nil, err
+	}
+
+	certificates[[2]string{CertificateFile, CertificateKey}] = reloader
+
+	go reloader.watch()
+
+	return reloader, nil
+}
+
+// Reload loads the certificate and key from disk and swaps the current certificate. If loading fails, the current certificate remains in use.
+func (reloader *certificateReloader) Reload() (err error) {
+	statCert, err := os.Stat(reloader.CertificateFile)
+	if err != nil {
+		return err
+	}
+	statKey, err := os.Stat(reloader.CertificateKey)
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.CertificateFile, reloader.CertificateKey)
+	if err != nil {
+		return err
+	}
+
+	// parse the leaf certificate for the expiry date
+	if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+		return err
+	}
+
+	reloader.Lock()
+	reloader.certificate = &certificate
+	reloader.modCert = statCert.ModTime()
+	reloader.modKey = statKey.ModTime()
+	reloader.Unlock()
+
+	return nil
+}
+
+// GetCertificate returns the current certificate. It is used as tls.Config.GetCertificate callback.
+func (reloader *certificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.RLock()
+	defer reloader.RUnlock()
+
+	if reloader.certificate == nil {
+		return nil, errors.New("no certificate loaded")
+	}
+
+	return reloader.certificate, nil
+}
+
+// Expiry returns the expiry date of the current certificate.
+func (reloader *certificateReloader) Expiry() (expires time.Time) {
+	reloader.RLock()
+	defer reloader.RUnlock()
+
+	if reloader.certificate == nil || reloader.certificate.Leaf == nil {
+		return time.Time{}
+	}
+
+	return reloader.certificate.Leaf.NotAfter
+}
+
+// changed checks if the certificate or key file was modified since it was loaded.
+func (reloader *certificateReloader) changed() bool {
+	statCert, err1 := os.Stat(reloader.CertificateFile)
+	statKey, err2 := os.Stat(reloader.CertificateKey)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+
+	reloader.RLock()
+	defer reloader.RUnlock()
+
+	return !statCert.ModTime().Equal(reloader.modCert) || !statKey.ModTime().Equal(reloader.modKey)
+}
+
+// watch periodically checks the files for changes and reloads the certificate.
+func (reloader *certificateReloader) watch() {
+	for {
+		time.Sleep(certificateWatchInterval)
+
+		if !reloader.changed() {
+			continue
+		}
+
+		// The certificate and key file are usually not replaced at the same time. If they do not match yet, the next check will retry.
+		if err := reloader.Reload(); err != nil {
+			log.Printf("Error reloading certificate '%s': %v\n", reloader.CertificateFile, err)
+			continue
+		}
+
+		log.Printf("Reloaded certificate '%s', expires %s\n", reloader.CertificateFile, reloader.Expiry().UTC().Format(dateFormat))
+	}
+}
+
+func init() {
+	registerCommand(&consoleCommand{Name: "cert reload", Help: "Reload TLS certificates and show expiry dates", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		reloaders, errs := certificateReloadAll()
+		if len(reloaders) == 0 && acmeManager == nil {
+			fmt.Fprintf(ctx.Output, "No TLS certificates in use.\n")
+			return false
+		}
+
+		for n, reloader := range reloaders {
+			if errs[n] != nil {
+				fmt.Fprintf(ctx.Output, "* %s\n  Error reloading: %s\n  Current certificate expires %s\n", reloader.CertificateFile, errs[n].Error(), reloader.Expiry().UTC().Format(dateFormat))
+			} else {
+				fmt.Fprintf(ctx.Output, "* %s\n  Reloaded. Expires %s (in %d days)\n", reloader.CertificateFile, reloader.Expiry().UTC().Format(dateFormat), int(time.Until(reloader.Expiry()).Hours()/24))
+			}
+		}
+
+		if acmeManager != nil {
+			for _, domain := range config.ACMEDomains {
+				if expires, err := acmeCertificateStatus(domain); err != nil {
+					fmt.Fprintf(ctx.Output, "* ACME %s\n  No certificate: %s\n", domain, err.Error())
+				} else {
+					fmt.Fprintf(ctx.Output, "* ACME %s\n  Expires %s (in %d days). Renewed automatically.\n", domain, expires.UTC().Format(dateFormat), int(time.Until(expires).Hours()/24))
+				}
+			}
+		}
+		return false
+	}})
+}
+
+// certificateReloadAll reloads all certificates and returns the list of reloaders sorted by file name.
+// The error list has the same order as the reloaders, nil for success.
+func certificateReloadAll() (reloaders []*certificateReloader, errs []error) {
+	certificatesMutex.Lock()
+	for _, reloader := range certificates {
+		reloaders = append(reloaders, reloader)
+	}
+	certificatesMutex.Unlock()
+
+	sort.Slice(reloaders, func(i, j int) bool { return reloaders[i].CertificateFile < reloaders[j].CertificateFile })
+
+	for _, reloader := range reloaders {
+		errs = append(errs, reloader.Reload())
+	}
+
+	return reloaders, errs
+}
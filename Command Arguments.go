@@ -0,0 +1,289 @@
+/*
+File Name:  Command Arguments.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Non-interactive command syntax. Arguments can be passed on the same line as the command, for example "get block [peer ID] [block number]".
+Arguments are separated by spaces. Double or single quotes group text with spaces into a single argument, for example: run "my script.txt"
+Inside double quotes a backslash escapes the next character. Text arguments like the one of chat take the rest of the line joined by single spaces.
+Additional arguments are rejected, unless the command accepts options.
+
+Each argument answers the next prompt of the command in order. If a command has fewer arguments than prompts, the remaining prompts are read from the input as before.
+Scripts run via "run [file]" contain one command per line. Empty lines and lines starting with # are ignored.
+The file can be any path readable by the root peer and its lines are echoed, therefore "run" requires the admin role.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// scriptDepthMax is the maximum nesting of scripts running other scripts. It prevents endless recursion of scripts running themselves.
+const scriptDepthMax = 8
+
+// consoleReader reads commands and answers to prompts. Arguments of the current command and lines of scripts are read before the input.
+type consoleReader struct {
+	reader    lineReader   // Input
+	args      []string     // Remaining arguments of the current command
+	lines     []scriptLine // Queued lines of scripts
+	depth     int          // Script nesting depth of the last line read. 0 for lines from the input.
+	exitOnEOF bool         // Terminate at the end of the input instead of waiting for more
+	json      bool         // JSON mode of the session
+	jsonOnce  bool         // JSON mode for the current command only
+}
+
+// scriptLine is a queued line of a script.
+type scriptLine struct {
+	text  string // Command or answer to a prompt
+	depth int    // Script nesting depth
+}
+
+// lineReader reads a line of input. It is implemented by bufio.Reader and the line editor of the local terminal.
+type lineReader interface {
+	ReadString(delim byte) (string, error)
+}
+
+func newConsoleReader(input io.Reader, exitOnEOF bool) *consoleReader {
+	if reader, ok := input.(lineReader); ok {
+		return &consoleReader{reader: reader, exitOnEOF: exitOnEOF}
+	}
+	return &consoleReader{reader: bufio.NewReader(input), exitOnEOF: exitOnEOF}
+}
+
+// nextArg returns the next argument of the current command, if any.
+func (reader *consoleReader) nextArg() (arg string, ok bool) {
+	if len(reader.args) == 0 {
+		return "", false
+	}
+	arg = reader.args[0]
+	reader.args = reader.args[1:]
+	return arg, true
+}
+
+// nextLine returns the next queued script line, if any.
+func (reader *consoleReader) nextLine() (line string, ok bool) {
+	if len(reader.lines) == 0 {
+		return "", false
+	}
+	line = reader.lines[0].text
+	reader.depth = reader.lines[0].depth
+	reader.lines = reader.lines[1:]
+	return line, true
+}
+
+// jsonOutput checks if the current command shall write JSON instead of text.
+func (reader *consoleReader) jsonOutput() bool {
+	return reader.json || reader.jsonOnce
+}
+
+// prompt prints the text unless the answer is already provided as argument. No prompts are printed in JSON mode.
+func (reader *consoleReader) prompt(output io.Writer, text string) {
+	if len(reader.args) == 0 && !reader.jsonOutput() {
+		fmt.Fprint(output, text)
+	}
+}
+
+// readScript reads the commands from the script file.
+func readScript(filename string) (lines []string, err error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// queueScript reads the script file and queues its commands before any other input.
+func (reader *consoleReader) queueScript(filename string) (count int, err error) {
+	lines, err := readScript(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	if reader.depth >= scriptDepthMax {
+		return 0, errors.New("too many nested scripts")
+	}
+
+	var queue []scriptLine
+	for _, line := range lines {
+		queue = append(queue, scriptLine{text: line, depth: reader.depth + 1})
+	}
+	reader.lines = append(queue, reader.lines...)
+
+	return len(lines), nil
+}
+
+// readCommand reads the next command line and splits it into the command and its arguments.
+// The command is lower case. Arguments are kept as is and are used for the following prompts. The argument --json is removed and enables JSON mode for the command.
+func (reader *consoleReader) readCommand(terminateSignal <-chan struct{}) (command string, args []string, terminate bool, err error) {
+	reader.args = nil
+	reader.jsonOnce = false
+
+	line, _, terminate := readUserText(reader, terminateSignal)
+	if terminate {
+		return "", nil, true, nil
+	}
+
+	tokens, err := splitCommandLine(line)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	var filtered []string
+	for _, token := range tokens {
+		if strings.ToLower(token) == jsonArgument {
+			reader.jsonOnce = true
+		} else {
+			filtered = append(filtered, token)
+		}
+	}
+
+	command, args = matchCommand(filtered)
+	reader.args = args
+
+	return command, args, false, nil
+}
+
+// splitCommandLine splits the line into arguments separated by spaces. Quotes group text into a single argument.
+func splitCommandLine(line string) (args []string, err error) {
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, char := range line {
+		switch {
+		case escaped:
+			current.WriteRune(char)
+			escaped = false
+
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			} else if char == '\\' && quote == '"' {
+				escaped = true
+			} else {
+				current.WriteRune(char)
+			}
+
+		case char == '"' || char == '\'':
+			quote = char
+			inArg = true
+
+		case char == ' ' || char == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+
+		default:
+			current.WriteRune(char)
+			inArg = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote")
+	}
+
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+// matchCommand finds the longest registered command at the start of the tokens. Commands consisting of multiple words are matched before shorter ones.
+// If no command matches, the first token is returned as command.
+func matchCommand(tokens []string) (command string, args []string) {
+	if len(tokens) == 0 {
+		return "", nil
+	}
+
+	bestWords := 0
+	for _, known := range commandNames() {
+		words := strings.Fields(known)
+		if len(words) <= bestWords || len(words) > len(tokens) {
+			continue
+		}
+
+		match := true
+		for n, word := range words {
+			if strings.ToLower(tokens[n]) != word {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			command = known
+			bestWords = len(words)
+		}
+	}
+
+	if bestWords == 0 {
+		return strings.ToLower(tokens[0]), tokens[1:]
+	}
+
+	return command, tokens[bestWords:]
+}
+
+func init() {
+	registerCommand(&consoleCommand{Name: "run", Args: []commandArg{{Name: "file"}}, Help: "Run commands from a script file", Role: roleAdmin, Handler: func(ctx *commandContext) bool {
+		filename := ctx.Arg(0)
+		if filename == "" {
+			fmt.Fprintf(ctx.Output, "Please specify the script file: run [file]\n")
+			return false
+		}
+
+		if count, err := ctx.Reader.queueScript(filename); err != nil {
+			fmt.Fprintf(ctx.Output, "Error reading script '%s': %s\n", filename, err.Error())
+		} else if ctx.Session.Batch {
+			fmt.Fprintf(ctx.Output, "Running %d commands from '%s'.\n", count, filename)
+		}
+		return false
+	}})
+}
+
+// exitErrorScript is the exit code if the script file cannot be read in command line mode.
+const exitErrorScript = 22
+
+// runCommandLine executes the commands from the script file (optional) and the command line arguments and exits.
+// Each argument is a single command line including its arguments, for example: root "get block [peer ID] 0" status
+// The statistics, web servers and API are not started. If json is set, supported commands write JSON instead of text.
+func runCommandLine(backend *core.Backend, filename string, commands []string, json bool) {
+	var lines []string
+
+	if filename != "" {
+		var err error
+		if lines, err = readScript(filename); err != nil {
+			fmt.Printf("Error reading script '%s': %s\n", filename, err.Error())
+			os.Exit(exitErrorScript)
+		}
+	}
+	lines = append(lines, commands...)
+
+	backend.Connect()
+
+	session := &consoleSession{Key: "cli", Role: roleAdmin, Remote: "command line", Batch: true, JSON: json}
+	userCommands(backend, strings.NewReader(strings.Join(lines, "\n")+"\n"), os.Stdout, nil, session)
+
+	os.Exit(core.ExitSuccess)
+}
@@ -0,0 +1,44 @@
+/*
+File Name:  Command Arguments_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	for _, test := range []struct {
+		line  string
+		args  []string
+		valid bool
+	}{
+		{``, nil, true},
+		{`   `, nil, true},
+		{`status`, []string{"status"}, true},
+		{`  get block  abc	1 `, []string{"get", "block", "abc", "1"}, true},
+		{`download p h "my file.txt"`, []string{"download", "p", "h", "my file.txt"}, true},
+		{`chat 'single "quoted"'`, []string{"chat", `single "quoted"`}, true},
+		{`chat "double 'quoted'"`, []string{"chat", "double 'quoted'"}, true},
+		{`a "escaped \" quote"`, []string{"a", `escaped " quote`}, true},
+		{`a "escaped \\ backslash"`, []string{"a", `escaped \ backslash`}, true},
+		{`a 'no \escape'`, []string{"a", `no \escape`}, true},
+		{`a no\escape`, []string{"a", `no\escape`}, true},
+		{`a "" b`, []string{"a", "", "b"}, true},
+		{`a"b c"d`, []string{"ab cd"}, true},
+		{`a "b`, nil, false},
+		{`a 'b`, nil, false},
+		{`a "b\`, nil, false},
+	} {
+		args, err := splitCommandLine(test.line)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: error %v, expected valid %t", test.line, err, test.valid)
+		} else if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%q: arguments %q, expected %q", test.line, args, test.args)
+		}
+	}
+}
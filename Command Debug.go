@@ -20,6 +20,132 @@ import (
 	"github.com/PeernetOfficial/core/protocol"
 )
 
+func init() {
+	registerCommand(&consoleCommand{Name: "debug key create", Help: "Create Public-Private Key pair", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		privateKey, publicKey, err := core.Secp256k1NewPrivateKey()
+		if err != nil {
+			fmt.Fprintf(ctx.Output, "Error: %s\n", err.Error())
+			return false
+		}
+
+		fmt.Fprintf(ctx.Output, "Private Key: %s\n", hex.EncodeToString(privateKey.Serialize()))
+		fmt.Fprintf(ctx.Output, "Public Key:  %s\n", hex.EncodeToString(publicKey.SerializeCompressed()))
+		return false
+	}})
+
+	registerCommand(&consoleCommand{Name: "debug key self", Help: "List current Public-Private Key pair", Role: roleAdmin, Handler: func(ctx *commandContext) bool {
+		privateKey, publicKey := ctx.Backend.ExportPrivateKey()
+		fmt.Fprintf(ctx.Output, "Private Key: %s\n", hex.EncodeToString(privateKey.Serialize()))
+		fmt.Fprintf(ctx.Output, "Public Key:  %s\n", hex.EncodeToString(publicKey.SerializeCompressed()))
+		return false
+	}})
+
+	registerCommand(&consoleCommand{Name: "debug connect", Args: []commandArg{{Name: "peer ID", Complete: completePeerIDs, Prompt: "Please specify the target peer to connect to via DHT lookup, either by peer ID or node ID:"}}, Help: "Attempts to connect to the target peer", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		text := ctx.Arg(0)
+		if len(text) != 66 && len(text) != 64 {
+			fmt.Fprintf(ctx.Output, "Invalid peer ID or node ID. It must be hex-encoded and 66 (peer ID) or 64 characters (node ID) long.\n")
+			return false
+		}
+
+		// node ID is required
+		var nodeID []byte
+		var err error
+
+		if len(text) == 66 {
+			// Assume peer ID was supplied.
+			publicKeyB, err := hex.DecodeString(text)
+			if err != nil || len(publicKeyB) != 33 {
+				fmt.Fprintf(ctx.Output, "Invalid peer ID encoding.\n")
+				return false
+			}
+
+			publicKey, err := btcec.ParsePubKey(publicKeyB, btcec.S256())
+			if err != nil {
+				fmt.Fprintf(ctx.Output, "Invalid peer ID (public key decoding failed).\n")
+				return false
+			}
+
+			nodeID = protocol.PublicKey2NodeID(publicKey)
+		} else {
+			// Node ID was supplied.
+			if nodeID, err = hex.DecodeString(text); err != nil || len(nodeID) != 256/8 {
+				fmt.Fprintf(ctx.Output, "Invalid node ID encoding.\n")
+				return false
+			}
+		}
+
+		// is self?
+		if bytes.Equal(nodeID, ctx.Backend.SelfNodeID()) {
+			fmt.Fprintf(ctx.Output, "Target node is self.\n")
+			return false
+		}
+
+		debugCmdConnect(ctx.Backend, nodeID, ctx.Output)
+		return false
+	}})
+
+	registerCommand(&consoleCommand{Name: "debug watch searches", Args: []commandArg{{Name: "1|0", Prompt: "Enable (1) or disable (0) watching of all outgoing DHT searches?"}}, Help: "Watch all outgoing DHT searches", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		debugWatchAll(ctx, keyMonitorAllSearches)
+		return false
+	}})
+
+	registerCommand(&consoleCommand{Name: "debug watch incoming", Args: []commandArg{{Name: "1|0", Prompt: "Enable (1) or disable (0) watching of all incoming information requests?"}}, Help: "Watch all incoming information requests", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		debugWatchAll(ctx, keyMonitorAllRequests)
+		return false
+	}})
+
+	registerCommand(&consoleCommand{Name: "debug bucket refresh", Args: []commandArg{{Name: "1|0", Prompt: "Disable (1) or enable (0) bucket refresh. This can be useful to disable bucket refresh when debugging outgoing DHT searches."}}, Help: "Disable or enable the DHT bucket refresh", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		if number, valid := ctx.ArgInt(0); valid && number >= 0 && number <= 1 {
+			dht.DisableBucketRefresh = number == 1
+			fmt.Fprintf(ctx.Output, "Bucket refresh disabled: %t\n", dht.DisableBucketRefresh)
+		} else {
+			fmt.Fprintf(ctx.Output, "Invalid option.\n")
+		}
+		return false
+	}})
+
+	registerCommand(&consoleCommand{Name: "debug watch", Args: []commandArg{{Name: "hash", Prompt: "Enter hash of data or node ID to watch. This monitors info requests and packets. Enter same hash again to remove from list."}}, Help: "Watch packets and info requests for hash", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		hash, valid := ctx.ArgHash(0)
+		if !valid {
+			fmt.Fprintf(ctx.Output, "Invalid hash. Hex-encoded 64 character hash expected.\n")
+			return false
+		}
+
+		if added, conflict := hashMonitorControl(hash, 2, ctx.Output); conflict {
+			fmt.Fprintf(ctx.Output, "The hash is monitored by another session.\n")
+		} else if added {
+			ctx.MonitoredHashes[string(hash)] = struct{}{}
+			fmt.Fprintf(ctx.Output, "The hash was added to the monitoring list.\n")
+		} else {
+			delete(ctx.MonitoredHashes, string(hash))
+			fmt.Fprintf(ctx.Output, "The hash was removed from the monitoring list.\n")
+		}
+		return false
+	}})
+}
+
+// debugWatchAll enables (1) or disables (0) monitoring of the special key as selected by the first argument.
+func debugWatchAll(ctx *commandContext, key string) {
+	number, valid := ctx.ArgInt(0)
+	if !valid || number < 0 || number > 1 {
+		fmt.Fprintf(ctx.Output, "Invalid option.\n")
+		return
+	}
+
+	action := 1
+	if number == 1 {
+		action = 0
+	}
+
+	if _, conflict := hashMonitorControl([]byte(key), action, ctx.Output); conflict {
+		fmt.Fprintf(ctx.Output, "Watching is enabled by another session.\n")
+	} else if number == 1 {
+		ctx.MonitoredHashes[key] = struct{}{}
+	} else {
+		delete(ctx.MonitoredHashes, key)
+	}
+}
+
 // debugCmdConnect connects to the node ID
 func debugCmdConnect(backend *core.Backend, nodeID []byte, output io.Writer) {
 	fmt.Fprintf(output, "---------------- Connect to node %s ----------------\n", hex.EncodeToString(nodeID))
@@ -33,7 +159,7 @@ func debugCmdConnect(backend *core.Backend, nodeID []byte, output io.Writer) {
 		fmt.Fprintf(output, "* In local routing table: No. Lookup via DHT. Timeout = 10 seconds.\n")
 
 		hashMonitorControl(nodeID, 0, output)
-		defer hashMonitorControl(nodeID, 1, nil)
+		defer hashMonitorControl(nodeID, 1, output)
 
 		// Discovery via DHT.
 		_, peer, _ = backend.FindNode(nodeID, time.Second*10)
@@ -71,11 +197,17 @@ func debugCmdConnect(backend *core.Backend, nodeID []byte, output io.Writer) {
 var monitorKeys map[string]io.Writer = make(map[string]io.Writer)
 var monitorKeysMutex sync.RWMutex
 
-// hashMonitorControl adds (0), removes (1), or inverts (2) a hash on the list
-func hashMonitorControl(key []byte, action int, output io.Writer) (added bool) {
+// hashMonitorControl adds (0), removes (1), or inverts (2) a hash on the list. The output that added a hash owns it.
+// A hash monitored by another output is not changed and conflict is returned, so that sessions cannot take over or remove the monitoring of others.
+func hashMonitorControl(key []byte, action int, output io.Writer) (added, conflict bool) {
 	monitorKeysMutex.Lock()
 	defer monitorKeysMutex.Unlock()
 
+	current, exists := monitorKeys[string(key)]
+	if exists && current != output {
+		return false, true
+	}
+
 	switch action {
 	case 0:
 		monitorKeys[string(key)] = output
@@ -83,7 +215,7 @@ func hashMonitorControl(key []byte, action int, output io.Writer) (added bool) {
 	case 1:
 		delete(monitorKeys, string(key))
 	case 2:
-		if _, ok := monitorKeys[string(key)]; !ok {
+		if !exists {
 			monitorKeys[string(key)] = output
 			added = true
 		} else {
@@ -166,6 +298,10 @@ func filterIncomingRequest(peer *core.PeerInfo, Action int, Key []byte, Info int
 // ---- filter for incoming and outgoing packets ----
 
 func filterMessageIn(peer *core.PeerInfo, raw *protocol.MessageRaw, message interface{}) {
+	if response, ok := message.(*protocol.MessageResponse); ok {
+		fileLookupResponse(response)
+	}
+
 	monitored, output := hashIsMonitored(peer.NodeID)
 	if !monitored {
 		// TODO: For Announcement/Response also check data, Traverse the final target
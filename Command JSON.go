@@ -0,0 +1,435 @@
+/*
+File Name:  Command JSON.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Machine-readable output of console commands. In JSON mode the commands status, peer list, net list, transfer list, search file and hash
+write a single JSON object per command on one line instead of the text output. Errors are written as {"error": "..."}.
+Other commands write their regular text output.
+
+JSON mode is enabled for a single command by adding the argument --json, for example "status --json", or for the rest of the session via "output json".
+Prompts are not printed in JSON mode, answers must be passed as arguments.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/PeernetOfficial/core/protocol"
+	"github.com/PeernetOfficial/core/search"
+)
+
+// jsonArgument is the argument to request JSON output for a single command.
+const jsonArgument = "--json"
+
+// jsonConsoleError is written in JSON mode if a command fails.
+type jsonConsoleError struct {
+	Error string `json:"error"` // Error message
+}
+
+// jsonConsoleStatus is the output of "status".
+type jsonConsoleStatus struct {
+	PublicKey   string               `json:"publickey"`       // Public key of this peer
+	NodeID      string               `json:"nodeid"`          // Node ID of this peer
+	UserAgent   string               `json:"useragent"`       // User agent of this peer
+	Features    jsonConsoleFeatures  `json:"features"`        // Supported features
+	Networks    []jsonConsoleNetwork `json:"networks"`        // Networks the peer listens on
+	Peers       []jsonConsolePeer    `json:"peers,omitempty"` // Current peers matching the filter. Omitted with the count option.
+	PeerSummary peerSummary          `json:"peersummary"`     // Count of all peers and of the matching ones
+}
+
+// jsonConsoleFeatures are the feature bits reported to other peers.
+type jsonConsoleFeatures struct {
+	Bits       uint8 `json:"bits"`       // Raw feature bit array
+	IPv4Listen bool  `json:"ipv4listen"` // Listening on IPv4
+	IPv6Listen bool  `json:"ipv6listen"` // Listening on IPv6
+	Firewall   bool  `json:"firewall"`   // Firewall reported
+}
+
+// jsonConsoleNetwork is a network the peer listens on.
+type jsonConsoleNetwork struct {
+	IPVersion    int      `json:"ipversion"`              // 4 or 6
+	Adapter      string   `json:"adapter"`                // Name of the network adapter, if available
+	Listen       string   `json:"listen"`                 // Listen address
+	Multicast    string   `json:"multicast,omitempty"`    // IPv6 only: Multicast IP
+	Broadcast    []string `json:"broadcast,omitempty"`    // IPv4 only: Broadcast IPs
+	ExternalIP   string   `json:"externalip,omitempty"`   // External IP, if known
+	ExternalPort uint16   `json:"externalport,omitempty"` // External port, if known
+}
+
+// jsonConsolePeer is a peer in the status output and the peer list.
+type jsonConsolePeer struct {
+	PublicKey         string                  `json:"publickey"`             // Public key of the peer
+	NodeID            string                  `json:"nodeid"`                // Node ID of the peer
+	UserAgent         string                  `json:"useragent"`             // User agent
+	Address           string                  `json:"address"`               // Address of the first active connection. Empty if none.
+	PacketsSent       uint64                  `json:"packetssent"`           // Count of packets sent
+	PacketsReceived   uint64                  `json:"packetsreceived"`       // Count of packets received
+	RTT               int64                   `json:"rtt"`                   // Round-trip time in milliseconds. 0 if not known.
+	Flags             string                  `json:"flags"`                 // Same as in the text output: R = root peer, N = behind NAT, F = firewall reported
+	RootPeer          bool                    `json:"rootpeer"`              // Whether the peer is a root peer
+	NAT               bool                    `json:"nat"`                   // Whether the peer is behind a NAT
+	Firewall          bool                    `json:"firewall"`              // Whether the peer reported a firewall
+	BlockchainHeight  uint64                  `json:"blockchainheight"`      // Blockchain height
+	BlockchainVersion uint64                  `json:"blockchainversion"`     // Blockchain version
+	Connections       []jsonConsoleConnection `json:"connections,omitempty"` // Connections. Peer list only.
+}
+
+// jsonConsoleConnection is a connection to a peer.
+type jsonConsoleConnection struct {
+	Status        string    `json:"status"`        // Connection status
+	Adapter       string    `json:"adapter"`       // Name of the network adapter, if available
+	Local         string    `json:"local"`         // Local listen address
+	Remote        string    `json:"remote"`        // Remote address
+	LastPacketIn  time.Time `json:"lastpacketin"`  // Last incoming packet
+	LastPacketOut time.Time `json:"lastpacketout"` // Last outgoing packet
+	RTT           int64     `json:"rtt"`           // Round-trip time in milliseconds. 0 if not known.
+	PortInternal  uint16    `json:"portinternal"`  // Internal port reported by the remote peer
+	PortExternal  uint16    `json:"portexternal"`  // External port reported by the remote peer
+}
+
+// jsonConsolePeerList is the output of "peer list".
+type jsonConsolePeerList struct {
+	Peers   []jsonConsolePeer `json:"peers"`   // Peers matching the filter on the requested page
+	Summary peerSummary       `json:"summary"` // Count of all peers and of the matching ones
+}
+
+// jsonConsoleInterface is a network interface in the output of "net list".
+type jsonConsoleInterface struct {
+	Name string   `json:"name"` // Name of the interface
+	IPs  []string `json:"ips"`  // IPs of the interface
+}
+
+// jsonConsoleNetList is the output of "net list".
+type jsonConsoleNetList struct {
+	Interfaces []jsonConsoleInterface `json:"interfaces"`
+}
+
+// jsonConsoleTransfer is a file or block transfer.
+type jsonConsoleTransfer struct {
+	Type            string   `json:"type"`                      // "file" or "block"
+	LiteID          string   `json:"liteid"`                    // Lite session ID
+	Peer            string   `json:"peer"`                      // Public key of the remote peer
+	Direction       string   `json:"direction"`                 // In, Out or Bi
+	Hash            string   `json:"hash,omitempty"`            // File transfer only: Hash of the file
+	FileSize        uint64   `json:"filesize,omitempty"`        // File transfer only: File size
+	Offset          uint64   `json:"offset,omitempty"`          // File transfer only: Offset
+	Limit           uint64   `json:"limit,omitempty"`           // File transfer only: Limit
+	Blockchain      string   `json:"blockchain,omitempty"`      // Block transfer only: Public key of the blockchain
+	TargetBlocks    []string `json:"targetblocks,omitempty"`    // Block transfer only: Requested block ranges
+	LimitBlockCount uint64   `json:"limitblockcount,omitempty"` // Block transfer only: Max count of blocks
+	MaxBlockSize    uint64   `json:"maxblocksize,omitempty"`    // Block transfer only: Max block size
+	Connected       bool     `json:"connected"`                 // Whether the UDT connection is established. The metrics are only available if true.
+	DataSent        uint64   `json:"datasent"`                  // Bytes sent
+	DataReceived    uint64   `json:"datareceived"`              // Bytes received
+	PacketsSent     uint64   `json:"packetssent"`               // Data packets sent
+	PacketsReceived uint64   `json:"packetsreceived"`           // Data packets received
+	SpeedSend       float64  `json:"speedsend"`                 // Send speed in bytes per second
+	SpeedReceive    float64  `json:"speedreceive"`              // Receive speed in bytes per second
+	Progress        float64  `json:"progress"`                  // File transfer only: Progress in percent. -1 if not known.
+	ETA             int64    `json:"eta"`                       // File transfer only: Estimated remaining time in seconds. -1 if not known.
+	Started         string   `json:"started,omitempty"`         // Start time
+	Terminated      bool     `json:"terminated"`                // Whether the transfer is terminated
+	TerminateReason string   `json:"terminatereason,omitempty"` // Reason for termination
+	TerminateCode   int      `json:"terminatecode,omitempty"`   // Terminate reason code
+}
+
+// jsonConsoleTransferCancel is the output of "transfer cancel".
+type jsonConsoleTransferCancel struct {
+	LiteID            string `json:"liteid"`                    // Lite session ID
+	AlreadyTerminated bool   `json:"alreadyterminated"`         // Whether the transfer was terminated before
+	Terminated        bool   `json:"terminated"`                // Whether the transfer reported the termination
+	TerminateReason   string `json:"terminatereason,omitempty"` // Reason for termination
+	TerminateCode     int    `json:"terminatecode,omitempty"`   // Terminate reason code
+}
+
+// jsonConsoleTransferList is the output of "transfer list" and of each refresh of "transfer watch".
+type jsonConsoleTransferList struct {
+	Transfers []jsonConsoleTransfer `json:"transfers"`
+}
+
+// jsonConsoleSearchResult is a file found by "search file".
+type jsonConsoleSearchResult struct {
+	FileID      string   `json:"fileid"`      // File ID
+	PublicKey   string   `json:"publickey"`   // Public key of the blockchain
+	BlockNumber uint64   `json:"blocknumber"` // Block number
+	Keywords    []string `json:"keywords"`    // Keywords that found the file
+}
+
+// jsonConsoleSearch is the output of "search file".
+type jsonConsoleSearch struct {
+	Results []jsonConsoleSearchResult `json:"results"`
+}
+
+// jsonConsoleHash is the output of "hash".
+type jsonConsoleHash struct {
+	Hash string `json:"hash"` // blake3 hash
+}
+
+func init() {
+	registerCommand(&consoleCommand{Name: "output json", Help: "Write JSON instead of text for the rest of the session", Role: roleReadOnly, Handler: func(ctx *commandContext) bool {
+		ctx.Reader.json = true
+		return false
+	}})
+
+	registerCommand(&consoleCommand{Name: "output text", Help: "Write text (default)", Role: roleReadOnly, Handler: func(ctx *commandContext) bool {
+		ctx.Reader.json = false
+		fmt.Fprintf(ctx.Output, "Output set to text.\n")
+		return false
+	}})
+}
+
+// writeJSON writes the object as single line.
+func writeJSON(output io.Writer, v interface{}) {
+	json.NewEncoder(output).Encode(v)
+}
+
+// writeJSONError writes the error as JSON object.
+func writeJSONError(output io.Writer, text string) {
+	writeJSON(output, jsonConsoleError{Error: text})
+}
+
+// consoleStatusJSON returns the status. The peers are filtered by the caller. With the count option only the summary is returned.
+func consoleStatusJSON(backend *core.Backend, filter *peerFilter, peers []*core.PeerInfo, summary peerSummary) (status jsonConsoleStatus) {
+	_, publicKey := backend.ExportPrivateKey()
+	featureSupport := backend.FeatureSupport()
+
+	status.PublicKey = hex.EncodeToString(publicKey.SerializeCompressed())
+	status.NodeID = hex.EncodeToString(backend.SelfNodeID())
+	status.UserAgent = backend.SelfUserAgent()
+	status.Features = jsonConsoleFeatures{
+		Bits:       featureSupport,
+		IPv4Listen: featureSupport&(1<<protocol.FeatureIPv4Listen) > 0,
+		IPv6Listen: featureSupport&(1<<protocol.FeatureIPv6Listen) > 0,
+		Firewall:   featureSupport&(1<<protocol.FeatureFirewall) > 0,
+	}
+
+	status.Networks = []jsonConsoleNetwork{}
+	for _, ipVersion := range []int{4, 6} {
+		for _, network := range backend.GetNetworks(ipVersion) {
+			address, multicastIP, broadcastIPv4, ipExternal, externalPort := network.GetListen()
+
+			result := jsonConsoleNetwork{IPVersion: ipVersion, Adapter: network.GetAdapterName(), Listen: address.String(), ExternalPort: externalPort}
+			if ipVersion == 6 && multicastIP != nil {
+				result.Multicast = multicastIP.String()
+			}
+			for _, broadcastIP := range broadcastIPv4 {
+				result.Broadcast = append(result.Broadcast, broadcastIP.String())
+			}
+			if ipExternal != nil && !ipExternal.IsUnspecified() {
+				result.ExternalIP = ipExternal.String()
+			}
+
+			status.Networks = append(status.Networks, result)
+		}
+	}
+
+	status.PeerSummary = summary
+	if !filter.Count {
+		status.Peers = []jsonConsolePeer{}
+		for _, peer := range peers {
+			status.Peers = append(status.Peers, peerToJSON(peer, false))
+		}
+	}
+
+	return status
+}
+
+// peerToJSON returns the peer details. Connections are only included if requested.
+func peerToJSON(peer *core.PeerInfo, connections bool) (result jsonConsolePeer) {
+	result = jsonConsolePeer{
+		PublicKey:         hex.EncodeToString(peer.PublicKey.SerializeCompressed()),
+		NodeID:            hex.EncodeToString(peer.NodeID),
+		UserAgent:         strings.ToValidUTF8(peer.UserAgent, "?"),
+		PacketsSent:       peer.StatsPacketSent,
+		PacketsReceived:   peer.StatsPacketReceived,
+		RTT:               peer.GetRTT().Milliseconds(),
+		RootPeer:          peer.IsRootPeer,
+		NAT:               peer.IsBehindNAT(),
+		Firewall:          peer.IsFirewallReported(),
+		BlockchainHeight:  peer.BlockchainHeight,
+		BlockchainVersion: peer.BlockchainVersion,
+	}
+
+	if result.RootPeer {
+		result.Flags = "R"
+	}
+	if result.NAT {
+		result.Flags += "N"
+	}
+	if result.Firewall {
+		result.Flags += "F"
+	}
+
+	connectionsActive := peer.GetConnections(true)
+	if len(connectionsActive) > 0 {
+		result.Address = addressToA(connectionsActive[0].Address)
+	}
+
+	if connections {
+		for _, c := range append(connectionsActive, peer.GetConnections(false)...) {
+			listenAddress, _, _, _, _ := c.Network.GetListen()
+
+			result.Connections = append(result.Connections, jsonConsoleConnection{
+				Status:        strings.TrimSpace(connectionStatusToA(c.Status)),
+				Adapter:       c.Network.GetAdapterName(),
+				Local:         listenAddress.String(),
+				Remote:        addressToA(c.Address),
+				LastPacketIn:  c.LastPacketIn,
+				LastPacketOut: c.LastPacketOut,
+				RTT:           c.RoundTripTime.Milliseconds(),
+				PortInternal:  c.PortInternal,
+				PortExternal:  c.PortExternal,
+			})
+		}
+	}
+
+	return result
+}
+
+func consolePeerListJSON(peers []*core.PeerInfo, summary peerSummary) (list jsonConsolePeerList) {
+	list.Summary = summary
+	list.Peers = []jsonConsolePeer{}
+	for _, peer := range peers {
+		list.Peers = append(list.Peers, peerToJSON(peer, true))
+	}
+	return list
+}
+
+func consoleNetListJSON() (list jsonConsoleNetList, err error) {
+	interfaceList, err := net.Interfaces()
+	if err != nil {
+		return list, err
+	}
+
+	list.Interfaces = []jsonConsoleInterface{}
+	for _, ifaceSingle := range interfaceList {
+		result := jsonConsoleInterface{Name: ifaceSingle.Name, IPs: []string{}}
+
+		if addresses, err := ifaceSingle.Addrs(); err == nil {
+			for _, address := range addresses {
+				if ipNet, ok := address.(*net.IPNet); ok {
+					result.IPs = append(result.IPs, ipNet.IP.String())
+				}
+			}
+		}
+
+		list.Interfaces = append(list.Interfaces, result)
+	}
+
+	return list, nil
+}
+
+func directionToA(direction int) string {
+	switch direction {
+	case core.DirectionIn:
+		return "In"
+	case core.DirectionOut:
+		return "Out"
+	case core.DirectionBi:
+		return "Bi"
+	}
+	return ""
+}
+
+func consoleTransferListJSON(backend *core.Backend) (list jsonConsoleTransferList) {
+	list.Transfers = []jsonConsoleTransfer{}
+
+	for _, session := range backend.LiteSessions() {
+		virtualConn, ok := session.Data.(*core.VirtualPacketConn)
+		if !ok {
+			continue
+		}
+
+		result := jsonConsoleTransfer{LiteID: session.ID.String(), Peer: hex.EncodeToString(virtualConn.Peer.PublicKey.SerializeCompressed()), Progress: -1, ETA: -1}
+
+		if fileStats, ok := virtualConn.Stats.(*core.FileTransferStats); ok {
+			result.Type = "file"
+			result.Direction = directionToA(fileStats.Direction)
+			result.Hash = hex.EncodeToString(fileStats.Hash)
+			result.FileSize = fileStats.FileSize
+			result.Offset = fileStats.Offset
+			result.Limit = fileStats.Limit
+
+			if fileStats.UDTConn != nil {
+				metrics := fileStats.UDTConn.Metrics
+				result.Connected = true
+				result.DataSent, result.DataReceived = metrics.DataSent, metrics.DataReceived
+				result.PacketsSent, result.PacketsReceived = metrics.PktSentData, metrics.PktRecvData
+				result.SpeedSend, result.SpeedReceive = metrics.SpeedSend, metrics.SpeedReceive
+				result.Started = metrics.Started.Format(dateFormat)
+
+				progress, eta, validPercent, validETA := transferETA(fileStats)
+				if validPercent {
+					result.Progress = progress
+				}
+				if validETA {
+					result.ETA = int64(eta.Round(time.Second).Seconds())
+				}
+			}
+		} else if blockStats, ok := virtualConn.Stats.(*core.BlockTransferStats); ok {
+			result.Type = "block"
+			result.Direction = directionToA(blockStats.Direction)
+			result.Blockchain = hex.EncodeToString(blockStats.BlockchainPublicKey.SerializeCompressed())
+			result.LimitBlockCount = blockStats.LimitBlockCount
+			result.MaxBlockSize = blockStats.MaxBlockSize
+			result.TargetBlocks = []string{}
+			for _, block := range blockStats.TargetBlocks {
+				result.TargetBlocks = append(result.TargetBlocks, formatTextNumbers2(block.Offset, block.Limit))
+			}
+
+			if blockStats.UDTConn != nil {
+				metrics := blockStats.UDTConn.Metrics
+				result.Connected = true
+				result.DataSent, result.DataReceived = metrics.DataSent, metrics.DataReceived
+				result.PacketsSent, result.PacketsReceived = metrics.PktSentData, metrics.PktRecvData
+				result.SpeedSend, result.SpeedReceive = metrics.SpeedSend, metrics.SpeedReceive
+				result.Started = metrics.Started.Format(dateFormat)
+			}
+		} else {
+			continue
+		}
+
+		if reason := virtualConn.GetTerminateReason(); reason > 0 {
+			result.Terminated = true
+			result.TerminateCode = reason
+			result.TerminateReason = translateTerminateReason(reason)
+		}
+
+		list.Transfers = append(list.Transfers, result)
+	}
+
+	return list
+}
+
+func transferCancelJSON(session *protocol.LiteID, reason int, alreadyTerminated bool) (result jsonConsoleTransferCancel) {
+	result = jsonConsoleTransferCancel{LiteID: session.ID.String(), AlreadyTerminated: alreadyTerminated}
+	if reason > 0 {
+		result.Terminated = true
+		result.TerminateCode = reason
+		result.TerminateReason = translateTerminateReason(reason)
+	}
+	return result
+}
+
+func consoleSearchJSON(results []search.SearchIndexRecord) (list jsonConsoleSearch) {
+	list.Results = []jsonConsoleSearchResult{}
+
+	for _, result := range results {
+		item := jsonConsoleSearchResult{FileID: result.FileID.String(), PublicKey: hex.EncodeToString(result.PublicKey.SerializeCompressed()), BlockNumber: result.BlockNumber, Keywords: []string{}}
+		for _, selector := range result.Selectors {
+			item.Keywords = append(item.Keywords, selector.Word)
+		}
+		list.Results = append(list.Results, item)
+	}
+
+	return list
+}
@@ -7,622 +7,552 @@ Author:     Peter Kleissner
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/PeernetOfficial/core"
-	"github.com/PeernetOfficial/core/btcec"
-	"github.com/PeernetOfficial/core/dht"
 	"github.com/PeernetOfficial/core/protocol"
 	"github.com/PeernetOfficial/core/webapi"
 )
 
-func showHelp(output io.Writer) {
-	fmt.Fprint(output, "Please enter a command:\n"+
-		"help                          Show this help\n"+
-		"net list                      Lists all network adapters and their IPs\n"+
-		"status                        Get current status\n"+
-		"chat                          Send text to all peers\n"+
-		"peer list                     List current peers\n"+
-		"debug key create              Create Public-Private Key pair\n"+
-		"debug key self                List current Public-Private Key pair\n"+
-		"debug connect                 Attempts to connect to the target peer\n"+
-		"debug watch searches          Watch all outgoing DHT searches\n"+
-		"debug watch incoming          Watch all incoming information requests\n"+
-		"debug watch                   Watch packets and info requests for hash\n"+
-		"probe file transfer           Attempts to transfer and validate a remote file against a local file\n"+
-		"hash                          Create blake3 hash of input\n"+
-		"warehouse get                 Get data from local warehouse by hash\n"+
-		"warehouse store               Store data into local warehouse\n"+
-		"dht get                       Get data via DHT by hash\n"+
-		"dht store                     Store data into DHT\n"+
-		"get block                     Get block from remote peer\n"+
-		"log error                     Set error log output\n"+
-		"exit                          Exit\n"+
-		"search file                   Search globally for files using the local search index\n"+
-		"transfer list                 List of transfers\n"+
-		"\n")
-}
-
-func userCommands(backend *core.Backend, input io.Reader, output io.Writer, terminateSignal chan struct{}) {
-	reader := bufio.NewReader(input)
-	monitoredHashes := make(map[string]struct{})
+// userCommands reads and executes commands. The session defines which commands are allowed and is recorded in the audit log.
+func userCommands(backend *core.Backend, input io.Reader, output io.Writer, terminateSignal chan struct{}, session *consoleSession) {
+	reader := newConsoleReader(input, session.Batch)
+	reader.json = session.JSON
+	ctx := &commandContext{Backend: backend, Reader: reader, Output: output, TerminateSignal: terminateSignal, Session: session, MonitoredHashes: make(map[string]struct{})}
 
 	defer func() { // unmonitor hashes in case of terminate signal
-		for hash := range monitoredHashes {
-			hashMonitorControl([]byte(hash), 1, nil)
+		for hash := range ctx.MonitoredHashes {
+			hashMonitorControl([]byte(hash), 1, output)
 		}
 	}()
 
-	fmt.Fprint(output, appName+" "+core.Version+"\n------------------------------\n")
-	showHelp(output)
+	if !session.Batch {
+		fmt.Fprint(output, appName+" "+core.Version+"\n------------------------------\n")
+		showHelp(output, session.Role)
+	}
 
 	for {
-		command, _, terminate := getUserOptionString(reader, terminateSignal)
+		name, args, terminate, err := reader.readCommand(terminateSignal)
 		if terminate {
 			return
+		} else if err != nil {
+			ctx.writeError("Invalid command: " + err.Error())
+			continue
+		} else if name == "" {
+			continue
 		}
 
-		command = strings.ToLower(command)
+		command := lookupCommand(name)
+		allowed := session.allowed(name)
 
-		switch command {
-		case "help", "?":
-			showHelp(output)
+		if command == nil {
+			auditCommand(session, name, args, false)
+			ctx.writeError("Unknown command.")
+			continue
+		} else if !allowed {
+			auditCommand(session, name, args, false)
+			ctx.writeError("Permission denied. The role '" + session.Role + "' is not allowed to use this command.")
+			continue
+		}
 
-		case "net list":
-			fmt.Fprint(output, NetworkListOutput())
+		// The audit record is written after the prompts to include the answers.
+		terminate = ctx.readArgs(command)
+		auditCommand(session, name, append(append([]string{}, ctx.Args...), reader.args...), true)
 
-		case "debug key create":
-			privateKey, publicKey, err := core.Secp256k1NewPrivateKey()
-			if err != nil {
-				fmt.Fprintf(output, "Error: %s\n", err.Error())
-				return
-			}
+		if terminate {
+			return
+		} else if extra := ctx.extraArgs(command); len(extra) > 0 {
+			ctx.writeError("Too many arguments: " + strings.Join(extra, " ") + "\nUsage: " + command.usage())
+			continue
+		}
 
-			fmt.Fprintf(output, "Private Key: %s\n", hex.EncodeToString(privateKey.Serialize()))
-			fmt.Fprintf(output, "Public Key:  %s\n", hex.EncodeToString(publicKey.SerializeCompressed()))
+		if command.Handler(ctx) {
+			return
+		}
+	}
+}
 
-		case "debug key self":
-			privateKey, publicKey := backend.ExportPrivateKey()
-			fmt.Fprintf(output, "Private Key: %s\n", hex.EncodeToString(privateKey.Serialize()))
-			fmt.Fprintf(output, "Public Key:  %s\n", hex.EncodeToString(publicKey.SerializeCompressed()))
+// writeError writes the error message as text or as JSON object in JSON mode.
+func (ctx *commandContext) writeError(text string) {
+	if ctx.Reader.jsonOutput() {
+		writeJSONError(ctx.Output, text)
+	} else {
+		fmt.Fprintf(ctx.Output, "%s\n", text)
+	}
+}
 
-		case "peer list":
-			for _, peer := range GetPeerlistSorted(backend) {
-				info := ""
-				if peer.IsRootPeer {
-					info = " [root peer]"
-				}
-				if peer.IsBehindNAT() {
-					info += " [NAT]"
-				}
-				userAgent := strings.ToValidUTF8(peer.UserAgent, "?")
+func init() {
+	registerCommand(&consoleCommand{Name: "help", Aliases: []string{"?"}, Help: "Show this help", Role: roleReadOnly, Handler: func(ctx *commandContext) bool {
+		showHelp(ctx.Output, ctx.Session.Role)
+		return false
+	}})
+
+	registerCommand(&consoleCommand{Name: "net list", Help: "Lists all network adapters and their IPs", Role: roleReadOnly, Handler: func(ctx *commandContext) bool {
+		if !ctx.Reader.jsonOutput() {
+			fmt.Fprint(ctx.Output, NetworkListOutput())
+		} else if list, err := consoleNetListJSON(); err != nil {
+			writeJSONError(ctx.Output, err.Error())
+		} else {
+			writeJSON(ctx.Output, list)
+		}
+		return false
+	}})
 
-				fmt.Fprintf(output, "* Peer ID %s%s\n  Node ID %s\n  User Agent: %s\n  Blockchain: height %d, version %d\n\n%s\n  Packets sent:      %d\n  Packets received:  %d\n\n", hex.EncodeToString(peer.PublicKey.SerializeCompressed()), info, hex.EncodeToString(peer.NodeID), userAgent, peer.BlockchainHeight, peer.BlockchainVersion, textPeerConnections(peer), peer.StatsPacketSent, peer.StatsPacketReceived)
-			}
+	registerCommand(&consoleCommand{Name: "status", Help: "Get current status. Supports filter options for the peer table.", Role: roleReadOnly, Options: true, Handler: commandStatus})
 
-		case "chat all", "chat":
-			if text, valid, terminate := getUserOptionString(reader, terminateSignal); valid {
-				backend.SendChatAll(text)
-			} else if terminate {
-				return
-			}
+	registerCommand(&consoleCommand{Name: "chat", Aliases: []string{"chat all"}, Args: []commandArg{{Name: "text", Rest: true}}, Help: "Send text to all peers", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		ctx.Backend.SendChatAll(ctx.Arg(0))
+		return false
+	}})
 
-		case "status":
-			_, publicKey := backend.ExportPrivateKey()
-			nodeID := backend.SelfNodeID()
-			fmt.Fprintf(output, "----------------\nPublic Key: %s\nNode ID:    %s\n\n", hex.EncodeToString(publicKey.SerializeCompressed()), hex.EncodeToString(nodeID))
+	registerCommand(&consoleCommand{Name: "peer list", Help: "List current peers. Supports filter options, see below.", Role: roleReadOnly, Options: true, Handler: func(ctx *commandContext) bool {
+		filter, err := parsePeerFilter(ctx.RestArgs())
+		if err != nil {
+			ctx.writeError("Invalid filter: " + err.Error())
+			return false
+		}
+		peers, summary := filter.apply(ctx.Backend)
 
-			features := ""
-			featureSupport := backend.FeatureSupport()
-			if featureSupport&(1<<protocol.FeatureIPv4Listen) > 0 {
-				features = "IPv4"
+		if ctx.Reader.jsonOutput() {
+			if filter.Count {
+				writeJSON(ctx.Output, summary)
+			} else {
+				writeJSON(ctx.Output, consolePeerListJSON(peers, summary))
 			}
-			if featureSupport&(1<<protocol.FeatureIPv6Listen) > 0 {
-				if len(features) > 0 {
-					features += ", "
-				}
-				features += "IPv6"
+			return false
+		} else if filter.Count {
+			fmt.Fprint(ctx.Output, peerSummaryToA(summary))
+			return false
+		}
+
+		for _, peer := range peers {
+			info := ""
+			if peer.IsRootPeer {
+				info = " [root peer]"
 			}
-			if featureSupport&(1<<protocol.FeatureFirewall) > 0 {
-				if len(features) > 0 {
-					features += ", "
-				}
-				features += "Firewall Reported"
+			if peer.IsBehindNAT() {
+				info += " [NAT]"
 			}
+			userAgent := strings.ToValidUTF8(peer.UserAgent, "?")
 
-			fmt.Fprintf(output, "User Agent: %s\nFeatures:   %s\n\n", backend.SelfUserAgent(), features)
+			fmt.Fprintf(ctx.Output, "* Peer ID %s%s\n  Node ID %s\n  User Agent: %s\n  Blockchain: height %d, version %d\n\n%s\n  Packets sent:      %d\n  Packets received:  %d\n\n", hex.EncodeToString(peer.PublicKey.SerializeCompressed()), info, hex.EncodeToString(peer.NodeID), userAgent, peer.BlockchainHeight, peer.BlockchainVersion, textPeerConnections(peer), peer.StatsPacketSent, peer.StatsPacketReceived)
+		}
+		fmt.Fprint(ctx.Output, filter.peerPageToA(len(peers), summary))
+		return false
+	}})
+
+	registerCommand(&consoleCommand{Name: "hash", Args: []commandArg{{Name: "text", Rest: true}}, Help: "Create blake3 hash of input", Role: roleReadOnly, Handler: func(ctx *commandContext) bool {
+		hash := core.Data2Hash([]byte(ctx.Arg(0)))
+		if ctx.Reader.jsonOutput() {
+			writeJSON(ctx.Output, jsonConsoleHash{Hash: hex.EncodeToString(hash)})
+		} else {
+			fmt.Fprintf(ctx.Output, "blake3 hash: %s\n", hex.EncodeToString(hash))
+		}
+		return false
+	}})
 
-			fmt.Fprintf(output, "Listen Address                                  Multicast IP out                  External Address\n")
+	registerCommand(&consoleCommand{Name: "warehouse get", Args: []commandArg{{Name: "hash"}}, Help: "Get data from local warehouse by hash", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		hash, valid := ctx.ArgHash(0)
+		if !valid {
+			fmt.Fprintf(ctx.Output, "Invalid hash. Hex-encoded blake3 hash as input is required.\n")
+			return false
+		}
 
-			for _, network := range backend.GetNetworks(4) {
-				address, _, broadcastIPv4, ipExternal, externalPort := network.GetListen()
+		data, found := ctx.Backend.GetDataLocal(hash)
+		if !found {
+			fmt.Fprintf(ctx.Output, "Not found.\n")
+		} else {
+			fmt.Fprintf(ctx.Output, "Data hex:    %s\n", hex.EncodeToString(data))
+			fmt.Fprintf(ctx.Output, "Data string: %s\n", string(data))
+		}
+		return false
+	}})
 
-				broadcastIPsA := ""
-				for n, broadcastIP := range broadcastIPv4 {
-					if n > 0 {
-						broadcastIPsA += ", "
-					}
-					broadcastIPsA += broadcastIP.String()
-				}
+	registerCommand(&consoleCommand{Name: "warehouse store", Args: []commandArg{{Name: "data", Rest: true}}, Help: "Store data into local warehouse", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		if err := ctx.Backend.StoreDataLocal([]byte(ctx.Arg(0))); err != nil {
+			fmt.Fprintf(ctx.Output, "Error storing data: %s\n", err.Error())
+			return false
+		}
+		fmt.Fprintf(ctx.Output, "Stored via hash: %s\n", hex.EncodeToString(core.Data2Hash([]byte(ctx.Arg(0)))))
+		return false
+	}})
 
-				externalAddress := ""
+	registerCommand(&consoleCommand{Name: "dht store", Args: []commandArg{{Name: "data", Rest: true}}, Help: "Store data into DHT", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		if err := ctx.Backend.StoreDataDHT([]byte(ctx.Arg(0)), 5); err != nil {
+			fmt.Fprintf(ctx.Output, "Error storing data: %s\n", err.Error())
+			return false
+		}
+		fmt.Fprintf(ctx.Output, "Stored via hash: %s\n", hex.EncodeToString(core.Data2Hash([]byte(ctx.Arg(0)))))
+		return false
+	}})
+
+	registerCommand(&consoleCommand{Name: "dht get", Args: []commandArg{{Name: "hash"}}, Help: "Get data via DHT by hash", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		hash, valid := ctx.ArgHash(0)
+		if !valid {
+			fmt.Fprintf(ctx.Output, "Invalid hash. Hex-encoded blake3 hash as input is required.\n")
+			return false
+		}
 
-				if ipExternal != nil && !ipExternal.IsUnspecified() || externalPort > 0 {
-					externalIPA := "[unknown]"
-					externalPortA := ""
-					if ipExternal != nil && !ipExternal.IsUnspecified() {
-						externalIPA = ipExternal.String()
-					}
-					if externalPort > 0 {
-						externalPortA = strconv.Itoa(int(externalPort))
-					}
+		data, sender, found := ctx.Backend.GetDataDHT(hash)
+		if !found {
+			fmt.Fprintf(ctx.Output, "Not found.\n")
+		} else {
+			fmt.Fprintf(ctx.Output, "\nSender:      %s\n", hex.EncodeToString(sender))
+			fmt.Fprintf(ctx.Output, "Data hex:    %s\n", hex.EncodeToString(data))
+			fmt.Fprintf(ctx.Output, "Data string: %s\n", string(data))
+		}
+		return false
+	}})
 
-					externalAddress = net.JoinHostPort(externalIPA, externalPortA)
-				}
+	registerCommand(&consoleCommand{Name: "log error", Args: []commandArg{{Name: "target", Prompt: "Please choose the target output of error messages:\n0 = Log file (default)\n1 = Command line\n2 = Log file + command line\n3 = None"}}, Help: "Set error log output", Role: roleAdmin, Handler: func(ctx *commandContext) bool {
+		if number, valid := ctx.ArgInt(0); valid && number >= 0 && number <= 3 {
+			ctx.Backend.Config.LogTarget = number
+		} else {
+			fmt.Fprintf(ctx.Output, "Invalid option.\n")
+		}
+		return false
+	}})
 
-				fmt.Fprintf(output, "%-46s  %-32s  %s\n", address.String(), broadcastIPsA, externalAddress)
-			}
-			for _, network := range backend.GetNetworks(6) {
-				address, multicastIP, _, _, externalPort := network.GetListen()
+	registerCommand(&consoleCommand{Name: "probe file transfer", Args: []commandArg{{Name: "peer ID", Complete: completePeerIDs, Prompt: "Enter peer ID or node ID to connect:"}, {Name: "file hash", Prompt: "Enter file hash:"}}, Help: "Attempts to transfer and validate a remote file against a local file. Benchmark options --runs=, --concurrency=, --warmup=, --limit=, --report=", Role: roleOperator, Options: true, Handler: func(ctx *commandContext) bool {
+		fileHash, valid := ctx.ArgHash(1)
+		if !validPeerID(ctx.Arg(0)) {
+			fmt.Fprintf(ctx.Output, "Invalid peer ID or node ID.\n")
+			return false
+		} else if !valid {
+			fmt.Fprintf(ctx.Output, "Invalid file hash.\n")
+			return false
+		}
 
-				externalPortA := ""
-				if externalPort > 0 {
-					externalPortA = strconv.Itoa(int(externalPort))
-				}
+		options, err := parseBenchmarkOptions(ctx.RestArgs())
+		if err != nil {
+			ctx.writeError("Error: " + err.Error())
+			return false
+		}
 
-				fmt.Fprintf(output, "%-46s  %-31s  %s\n", address.String(), multicastIP.String(), externalPortA)
-			}
+		peer, err := connectPeer(ctx.Backend, ctx.Arg(0), timeoutConnectPeer)
+		if err != nil {
+			fmt.Fprintf(ctx.Output, "Could not connect to peer: %s\n", err.Error())
+			return false
+		}
 
-			fmt.Fprintf(output, "\nPeer ID                                                             Sent      Received  IP                                   Flags   RTT     \n")
-			for _, peer := range GetPeerlistSorted(backend) {
-				addressA := "N/A"
-				rttA := "N/A"
-				if connectionsActive := peer.GetConnections(true); len(connectionsActive) > 0 {
-					addressA = addressToA(connectionsActive[0].Address)
-				}
-				if rtt := peer.GetRTT(); rtt > 0 {
-					rttA = rtt.Round(time.Millisecond).String()
-				}
-				flagsA := ""
-				if peer.IsRootPeer {
-					flagsA = "R"
-				}
-				if peer.IsBehindNAT() {
-					flagsA += "N"
-				}
-				if peer.IsFirewallReported() {
-					flagsA += "F"
-				}
-				fmt.Fprintf(output, "%-66s  %-8d  %-8d  %-35s  %-6s  %-6s\n", hex.EncodeToString(peer.PublicKey.SerializeCompressed()), peer.StatsPacketSent, peer.StatsPacketReceived, addressA, flagsA, rttA)
+		jsonOutput := ctx.Reader.jsonOutput()
+		ctx.runTask(func() {
+			if options.Enabled {
+				transferBenchmark(peer, fileHash, options, ctx.Output, jsonOutput)
+			} else {
+				transferCompareFile(peer, fileHash, ctx.Output)
 			}
+		})
+		return false
+	}})
 
-			fmt.Fprintf(output, "\n")
+	registerCommand(&consoleCommand{Name: "get block", Args: []commandArg{{Name: "peer ID", Complete: completePeerIDs, Prompt: "Enter peer ID or node ID:"}, {Name: "block number", Prompt: "Enter block number:"}}, Help: "Get block from remote peer", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		blockNumber, valid := ctx.ArgInt(1)
+		if !validPeerID(ctx.Arg(0)) {
+			fmt.Fprintf(ctx.Output, "Invalid peer ID or node ID.\n")
+			return false
+		} else if !valid || blockNumber < 0 {
+			fmt.Fprintf(ctx.Output, "Invalid block number.\n")
+			return false
+		}
 
-		case "hash":
-			if text, valid, terminate := getUserOptionString(reader, terminateSignal); valid {
-				hash := core.Data2Hash([]byte(text))
-				fmt.Fprintf(output, "blake3 hash: %s\n", hex.EncodeToString(hash))
-			} else if terminate {
-				return
-			}
+		peer, err := connectPeer(ctx.Backend, ctx.Arg(0), timeoutConnectPeer)
+		if err != nil {
+			fmt.Fprintf(ctx.Output, "Could not connect to peer: %s\n", err.Error())
+			return false
+		}
 
-		case "warehouse get":
-			if hash, valid, terminate := getUserOptionHash(reader, terminateSignal); valid {
-				data, found := backend.GetDataLocal(hash)
-				if !found {
-					fmt.Fprintf(output, "Not found.\n")
-				} else {
-					fmt.Fprintf(output, "Data hex:    %s\n", hex.EncodeToString(data))
-					fmt.Fprintf(output, "Data string: %s\n", string(data))
-				}
-			} else if terminate {
-				return
-			} else {
-				fmt.Fprintf(output, "Invalid hash. Hex-encoded blake3 hash as input is required.\n")
-			}
+		ctx.runTask(func() { blockTransfer(peer, uint64(blockNumber), ctx.Output) })
+		return false
+	}})
 
-		case "warehouse store":
-			if text, valid, terminate := getUserOptionString(reader, terminateSignal); valid {
-				if err := backend.StoreDataLocal([]byte(text)); err != nil {
-					fmt.Fprintf(output, "Error storing data: %s\n", err.Error())
-					break
-				}
-				fmt.Fprintf(output, "Stored via hash: %s\n", hex.EncodeToString(core.Data2Hash([]byte(text))))
-			} else if terminate {
-				return
-			}
+	registerCommand(&consoleCommand{Name: "exit", Help: "Exit", Role: roleAdmin, Handler: func(ctx *commandContext) bool {
+		fmt.Fprintf(ctx.Output, "Shutting down...\n")
+		shutdown(ctx.Backend, "user terminal command")
+		return false
+	}})
 
-		case "dht store":
-			if text, valid, terminate := getUserOptionString(reader, terminateSignal); valid {
-				if err := backend.StoreDataDHT([]byte(text), 5); err != nil {
-					fmt.Fprintf(output, "Error storing data: %s\n", err.Error())
-					break
-				}
-				fmt.Fprintf(output, "Stored via hash: %s\n", hex.EncodeToString(core.Data2Hash([]byte(text))))
-			} else if terminate {
-				return
-			}
+	registerCommand(&consoleCommand{Name: "search file", Args: []commandArg{{Name: "text", Rest: true}}, Help: "Search globally for files using the local search index", Role: roleReadOnly, Handler: func(ctx *commandContext) bool {
+		results := ctx.Backend.SearchIndex.Search(ctx.Arg(0))
+		if ctx.Reader.jsonOutput() {
+			writeJSON(ctx.Output, consoleSearchJSON(results))
+			return false
+		} else if len(results) == 0 {
+			fmt.Fprintf(ctx.Output, "No results found.\n")
+			return false
+		}
 
-		case "dht get":
-			if hash, valid, terminate := getUserOptionHash(reader, terminateSignal); valid {
-				data, sender, found := backend.GetDataDHT(hash)
-				if !found {
-					fmt.Fprintf(output, "Not found.\n")
-				} else {
-					fmt.Fprintf(output, "\nSender:      %s\n", hex.EncodeToString(sender))
-					fmt.Fprintf(output, "Data hex:    %s\n", hex.EncodeToString(data))
-					fmt.Fprintf(output, "Data string: %s\n", string(data))
+		for _, result := range results {
+			fmt.Fprintf(ctx.Output, "- File ID               %s\n", result.FileID.String())
+			fmt.Fprintf(ctx.Output, "  Public Key            %s\n", hex.EncodeToString(result.PublicKey.SerializeCompressed()))
+			fmt.Fprintf(ctx.Output, "  Block Number          %d\n", result.BlockNumber)
+			keywords := ""
+			for n, selector := range result.Selectors {
+				if n > 0 {
+					keywords += ", "
 				}
-			} else if terminate {
-				return
-			} else {
-				fmt.Fprintf(output, "Invalid hash. Hex-encoded blake3 hash as input is required.\n")
+				keywords += selector.Word
 			}
+			fmt.Fprintf(ctx.Output, "  Found via keywords    %s\n", keywords)
+		}
+		return false
+	}})
 
-		case "log error":
-			fmt.Fprintf(output, "Please choose the target output of error messages:\n0 = Log file (default)\n1 = Command line\n2 = Log file + command line\n3 = None\n")
-			if number, valid, terminate := getUserOptionInt(reader, terminateSignal); valid && number >= 0 && number <= 3 {
-				backend.Config.LogTarget = number
-			} else if terminate {
-				return
-			} else {
-				fmt.Fprintf(output, "Invalid option.\n")
-			}
+	registerCommand(&consoleCommand{Name: "transfer list", Help: "List of transfers", Role: roleReadOnly, Handler: commandTransferList})
+}
 
-		case "debug connect":
-			fmt.Fprintf(output, "Please specify the target peer to connect to via DHT lookup, either by peer ID or node ID:\n")
-			text, valid, terminate := getUserOptionString(reader, terminateSignal)
-			if terminate {
-				return
-			} else if !valid || (len(text) != 66 && len(text) != 64) {
-				fmt.Fprintf(output, "Invalid peer ID or node ID. It must be hex-encoded and 66 (peer ID) or 64 characters (node ID) long.\n")
-				break
-			}
+// commandStatus prints the keys, features, networks and the peer table. The peer table can be filtered, or replaced by the summary with --count.
+func commandStatus(ctx *commandContext) (terminate bool) {
+	backend, output := ctx.Backend, ctx.Output
 
-			// node ID is required
-			var nodeID []byte
-			var err error
+	filter, err := parsePeerFilter(ctx.RestArgs())
+	if err != nil {
+		ctx.writeError("Invalid filter: " + err.Error())
+		return false
+	}
+	peers, summary := filter.apply(backend)
 
-			if len(text) == 66 {
-				// Assume peer ID was supplied.
-				publicKeyB, err := hex.DecodeString(text)
-				if err != nil || len(publicKeyB) != 33 {
-					fmt.Fprintf(output, "Invalid peer ID encoding.\n")
-					break
-				}
+	if ctx.Reader.jsonOutput() {
+		writeJSON(output, consoleStatusJSON(backend, &filter, peers, summary))
+		return false
+	}
 
-				publicKey, err := btcec.ParsePubKey(publicKeyB, btcec.S256())
-				if err != nil {
-					fmt.Fprintf(output, "Invalid peer ID (public key decoding failed).\n")
-					continue
-				}
+	_, publicKey := backend.ExportPrivateKey()
+	nodeID := backend.SelfNodeID()
+	fmt.Fprintf(output, "----------------\nPublic Key: %s\nNode ID:    %s\n\n", hex.EncodeToString(publicKey.SerializeCompressed()), hex.EncodeToString(nodeID))
 
-				nodeID = protocol.PublicKey2NodeID(publicKey)
-			} else {
-				// Node ID was supplied.
-				if nodeID, err = hex.DecodeString(text); err != nil || len(nodeID) != 256/8 {
-					fmt.Fprintf(output, "Invalid node ID encoding.\n")
-					break
-				}
-			}
+	features := ""
+	featureSupport := backend.FeatureSupport()
+	if featureSupport&(1<<protocol.FeatureIPv4Listen) > 0 {
+		features = "IPv4"
+	}
+	if featureSupport&(1<<protocol.FeatureIPv6Listen) > 0 {
+		if len(features) > 0 {
+			features += ", "
+		}
+		features += "IPv6"
+	}
+	if featureSupport&(1<<protocol.FeatureFirewall) > 0 {
+		if len(features) > 0 {
+			features += ", "
+		}
+		features += "Firewall Reported"
+	}
 
-			// is self?
-			if bytes.Equal(nodeID, backend.SelfNodeID()) {
-				fmt.Fprintf(output, "Target node is self.\n")
-				break
-			}
+	fmt.Fprintf(output, "User Agent: %s\nFeatures:   %s\n\n", backend.SelfUserAgent(), features)
 
-			debugCmdConnect(backend, nodeID, output)
+	fmt.Fprintf(output, "Listen Address                                  Multicast IP out                  External Address\n")
 
-		case "debug watch searches":
-			fmt.Fprintf(output, "Enable (1) or disable (0) watching of all outgoing DHT searches?\n")
-			if number, valid, terminate := getUserOptionInt(reader, terminateSignal); valid && number >= 0 && number <= 1 {
-				if number == 1 {
-					hashMonitorControl([]byte(keyMonitorAllSearches), 0, output)
-					monitoredHashes[keyMonitorAllSearches] = struct{}{}
-				} else {
-					hashMonitorControl([]byte(keyMonitorAllSearches), 1, output)
-					delete(monitoredHashes, keyMonitorAllSearches)
-				}
-			} else if terminate {
-				return
-			} else {
-				fmt.Fprintf(output, "Invalid option.\n")
-			}
+	for _, network := range backend.GetNetworks(4) {
+		address, _, broadcastIPv4, ipExternal, externalPort := network.GetListen()
 
-		case "debug watch incoming":
-			fmt.Fprintf(output, "Enable (1) or disable (0) watching of all incoming information requests?\n")
-			if number, valid, terminate := getUserOptionInt(reader, terminateSignal); valid && number >= 0 && number <= 1 {
-				if number == 1 {
-					hashMonitorControl([]byte(keyMonitorAllRequests), 0, output)
-					monitoredHashes[keyMonitorAllRequests] = struct{}{}
-				} else {
-					hashMonitorControl([]byte(keyMonitorAllRequests), 1, output)
-					delete(monitoredHashes, keyMonitorAllRequests)
-				}
-			} else if terminate {
-				return
-			} else {
-				fmt.Fprintf(output, "Invalid option.\n")
+		broadcastIPsA := ""
+		for n, broadcastIP := range broadcastIPv4 {
+			if n > 0 {
+				broadcastIPsA += ", "
 			}
+			broadcastIPsA += broadcastIP.String()
+		}
 
-		case "debug bucket refresh":
-			fmt.Fprintf(output, "Disable (1) or enable (0) bucket refresh. This can be useful to disable bucket refresh when debugging outgoing DHT searches. (current setting: %t)\n", dht.DisableBucketRefresh)
-			if number, valid, terminate := getUserOptionInt(reader, terminateSignal); valid && number >= 0 && number <= 1 {
-				dht.DisableBucketRefresh = number == 1
-			} else if terminate {
-				return
-			} else {
-				fmt.Fprintf(output, "Invalid option.\n")
-			}
+		externalAddress := ""
 
-		case "debug watch":
-			fmt.Fprintf(output, "Enter hash of data or node ID to watch. This monitors info requests and packets. Enter same hash again to remove from list.\n")
-			text, _, terminate := getUserOptionString(reader, terminateSignal)
-			if terminate {
-				return
+		if ipExternal != nil && !ipExternal.IsUnspecified() || externalPort > 0 {
+			externalIPA := "[unknown]"
+			externalPortA := ""
+			if ipExternal != nil && !ipExternal.IsUnspecified() {
+				externalIPA = ipExternal.String()
 			}
-			var hash []byte
-			var err error
-			if hash, err = hex.DecodeString(text); err != nil || len(hash) != 256/8 {
-				fmt.Fprintf(output, "Invalid hash. Hex-encoded 64 character hash expected.\n")
-				break
+			if externalPort > 0 {
+				externalPortA = strconv.Itoa(int(externalPort))
 			}
 
-			added := hashMonitorControl(hash, 2, output)
-			if added {
-				monitoredHashes[string(hash)] = struct{}{}
-				fmt.Fprintf(output, "The hash was added to the monitoring list.\n")
-			} else {
-				delete(monitoredHashes, string(hash))
-				fmt.Fprintf(output, "The hash was removed from the monitoring list.\n")
-			}
+			externalAddress = net.JoinHostPort(externalIPA, externalPortA)
+		}
 
-		case "probe file transfer":
-			fmt.Fprintf(output, "Enter peer ID or node ID to connect:\n")
-			nodeIDA, _, terminate := getUserOptionString(reader, terminateSignal)
-			if terminate {
-				return
-			}
-			fmt.Fprintf(output, "Enter file hash:\n")
-			fileHashA, _, terminate := getUserOptionString(reader, terminateSignal)
-			if terminate {
-				return
-			}
+		fmt.Fprintf(output, "%-46s  %-32s  %s\n", address.String(), broadcastIPsA, externalAddress)
+	}
+	for _, network := range backend.GetNetworks(6) {
+		address, multicastIP, _, _, externalPort := network.GetListen()
 
-			fileHash, valid1 := webapi.DecodeBlake3Hash(fileHashA)
-			nodeID, valid2 := webapi.DecodeBlake3Hash(nodeIDA)
-			publicKey, err3 := core.PublicKeyFromPeerID(nodeIDA)
+		externalPortA := ""
+		if externalPort > 0 {
+			externalPortA = strconv.Itoa(int(externalPort))
+		}
 
-			if !valid2 && err3 != nil {
-				fmt.Fprintf(output, "Invalid peer ID or node ID.\n")
-				break
-			} else if !valid1 {
-				fmt.Fprintf(output, "Invalid file hash.\n")
-			}
+		fmt.Fprintf(output, "%-46s  %-31s  %s\n", address.String(), multicastIP.String(), externalPortA)
+	}
 
-			var peer *core.PeerInfo
-			var err error
-			timeout := time.Second * 10
+	if filter.Count {
+		fmt.Fprintf(output, "\n%s\n", peerSummaryToA(summary))
+		return false
+	}
 
-			if valid2 {
-				peer, err = webapi.PeerConnectNode(backend, nodeID, timeout)
-			} else if err3 == nil {
-				peer, err = webapi.PeerConnectPublicKey(backend, publicKey, timeout)
-			}
-			if err != nil {
-				fmt.Fprintf(output, "Could not connect to peer: %s\n", err.Error())
-				break
-			}
+	fmt.Fprintf(output, "\nPeer ID                                                             Sent      Received  IP                                   Flags   RTT     \n")
+	for _, peer := range peers {
+		addressA := "N/A"
+		rttA := "N/A"
+		if connectionsActive := peer.GetConnections(true); len(connectionsActive) > 0 {
+			addressA = addressToA(connectionsActive[0].Address)
+		}
+		if rtt := peer.GetRTT(); rtt > 0 {
+			rttA = rtt.Round(time.Millisecond).String()
+		}
+		flagsA := ""
+		if peer.IsRootPeer {
+			flagsA = "R"
+		}
+		if peer.IsBehindNAT() {
+			flagsA += "N"
+		}
+		if peer.IsFirewallReported() {
+			flagsA += "F"
+		}
+		fmt.Fprintf(output, "%-66s  %-8d  %-8d  %-35s  %-6s  %-6s\n", hex.EncodeToString(peer.PublicKey.SerializeCompressed()), peer.StatsPacketSent, peer.StatsPacketReceived, addressA, flagsA, rttA)
+	}
 
-			go transferCompareFile(peer, fileHash, output)
+	fmt.Fprintf(output, "%s\n", filter.peerPageToA(len(peers), summary))
 
-		case "get block":
-			fmt.Fprintf(output, "Enter peer ID or node ID:\n")
-			nodeIDA, _, terminate := getUserOptionString(reader, terminateSignal)
-			if terminate {
-				return
-			}
-			fmt.Fprintf(output, "Enter block number:\n")
-			blockNumber, _, terminate := getUserOptionInt(reader, terminateSignal)
-			if terminate {
-				return
-			}
+	return false
+}
 
-			nodeID, valid2 := webapi.DecodeBlake3Hash(nodeIDA)
-			publicKey, err3 := core.PublicKeyFromPeerID(nodeIDA)
+// commandTransferList lists all file and block transfers.
+func commandTransferList(ctx *commandContext) (terminate bool) {
+	backend, output := ctx.Backend, ctx.Output
 
-			if !valid2 && err3 != nil {
-				fmt.Fprintf(output, "Invalid peer ID or node ID.\n")
-				break
-			} else if blockNumber < 0 {
-				fmt.Fprintf(output, "Invalid block number.\n")
-			}
+	if ctx.Reader.jsonOutput() {
+		writeJSON(output, consoleTransferListJSON(backend))
+		return false
+	}
 
-			var peer *core.PeerInfo
-			var err error
-			timeout := time.Second * 10
+	var textF, textB string
+
+	for _, session := range backend.LiteSessions() {
+		if virtualConn, ok := session.Data.(*core.VirtualPacketConn); ok {
+			if fileStats, ok := virtualConn.Stats.(*core.FileTransferStats); ok {
+				var direction string
+				switch fileStats.Direction {
+				case core.DirectionIn:
+					direction = "In"
+				case core.DirectionOut:
+					direction = "Out"
+				case core.DirectionBi:
+					direction = "Bi"
+				}
 
-			if valid2 {
-				peer, err = webapi.PeerConnectNode(backend, nodeID, timeout)
-			} else if err3 == nil {
-				peer, err = webapi.PeerConnectPublicKey(backend, publicKey, timeout)
-			}
-			if err != nil {
-				fmt.Fprintf(output, "Could not connect to peer: %s\n", err.Error())
-				break
-			}
+				textF += fmt.Sprintf("%-12s  %-12s  %-12s  %-3s  %-10d %-10d %-8d",
+					shortenText(session.ID.String(), 8), shortenText(hex.EncodeToString(virtualConn.Peer.PublicKey.SerializeCompressed()), 8), shortenText(hex.EncodeToString(fileStats.Hash), 8),
+					direction, fileStats.FileSize, fileStats.Offset, fileStats.Limit)
 
-			go blockTransfer(peer, uint64(blockNumber), output)
+				if fileStats.UDTConn != nil {
+					metrics := fileStats.UDTConn.Metrics
 
-		case "exit":
-			backend.LogError("userCommands", "graceful exit via user terminal command\n")
-			os.Exit(core.ExitGraceful)
+					speed := "?"
+					percent := "?"
 
-		case "search file":
-			text, _, terminate := getUserOptionString(reader, terminateSignal)
-			if terminate {
-				return
-			}
+					progress, eta, validPercent, validETA := transferETA(fileStats)
+					if validPercent {
+						percent = fmt.Sprintf("%.2f%%", progress)
+					}
 
-			results := backend.SearchIndex.Search(text)
-			if len(results) == 0 {
-				fmt.Fprintf(output, "No results found.\n")
-				break
-			}
+					switch fileStats.Direction {
+					case core.DirectionIn:
+						speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedReceive/1024)
+					case core.DirectionOut:
+						speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedSend/1024)
+					case core.DirectionBi:
+						speed = fmt.Sprintf("%.2f KB/s - %.2f KB/s", metrics.SpeedSend/1024, metrics.SpeedReceive/1024)
+					}
+
+					status := "Active"
+					if reason := virtualConn.GetTerminateReason(); reason > 0 {
+						status = "Terminated. " + translateTerminateReason(reason)
+					}
 
-			for _, result := range results {
-				fmt.Fprintf(output, "- File ID               %s\n", result.FileID.String())
-				fmt.Fprintf(output, "  Public Key            %s\n", hex.EncodeToString(result.PublicKey.SerializeCompressed()))
-				fmt.Fprintf(output, "  Block Number          %d\n", result.BlockNumber)
-				keywords := ""
-				for n, selector := range result.Selectors {
+					started := metrics.Started.Format(dateFormat)
+
+					textF += fmt.Sprintf(" | %-12s  %-5s %-5s %-8s %-8s %-8s %-8s %-14s %-7s %-8s %s  %s\n",
+						formatTextNumbers2(metrics.DataSent, metrics.DataReceived), formatTextNumbers2(metrics.PktSendHandShake, metrics.PktRecvHandShake), formatTextNumbers2(metrics.PktSentShutdown, metrics.PktRecvShutdown),
+						formatTextNumbers2(metrics.PktSentACK, metrics.PktRecvACK), formatTextNumbers2(metrics.PktSentNAK, metrics.PktRecvNAK), formatTextNumbers2(metrics.PktSentACK2, metrics.PktRecvACK2), formatTextNumbers2(metrics.PktSentData, metrics.PktRecvData),
+						speed, percent, etaToA(eta, validETA), started, status)
+				} else {
+					textF += "  [UDT connection not established]\n"
+				}
+			} else if blockStats, ok := virtualConn.Stats.(*core.BlockTransferStats); ok {
+				var direction, targetBlocks string
+				switch blockStats.Direction {
+				case core.DirectionIn:
+					direction = "In"
+				case core.DirectionOut:
+					direction = "Out"
+				case core.DirectionBi:
+					direction = "Bi"
+				}
+
+				for n, block := range blockStats.TargetBlocks {
 					if n > 0 {
-						keywords += ", "
+						targetBlocks += ", "
 					}
-					keywords += selector.Word
+					targetBlocks += fmt.Sprintf("%d-%d", block.Offset, block.Limit)
 				}
-				fmt.Fprintf(output, "  Found via keywords    %s\n", keywords)
-			}
 
-		case "transfer list":
-			var textF, textB string
-
-			for _, session := range backend.LiteSessions() {
-				if virtualConn, ok := session.Data.(*core.VirtualPacketConn); ok {
-					if fileStats, ok := virtualConn.Stats.(*core.FileTransferStats); ok {
-						var direction string
-						switch fileStats.Direction {
-						case core.DirectionIn:
-							direction = "In"
-						case core.DirectionOut:
-							direction = "Out"
-						case core.DirectionBi:
-							direction = "Bi"
-						}
-
-						textF += fmt.Sprintf("%-12s  %-12s  %-12s  %-3s  %-10d %-10d %-8d",
-							shortenText(session.ID.String(), 8), shortenText(hex.EncodeToString(virtualConn.Peer.PublicKey.SerializeCompressed()), 8), shortenText(hex.EncodeToString(fileStats.Hash), 8),
-							direction, fileStats.FileSize, fileStats.Offset, fileStats.Limit)
-
-						if fileStats.UDTConn != nil {
-							metrics := fileStats.UDTConn.Metrics
-
-							speed := "?"
-							percent := "?"
-							//eta := "?"
-
-							switch fileStats.Direction {
-							case core.DirectionIn:
-								speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedReceive/1024)
-								if fileStats.FileSize > 0 && metrics.DataReceived >= 16 {
-									percent = fmt.Sprintf("%.2f%%", float64((metrics.DataReceived-16)*100)/float64(fileStats.FileSize))
-								}
-							case core.DirectionOut:
-								speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedSend/1024)
-								if fileStats.FileSize > 0 && metrics.DataSent >= 16 {
-									percent = fmt.Sprintf("%.2f%%", float64((metrics.DataSent-16)*100)/float64(fileStats.FileSize))
-								}
-							case core.DirectionBi:
-								speed = fmt.Sprintf("%.2f KB/s - %.2f KB/s", metrics.SpeedSend/1024, metrics.SpeedReceive/1024)
-							}
-
-							status := "Active"
-							if reason := virtualConn.GetTerminateReason(); reason > 0 {
-								status = "Terminated. " + translateTerminateReason(reason)
-							}
-
-							started := metrics.Started.Format(dateFormat)
-
-							textF += fmt.Sprintf(" | %-12s  %-5s %-5s %-8s %-8s %-8s %-8s %-14s %-7s %s  %s\n",
-								formatTextNumbers2(metrics.DataSent, metrics.DataReceived), formatTextNumbers2(metrics.PktSendHandShake, metrics.PktRecvHandShake), formatTextNumbers2(metrics.PktSentShutdown, metrics.PktRecvShutdown),
-								formatTextNumbers2(metrics.PktSentACK, metrics.PktRecvACK), formatTextNumbers2(metrics.PktSentNAK, metrics.PktRecvNAK), formatTextNumbers2(metrics.PktSentACK2, metrics.PktRecvACK2), formatTextNumbers2(metrics.PktSentData, metrics.PktRecvData),
-								speed, percent, started, status)
-						} else {
-							textF += "  [UDT connection not established]\n"
-						}
-					} else if blockStats, ok := virtualConn.Stats.(*core.BlockTransferStats); ok {
-						var direction, targetBlocks string
-						switch blockStats.Direction {
-						case core.DirectionIn:
-							direction = "In"
-						case core.DirectionOut:
-							direction = "Out"
-						case core.DirectionBi:
-							direction = "Bi"
-						}
-
-						for n, block := range blockStats.TargetBlocks {
-							if n > 0 {
-								targetBlocks += ", "
-							}
-							targetBlocks += fmt.Sprintf("%d-%d", block.Offset, block.Limit)
-						}
-
-						textB += fmt.Sprintf("%-12s  %-12s  %-12s  %-17s %-3s  %-12d %-15d",
-							shortenText(session.ID.String(), 8), shortenText(hex.EncodeToString(virtualConn.Peer.PublicKey.SerializeCompressed()), 8), shortenText(hex.EncodeToString(blockStats.BlockchainPublicKey.SerializeCompressed()), 8),
-							targetBlocks, direction, blockStats.LimitBlockCount, blockStats.MaxBlockSize)
-
-						if blockStats.UDTConn != nil {
-							metrics := blockStats.UDTConn.Metrics
-
-							speed := "?"
-							percent := ""
-							//eta := "?"
-
-							switch blockStats.Direction {
-							case core.DirectionIn:
-								speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedReceive/1024)
-							case core.DirectionOut:
-								speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedSend/1024)
-							case core.DirectionBi:
-								speed = fmt.Sprintf("%.2f KB/s - %.2f KB/s", metrics.SpeedSend/1024, metrics.SpeedReceive/1024)
-							}
-
-							status := "Active"
-							if reason := virtualConn.GetTerminateReason(); reason > 0 {
-								status = "Terminated. " + translateTerminateReason(reason)
-							}
-
-							started := metrics.Started.Format(dateFormat)
-
-							textB += fmt.Sprintf(" | %-12s  %-5s %-5s %-8s %-8s %-8s %-8s %-14s %-7s %s  %s\n",
-								formatTextNumbers2(metrics.DataSent, metrics.DataReceived), formatTextNumbers2(metrics.PktSendHandShake, metrics.PktRecvHandShake), formatTextNumbers2(metrics.PktSentShutdown, metrics.PktRecvShutdown),
-								formatTextNumbers2(metrics.PktSentACK, metrics.PktRecvACK), formatTextNumbers2(metrics.PktSentNAK, metrics.PktRecvNAK), formatTextNumbers2(metrics.PktSentACK2, metrics.PktRecvACK2), formatTextNumbers2(metrics.PktSentData, metrics.PktRecvData),
-								speed, percent, started, status)
-						} else {
-							textB += "  [UDT connection not established]\n"
-						}
+				textB += fmt.Sprintf("%-12s  %-12s  %-12s  %-17s %-3s  %-12d %-15d",
+					shortenText(session.ID.String(), 8), shortenText(hex.EncodeToString(virtualConn.Peer.PublicKey.SerializeCompressed()), 8), shortenText(hex.EncodeToString(blockStats.BlockchainPublicKey.SerializeCompressed()), 8),
+					targetBlocks, direction, blockStats.LimitBlockCount, blockStats.MaxBlockSize)
 
+				if blockStats.UDTConn != nil {
+					metrics := blockStats.UDTConn.Metrics
+
+					speed := "?"
+					percent := ""
+
+					switch blockStats.Direction {
+					case core.DirectionIn:
+						speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedReceive/1024)
+					case core.DirectionOut:
+						speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedSend/1024)
+					case core.DirectionBi:
+						speed = fmt.Sprintf("%.2f KB/s - %.2f KB/s", metrics.SpeedSend/1024, metrics.SpeedReceive/1024)
+					}
+
+					status := "Active"
+					if reason := virtualConn.GetTerminateReason(); reason > 0 {
+						status = "Terminated. " + translateTerminateReason(reason)
 					}
+
+					started := metrics.Started.Format(dateFormat)
+
+					textB += fmt.Sprintf(" | %-12s  %-5s %-5s %-8s %-8s %-8s %-8s %-14s %-7s %s  %s\n",
+						formatTextNumbers2(metrics.DataSent, metrics.DataReceived), formatTextNumbers2(metrics.PktSendHandShake, metrics.PktRecvHandShake), formatTextNumbers2(metrics.PktSentShutdown, metrics.PktRecvShutdown),
+						formatTextNumbers2(metrics.PktSentACK, metrics.PktRecvACK), formatTextNumbers2(metrics.PktSentNAK, metrics.PktRecvNAK), formatTextNumbers2(metrics.PktSentACK2, metrics.PktRecvACK2), formatTextNumbers2(metrics.PktSentData, metrics.PktRecvData),
+						speed, percent, started, status)
+				} else {
+					textB += "  [UDT connection not established]\n"
 				}
-			}
 
-			if textF != "" {
-				fmt.Fprintf(output, "Lite ID       Peer          Hash          Way  File Size  Offset     Limit    | Write-Read    HS    Shut  ACK      NAK      ACK2     Data     Speed          %%       Started              Status\n%s", textF)
-			}
-			if textB != "" {
-				fmt.Fprintf(output, "Lite ID       Peer          Blockchain    Target Blocks     Way  Limit Count  Max Block Size  | Write-Read    HS    Shut  ACK      NAK      ACK2     Data     Speed          %%       Started              Status\n%s", textB)
 			}
+		}
+	}
 
-			if textF == "" && textB == "" {
-				fmt.Fprintf(output, "No transfers.\n")
-			}
+	if textF != "" {
+		fmt.Fprintf(output, "Lite ID       Peer          Hash          Way  File Size  Offset     Limit    | Write-Read    HS    Shut  ACK      NAK      ACK2     Data     Speed          %%       ETA      Started              Status\n%s", textF)
+	}
+	if textB != "" {
+		fmt.Fprintf(output, "Lite ID       Peer          Blockchain    Target Blocks     Way  Limit Count  Max Block Size  | Write-Read    HS    Shut  ACK      NAK      ACK2     Data     Speed          %%       Started              Status\n%s", textB)
+	}
 
-		default:
-			fmt.Fprintf(output, "Unknown command.\n")
-		}
+	if textF == "" && textB == "" {
+		fmt.Fprintf(output, "No transfers.\n")
 	}
+
+	return false
 }
 
 // NetworkListOutput provides a user friendly output
@@ -788,74 +718,68 @@ func GetPeerlistSorted(backend *core.Backend) (peers []*core.PeerInfo) {
 	return peers
 }
 
+// timeoutConnectPeer is the timeout to connect to a peer for a transfer.
+const timeoutConnectPeer = time.Second * 10
+
+// validPeerID checks if the text is a peer ID or node ID.
+func validPeerID(peerIDorNodeID string) bool {
+	_, validNodeID := webapi.DecodeBlake3Hash(peerIDorNodeID)
+	_, errPeerID := core.PublicKeyFromPeerID(peerIDorNodeID)
+	return validNodeID || errPeerID == nil
+}
+
+// connectPeer connects to the peer identified by peer ID or node ID.
+func connectPeer(backend *core.Backend, peerIDorNodeID string, timeout time.Duration) (peer *core.PeerInfo, err error) {
+	if nodeID, valid := webapi.DecodeBlake3Hash(peerIDorNodeID); valid {
+		return webapi.PeerConnectNode(backend, nodeID, timeout)
+	} else if publicKey, err := core.PublicKeyFromPeerID(peerIDorNodeID); err == nil {
+		return webapi.PeerConnectPublicKey(backend, publicKey, timeout)
+	}
+
+	return nil, errors.New("invalid peer ID or node ID")
+}
+
 // ---- command-line helper functions ----
 
-// timeRetryUserInput defines how long the code waits for user input from reader before trying again
-// The termination signal takes effect once the reader is drained and returns io.EOF.
+// timeRetryUserInput defines how long the code waits for user input from reader before trying again.
+// This only applies to readers that return an error instead of blocking, like stdin at EOF. The termination signal takes effect immediately.
 const timeRetryUserInput = 500 * time.Millisecond
 
 // readUserText reads user text from the buffer. Blocking, unless termination signal is raised!
-func readUserText(reader *bufio.Reader, terminateSignal <-chan struct{}) (text string, valid, terminate bool) {
+// Pending input is discarded once the termination signal is raised. Arguments of the current command and queued script lines are returned first.
+func readUserText(reader *consoleReader, terminateSignal <-chan struct{}) (text string, valid, terminate bool) {
 	for {
-		if text, err := reader.ReadString('\n'); err == nil {
-			return strings.TrimSpace(text), true, false
-		}
-
-		// check for termination signal
 		select {
 		case <-terminateSignal:
 			return "", false, true
 		default:
 		}
 
-		time.Sleep(timeRetryUserInput)
-	}
-}
-
-func getUserOptionString(reader *bufio.Reader, terminateSignal <-chan struct{}) (response string, valid, terminate bool) {
-	return readUserText(reader, terminateSignal)
-}
-
-func getUserOptionBool(reader *bufio.Reader, terminateSignal <-chan struct{}) (response bool, valid, terminate bool) {
-	responseA, valid, terminate := readUserText(reader, terminateSignal)
-	if !valid || terminate {
-		return false, valid, terminate
-	}
-
-	responseI, err := strconv.Atoi(responseA)
-	if err != nil || (responseI != 0 && responseI != 1) {
-		return false, false, false
-	}
-
-	return responseI == 1, true, false
-}
-
-func getUserOptionInt(reader *bufio.Reader, terminateSignal <-chan struct{}) (response int, valid, terminate bool) {
-	responseA, valid, terminate := readUserText(reader, terminateSignal)
-	if !valid || terminate {
-		return 0, valid, terminate
-	}
-
-	responseI, err := strconv.Atoi(responseA)
-	if err != nil {
-		return 0, false, false
-	}
+		if arg, ok := reader.nextArg(); ok {
+			return arg, true, false
+		} else if line, ok := reader.nextLine(); ok {
+			return line, true, false
+		}
 
-	return responseI, true, false
-}
+		reader.depth = 0
 
-func getUserOptionHash(reader *bufio.Reader, terminateSignal <-chan struct{}) (hash []byte, valid, terminate bool) {
-	responseA, valid, terminate := readUserText(reader, terminateSignal)
-	if !valid || terminate {
-		return nil, valid, terminate
-	}
+		text, err := reader.reader.ReadString('\n')
+		if err == nil {
+			return strings.TrimSpace(text), true, false
+		} else if reader.exitOnEOF && errors.Is(err, io.EOF) {
+			if text = strings.TrimSpace(text); text != "" { // last line without line break
+				return text, true, false
+			}
+			return "", false, true
+		}
 
-	hash, err := hex.DecodeString(responseA)
-	if err != nil || len(hash) != 256/8 {
-		return nil, false, false
+		// wait for the termination signal or retry
+		select {
+		case <-terminateSignal:
+			return "", false, true
+		case <-time.After(timeRetryUserInput):
+		}
 	}
-
-	return hash, true, false
 }
 
 func shortenText(text string, maxLength uint64) string {
@@ -0,0 +1,229 @@
+/*
+File Name:  Command Registry.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Registry of console commands. Each command declares its name, arguments, help text, the minimum role and the handler.
+Commands are registered via registerCommand in an init function of the file that implements them.
+
+The help, the matching of commands, reading of the arguments and completion are generated from the registry.
+Declared arguments are read before the handler is called: Either from the command line, or by showing the prompt and reading the answer.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/PeernetOfficial/core/webapi"
+)
+
+// consoleCommand is a command of the console.
+type consoleCommand struct {
+	Name    string                                     // Name of the command. It may consist of multiple words.
+	Aliases []string                                   // Alternative names
+	Args    []commandArg                               // Arguments in order
+	Help    string                                     // Short description for the help
+	Role    string                                     // Minimum role required to run the command
+	Options bool                                       // Accepts options after the declared arguments. Other commands reject additional arguments.
+	Handler func(ctx *commandContext) (terminate bool) // Handler. Returns true if the session shall terminate.
+}
+
+// commandArg is an argument of a command.
+type commandArg struct {
+	Name     string                               // Name shown in the help, for example "peer ID"
+	Prompt   string                               // Prompt shown if the argument is not passed on the command line. Empty for no prompt.
+	Complete func(backend *core.Backend) []string // Optional list of values for tab completion in the local terminal
+	Optional bool                                 // Optional arguments are only read from the command line and never prompted. Empty if not passed.
+	Rest     bool                                 // The last argument takes the remaining text of the command line, for example chat hello world
+}
+
+// commandContext is passed to the command handler.
+type commandContext struct {
+	Backend         *core.Backend
+	Reader          *consoleReader
+	Output          io.Writer
+	TerminateSignal <-chan struct{}
+	Session         *consoleSession
+	MonitoredHashes map[string]struct{} // Hashes monitored by this session. They are removed when the session ends.
+	Args            []string            // Values of the declared arguments
+}
+
+// Registered commands by name and alias, and the list of commands in the order of registration.
+var (
+	commandRegistry = make(map[string]*consoleCommand)
+	commandList     []*consoleCommand
+)
+
+// registerCommand adds the command to the registry. It panics if the name is already used, since that is a programming error.
+func registerCommand(command *consoleCommand) {
+	for _, name := range append([]string{command.Name}, command.Aliases...) {
+		if _, exists := commandRegistry[name]; exists {
+			panic("console command registered twice: " + name)
+		}
+		commandRegistry[name] = command
+	}
+
+	commandList = append(commandList, command)
+}
+
+// lookupCommand returns the command by name or alias. Nil if not found.
+func lookupCommand(name string) *consoleCommand {
+	return commandRegistry[name]
+}
+
+// commandNames returns all names and aliases of registered commands.
+func commandNames() (names []string) {
+	for name := range commandRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// completeCommand returns the command names that start with the text and are allowed for the role.
+func completeCommand(text, role string) (matches []string) {
+	text = strings.ToLower(text)
+
+	for _, name := range commandNames() {
+		if strings.HasPrefix(name, text) && roleAllowed(role, name) {
+			matches = append(matches, name)
+		}
+	}
+
+	return matches
+}
+
+// roleLevels ranks the roles. A role is allowed all commands of lower ranked roles.
+var roleLevels = map[string]int{roleReadOnly: 1, roleOperator: 2, roleAdmin: 3}
+
+// roleAllowed checks if the role is allowed to run the command. Unknown commands are not allowed.
+func roleAllowed(role, name string) bool {
+	command := lookupCommand(name)
+	if command == nil {
+		return false
+	}
+
+	level, ok := roleLevels[role]
+	return ok && level >= roleLevels[command.Role]
+}
+
+// validRole checks if the role is known.
+func validRole(role string) bool {
+	_, ok := roleLevels[role]
+	return ok
+}
+
+// usage returns the command with its arguments, for example "get block [peer ID] [block number]".
+func (command *consoleCommand) usage() string {
+	text := command.Name
+	for _, arg := range command.Args {
+		text += " [" + arg.Name + "]"
+	}
+	return text
+}
+
+// showHelp lists the commands allowed for the role sorted by name.
+func showHelp(output io.Writer, role string) {
+	commands := make([]*consoleCommand, 0, len(commandList))
+	for _, command := range commandList {
+		if roleAllowed(role, command.Name) {
+			commands = append(commands, command)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+
+	text := "Please enter a command:\n"
+	for _, command := range commands {
+		text += fmt.Sprintf("%-44s  %s\n", command.usage(), command.Help)
+	}
+
+	text += "\n" +
+		"Arguments can be passed on the same line, for example: get block [peer ID] [block number]\n" +
+		"Use quotes for arguments with spaces, for example: run \"my script.txt\"\n" +
+		"Text arguments take the rest of the line, for example: chat hello world\n" +
+		"Add --json to a command for JSON output, for example: status --json\n" +
+		"Filter options for peer list and status: --root --nat --firewall (=0 for the opposite) --ipv4 --ipv6 --agent=[text] --min-packets=[n]\n" +
+		"  --sort=rtt|packets|distance --limit=[n] --page=[n] --count, for example: peer list --root=0 --sort=rtt --limit=20\n" +
+		"\n"
+
+	fmt.Fprint(output, text)
+}
+
+// readArgs reads the declared arguments of the command. Arguments not passed on the command line are prompted for, except optional ones.
+func (ctx *commandContext) readArgs(command *consoleCommand) (terminate bool) {
+	ctx.Args = nil
+
+	for _, arg := range command.Args {
+		if arg.Rest && len(ctx.Reader.args) > 0 {
+			ctx.Args = append(ctx.Args, strings.Join(ctx.Reader.args, " "))
+			ctx.Reader.args = nil
+			continue
+		} else if arg.Optional {
+			text, _ := ctx.Reader.nextArg()
+			ctx.Args = append(ctx.Args, text)
+			continue
+		}
+
+		if arg.Prompt != "" {
+			ctx.Reader.prompt(ctx.Output, arg.Prompt+"\n")
+		}
+
+		text, _, terminate := readUserText(ctx.Reader, ctx.TerminateSignal)
+		if terminate {
+			return true
+		}
+		ctx.Args = append(ctx.Args, text)
+	}
+
+	return false
+}
+
+// extraArgs returns the arguments passed on the command line that are not used by the command. They are an error, unless the command accepts options.
+func (ctx *commandContext) extraArgs(command *consoleCommand) []string {
+	if command.Options {
+		return nil
+	}
+	return ctx.Reader.args
+}
+
+// runTask runs a long operation of the command in the background, so that the console accepts the next command.
+// In batch mode the task runs synchronously instead, so that scripts and the command line mode wait for it.
+func (ctx *commandContext) runTask(task func()) {
+	if ctx.Session.Batch {
+		task()
+		return
+	}
+	go task()
+}
+
+// Arg returns the argument as text.
+func (ctx *commandContext) Arg(n int) string {
+	if n < len(ctx.Args) {
+		return ctx.Args[n]
+	}
+	return ""
+}
+
+// RestArgs returns the remaining arguments passed on the command line after the declared ones, for example options.
+func (ctx *commandContext) RestArgs() (args []string) {
+	args = ctx.Reader.args
+	ctx.Reader.args = nil
+	return args
+}
+
+// ArgInt returns the argument as number.
+func (ctx *commandContext) ArgInt(n int) (number int, valid bool) {
+	number, err := strconv.Atoi(ctx.Arg(n))
+	return number, err == nil
+}
+
+// ArgHash returns the argument as hex decoded blake3 hash.
+func (ctx *commandContext) ArgHash(n int) (hash []byte, valid bool) {
+	return webapi.DecodeBlake3Hash(ctx.Arg(n))
+}
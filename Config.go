@@ -0,0 +1,301 @@
+/*
+File Name:  Config.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Validation of the root specific settings at startup and reload of settings at runtime.
+
+The reload is triggered by SIGHUP or the console command "config reload". Only settings that can safely change at runtime are applied:
+* HTTPAccessAllow (CORS header)
+* CacheMaxAge and CacheMaxAgeCSV (cache policy)
+* RateLimit and RateLimitAllow, if rate limiting was enabled at startup
+Other settings require a restart.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// exitErrorConfigInvalid is the exit code if the config fails validation.
+const exitErrorConfigInvalid = 21
+
+// Default cache times in seconds.
+const (
+	cacheMaxAgeDefault    = 60      // 1 minute
+	cacheMaxAgeCSVDefault = 10 * 60 // 10 minutes
+)
+
+// validateConfig checks the settings and returns all errors found.
+func validateConfig(c *rootConfig) (errs []error) {
+	for _, listen := range c.WebListen {
+		errs = appendError(errs, validateListen("WebListen", listen))
+	}
+	for _, listen := range c.APIListen {
+		errs = appendError(errs, validateListen("APIListen", listen))
+	}
+	for _, listen := range c.ACMEHTTPListen {
+		errs = appendError(errs, validateListen("ACMEHTTPListen", listen))
+	}
+
+	if c.UseSSL && len(c.WebListen) > 0 {
+		errs = append(errs, validateCertificate("CertificateFile", "CertificateKey", c.CertificateFile, c.CertificateKey, len(c.ACMEDomains) > 0)...)
+	}
+	if c.APIUseSSL && len(c.APIListen) > 0 {
+		errs = append(errs, validateCertificate("APICertificateFile", "APICertificateKey", c.APICertificateFile, c.APICertificateKey, len(c.ACMEDomains) > 0)...)
+	}
+	if c.ACMEDirectoryCA != "" {
+		errs = appendError(errs, validateFile("ACMEDirectoryCA", c.ACMEDirectoryCA))
+	}
+
+	for _, setting := range []struct{ name, value string }{
+		{"HTTPTimeoutRead", c.HTTPTimeoutRead},
+		{"HTTPTimeoutWrite", c.HTTPTimeoutWrite},
+		{"APITimeoutRead", c.APITimeoutRead},
+		{"APITimeoutWrite", c.APITimeoutWrite},
+		{"FederationInterval", c.FederationInterval},
+		{"CacheMaxAge", c.CacheMaxAge},
+		{"CacheMaxAgeCSV", c.CacheMaxAgeCSV},
+	} {
+		errs = appendError(errs, validateDuration(setting.name, setting.value))
+	}
+
+	if c.DatabaseFolder == "" {
+		errs = append(errs, fmt.Errorf("DatabaseFolder is not set. It is required to store the statistics"))
+	} else if stat, err := os.Stat(c.DatabaseFolder); err != nil {
+		errs = append(errs, fmt.Errorf("DatabaseFolder '%s' is not accessible: %v", c.DatabaseFolder, err))
+	} else if !stat.IsDir() {
+		errs = append(errs, fmt.Errorf("DatabaseFolder '%s' is not a directory", c.DatabaseFolder))
+	}
+
+	if c.WebFiles != "" {
+		if stat, err := os.Stat(c.WebFiles); err != nil || !stat.IsDir() {
+			errs = append(errs, fmt.Errorf("WebFiles '%s' is not an accessible directory", c.WebFiles))
+		}
+	}
+
+	switch strings.ToLower(c.AccessLogFormat) {
+	case "", accessLogFormatCommon, accessLogFormatCombined, accessLogFormatJSON:
+	default:
+		errs = append(errs, fmt.Errorf("AccessLogFormat '%s' is unknown. Valid formats are common, combined and json", c.AccessLogFormat))
+	}
+
+	if _, _, err := parseRateLimitRules(c.RateLimit, c.RateLimitAllow); err != nil {
+		errs = append(errs, err)
+	}
+
+	keys := make(map[uuid.UUID]struct{})
+	if c.APIKey != uuid.Nil {
+		keys[c.APIKey] = struct{}{}
+	}
+	for _, entry := range c.APIKeys {
+		if entry.Key == uuid.Nil {
+			errs = append(errs, fmt.Errorf("APIKeys entry '%s' has no key", entry.Name))
+		} else if _, exists := keys[entry.Key]; exists {
+			errs = append(errs, fmt.Errorf("APIKeys entry '%s' uses a key that is already used", entry.Name))
+		}
+		keys[entry.Key] = struct{}{}
+
+		if !validRole(strings.ToLower(entry.Role)) {
+			errs = append(errs, fmt.Errorf("APIKeys entry '%s' has unknown role '%s'. Valid roles are readonly, operator and admin", entry.Name, entry.Role))
+		}
+	}
+
+	for _, root := range c.FederationRoots {
+		if parsed, err := url.Parse(root); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("FederationRoots entry '%s' is not a valid http or https URL", root))
+		}
+	}
+
+	return errs
+}
+
+func appendError(errs []error, err error) []error {
+	if err != nil {
+		return append(errs, err)
+	}
+	return errs
+}
+
+// validateListen checks an address in the format IP:Port. The IP may be omitted to listen on any.
+func validateListen(setting, address string) error {
+	host, portA, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%s '%s' is invalid, expected format IP:Port: %v", setting, address, err)
+	}
+
+	if port, err := strconv.Atoi(portA); err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("%s '%s' has an invalid port", setting, address)
+	}
+
+	if host != "" && net.ParseIP(host) == nil {
+		for _, char := range host {
+			if !(char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char >= '0' && char <= '9' || char == '-' || char == '.') {
+				return fmt.Errorf("%s '%s' has an invalid IP or host name", setting, address)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateCertificate checks that the certificate and key files exist. If ACME is configured, the files may be empty.
+func validateCertificate(settingFile, settingKey, certificateFile, certificateKey string, acme bool) (errs []error) {
+	if certificateFile == "" && certificateKey == "" {
+		if !acme {
+			errs = append(errs, fmt.Errorf("%s and %s are required for SSL unless ACMEDomains is set", settingFile, settingKey))
+		}
+		return errs
+	}
+
+	errs = appendError(errs, validateFile(settingFile, certificateFile))
+	errs = appendError(errs, validateFile(settingKey, certificateKey))
+
+	return errs
+}
+
+func validateFile(setting, filename string) error {
+	if filename == "" {
+		return fmt.Errorf("%s is not set", setting)
+	} else if stat, err := os.Stat(filename); err != nil {
+		return fmt.Errorf("%s '%s' is not accessible: %v", setting, filename, err)
+	} else if stat.IsDir() {
+		return fmt.Errorf("%s '%s' is a directory", setting, filename)
+	}
+	return nil
+}
+
+// validateDuration checks a duration setting. Empty is valid and means the default.
+func validateDuration(setting, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%s '%s' is not a valid duration. Valid units are ms, s, m, h, for example \"10s\"", setting, value)
+	} else if duration < 0 {
+		return fmt.Errorf("%s '%s' must not be negative", setting, value)
+	}
+
+	return nil
+}
+
+// ---- runtime settings ----
+
+// runtimeSettings are the settings that can be changed at runtime.
+type runtimeSettings struct {
+	HTTPAccessAllow string // Access-Control-Allow-Origin header
+	CacheMaxAge     int    // Cache time in seconds of statistics responses
+	CacheMaxAgeCSV  int    // Cache time in seconds of the CSV file
+}
+
+var currentRuntimeSettings atomic.Pointer[runtimeSettings]
+
+// settings returns the current runtime settings.
+func settings() *runtimeSettings {
+	if current := currentRuntimeSettings.Load(); current != nil {
+		return current
+	}
+	return &runtimeSettings{CacheMaxAge: cacheMaxAgeDefault, CacheMaxAgeCSV: cacheMaxAgeCSVDefault}
+}
+
+// newRuntimeSettings extracts the runtime settings from the config.
+func newRuntimeSettings(c *rootConfig) *runtimeSettings {
+	return &runtimeSettings{
+		HTTPAccessAllow: c.HTTPAccessAllow,
+		CacheMaxAge:     parseCacheMaxAge(c.CacheMaxAge, cacheMaxAgeDefault),
+		CacheMaxAgeCSV:  parseCacheMaxAge(c.CacheMaxAgeCSV, cacheMaxAgeCSVDefault),
+	}
+}
+
+// parseCacheMaxAge returns the duration in seconds. Empty returns the default.
+func parseCacheMaxAge(value string, defaultSeconds int) int {
+	if value == "" {
+		return defaultSeconds
+	}
+	return int(parseDuration(value).Seconds())
+}
+
+// initRuntimeSettings sets the runtime settings from the config loaded at startup.
+func initRuntimeSettings() {
+	currentRuntimeSettings.Store(newRuntimeSettings(&config))
+}
+
+func init() {
+	registerCommand(&consoleCommand{Name: "config reload", Help: "Reload settings that can change at runtime", Role: roleOperator, Handler: func(ctx *commandContext) bool {
+		changes, err := reloadConfig()
+		if err != nil {
+			fmt.Fprintf(ctx.Output, "Error reloading config: %v\n", err)
+			return false
+		} else if len(changes) == 0 {
+			fmt.Fprintf(ctx.Output, "Config reloaded. No changes.\n")
+			return false
+		}
+
+		fmt.Fprintf(ctx.Output, "Config reloaded:\n")
+		for _, change := range changes {
+			fmt.Fprintf(ctx.Output, "* %s\n", change)
+		}
+		return false
+	}})
+}
+
+// reloadConfig reads the config file and applies the settings that can change at runtime. If the new config is invalid, nothing is changed.
+func reloadConfig() (changes []string, err error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var fresh rootConfig
+	if err = yaml.Unmarshal(data, &fresh); err != nil {
+		return nil, fmt.Errorf("error parsing config file '%s': %v", configFile, err)
+	}
+
+	if errs := validateConfig(&fresh); len(errs) > 0 {
+		var texts []string
+		for _, err := range errs {
+			texts = append(texts, err.Error())
+		}
+		return nil, fmt.Errorf("invalid config, nothing changed:\n%s", strings.Join(texts, "\n"))
+	}
+
+	if statRateLimiter != nil {
+		changed, err := statRateLimiter.update(fresh.RateLimit, fresh.RateLimitAllow)
+		if err != nil {
+			return nil, err
+		} else if changed {
+			changes = append(changes, fmt.Sprintf("RateLimit: %d rules, %d allow entries, counters reset", len(fresh.RateLimit), len(fresh.RateLimitAllow)))
+		}
+	} else if len(fresh.RateLimit) > 0 {
+		changes = append(changes, "RateLimit: rate limiting was disabled at startup and requires a restart to be enabled")
+	}
+
+	old := settings()
+	updated := newRuntimeSettings(&fresh)
+	currentRuntimeSettings.Store(updated)
+
+	if old.HTTPAccessAllow != updated.HTTPAccessAllow {
+		changes = append(changes, fmt.Sprintf("HTTPAccessAllow: '%s' -> '%s'", old.HTTPAccessAllow, updated.HTTPAccessAllow))
+	}
+	if old.CacheMaxAge != updated.CacheMaxAge {
+		changes = append(changes, fmt.Sprintf("CacheMaxAge: %d s -> %d s", old.CacheMaxAge, updated.CacheMaxAge))
+	}
+	if old.CacheMaxAgeCSV != updated.CacheMaxAgeCSV {
+		changes = append(changes, fmt.Sprintf("CacheMaxAgeCSV: %d s -> %d s", old.CacheMaxAgeCSV, updated.CacheMaxAgeCSV))
+	}
+
+	return changes, nil
+}
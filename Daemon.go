@@ -0,0 +1,124 @@
+/*
+File Name:  Daemon.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Support for running the root peer as a daemon, for example as systemd service:
+* PID file that is removed on shutdown
+* sd_notify readiness, stopping and watchdog notifications if started by systemd with Type=notify
+
+The notification protocol is implemented directly: Messages are sent as datagrams to the unix socket in the NOTIFY_SOCKET environment variable.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// exitErrorPIDFile is the exit code if the PID file cannot be created.
+const exitErrorPIDFile = 20
+
+// pidFile is the PID file created at startup. Empty if not used.
+var pidFile string
+
+// writePIDFile writes the process ID into the file. It fails if the file exists and belongs to another running process.
+func writePIDFile(filename string) (err error) {
+	if data, err := os.ReadFile(filename); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid != os.Getpid() && processExists(pid) {
+			return fmt.Errorf("process %d is already running", pid)
+		}
+	}
+
+	if err = os.WriteFile(filename, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return err
+	}
+
+	pidFile = filename
+	return nil
+}
+
+// removePIDFile deletes the PID file if one was created.
+func removePIDFile() {
+	if pidFile != "" {
+		os.Remove(pidFile)
+	}
+}
+
+// processExists checks if a process with the PID is running.
+func processExists(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	// On Unix FindProcess always succeeds. Signal 0 checks for existence without affecting the process.
+	// On Windows the process is opened by FindProcess and Signal is not supported.
+	if err = process.Signal(syscall.Signal(0)); err != nil {
+		return !errors.Is(err, os.ErrProcessDone) && !errors.Is(err, syscall.ESRCH)
+	}
+
+	return true
+}
+
+// sdNotify sends the state to systemd. It returns false if the process was not started by systemd with a notify socket.
+func sdNotify(state string) bool {
+	socketName := os.Getenv("NOTIFY_SOCKET")
+	if socketName == "" {
+		return false
+	}
+
+	// Abstract namespace sockets are prefixed with @.
+	if strings.HasPrefix(socketName, "@") {
+		socketName = "\x00" + socketName[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketName, Net: "unixgram"})
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err == nil
+}
+
+// sdWatchdogInterval returns the interval to send watchdog notifications. It is half of the timeout set by systemd. Zero if the watchdog is disabled.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	// WATCHDOG_PID is set if the watchdog is meant for a specific process.
+	if pidA := os.Getenv("WATCHDOG_PID"); pidA != "" {
+		if pid, err := strconv.Atoi(pidA); err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdNotifyReady signals systemd that the startup is complete and starts sending watchdog notifications if enabled.
+func sdNotifyReady() {
+	if !sdNotify("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid())) {
+		return
+	}
+
+	if interval := sdWatchdogInterval(); interval > 0 {
+		go func() {
+			for {
+				time.Sleep(interval)
+				sdNotify("WATCHDOG=1")
+			}
+		}()
+	}
+}
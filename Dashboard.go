@@ -0,0 +1,243 @@
+/*
+File Name:  Dashboard.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Server-rendered statistics dashboard. It shows the same KPIs as the JavaScript dashboard from the web files, but the charts
+are generated as inline SVG and all numbers are also listed in tables. It works with JavaScript disabled and in text browsers.
+*/
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// chartSeries is a single line in a chart.
+type chartSeries struct {
+	Name   string    // Name shown in the legend
+	Color  string    // Stroke color
+	Values []float64 // One value per date
+}
+
+// chart dimensions in SVG units
+const (
+	chartWidth   = 900
+	chartHeight  = 300
+	chartPadLeft = 60
+	chartPadTop  = 20
+	chartPadBot  = 40
+	chartPadRgt  = 20
+)
+
+// svgLineChart renders a line chart as inline SVG. All series must have the same count of values as dates.
+func svgLineChart(title string, dates []time.Time, series []chartSeries) template.HTML {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `<svg class="chart" viewBox="0 0 %d %d" width="100%%" role="img" aria-label="%s" xmlns="http://www.w3.org/2000/svg">`, chartWidth, chartHeight+20*len(series), template.HTMLEscapeString(title))
+
+	maxValue := 0.0
+	for _, s := range series {
+		for _, value := range s.Values {
+			if value > maxValue {
+				maxValue = value
+			}
+		}
+	}
+	if maxValue == 0 {
+		maxValue = 1
+	}
+
+	plotWidth := float64(chartWidth - chartPadLeft - chartPadRgt)
+	plotHeight := float64(chartHeight - chartPadTop - chartPadBot)
+
+	x := func(n int) float64 {
+		if len(dates) <= 1 {
+			return float64(chartPadLeft) + plotWidth/2
+		}
+		return float64(chartPadLeft) + plotWidth*float64(n)/float64(len(dates)-1)
+	}
+	y := func(value float64) float64 {
+		return float64(chartPadTop) + plotHeight*(1-value/maxValue)
+	}
+
+	// horizontal grid lines with labels
+	for n := 0; n <= 4; n++ {
+		value := maxValue * float64(n) / 4
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#ddd"/>`, chartPadLeft, y(value), chartWidth-chartPadRgt, y(value))
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" font-size="12" text-anchor="end" fill="#555">%.0f</text>`, chartPadLeft-6, y(value)+4, value)
+	}
+
+	// date labels, at most 8
+	if len(dates) > 0 {
+		step := (len(dates) + 7) / 8
+		for n := 0; n < len(dates); n += step {
+			fmt.Fprintf(&b, `<text x="%.1f" y="%d" font-size="12" text-anchor="middle" fill="#555">%s</text>`, x(n), chartHeight-chartPadBot+18, dates[n].Format("2006-01-02"))
+		}
+	}
+
+	// the lines
+	for _, s := range series {
+		var points []string
+		for n, value := range s.Values {
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x(n), y(value)))
+		}
+
+		if len(points) == 1 {
+			fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"/>`, x(0), y(s.Values[0]), s.Color)
+		} else if len(points) > 1 {
+			fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="2" points="%s"/>`, s.Color, strings.Join(points, " "))
+		}
+	}
+
+	// legend below the chart
+	for n, s := range series {
+		legendY := chartHeight + 20*n
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`, chartPadLeft, legendY-10, s.Color)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="13">%s</text>`, chartPadLeft+18, legendY, template.HTMLEscapeString(s.Name))
+	}
+
+	b.WriteString(`</svg>`)
+
+	return template.HTML(b.String())
+}
+
+// formatBytes formats a size in bytes as human readable text.
+func formatBytes(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.2f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// dashboardData is the input for the dashboard template.
+type dashboardData struct {
+	Host        string         // Host name of the root peer
+	Generated   time.Time      // Time the page was generated
+	Today       jsonStatsToday // Current statistics of today
+	Daily       []jsonStatsDay // Daily records, newest first
+	ChartActive template.HTML  // Chart of daily active peers
+	ChartKPI    template.HTML  // Chart of peers per special category
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"date":  func(t time.Time) string { return t.Format("2006-01-02") },
+	"time":  func(t time.Time) string { return t.Format(dateFormat) },
+}).Parse(`<!doctype html>
+<html>
+
+<head>
+    <meta charset="utf-8" />
+    <meta name="description" content="Peernet statistics showing live count of peers.">
+    <meta name="viewport" content="width=device-width,initial-scale=1">
+    <link rel="stylesheet" href="/css/styles.css">
+    <title>{{.Host}}</title>
+    <style>
+        table.stats { margin-bottom: 2em; } table.stats th, table.stats td { padding: .3em .8em; text-align: right; border-bottom: 1px solid #ddd; } table.stats th:first-child, table.stats td:first-child { text-align: left; }
+        svg.chart { max-width: 900px; margin-bottom: 2em; }
+    </style>
+</head>
+
+<body>
+    <header class="header">
+        <div class="container content">
+            <h1>Root Peer '{{.Host}}'</h1>
+        </div>
+    </header>
+    <main>
+        <section class="section">
+            <div class="container">
+                <h2>Today</h2>
+                <table class="stats">
+                    <tr><th>Active peers</th><td>{{.Today.Active}}</td></tr>
+                    <tr><th>Root peers</th><td>{{.Today.Root}}</td></tr>
+                    <tr><th>Behind NAT</th><td>{{.Today.NAT}}</td></tr>
+                    <tr><th>Port forward</th><td>{{.Today.PortForward}}</td></tr>
+                    <tr><th>Firewall</th><td>{{.Today.Firewall}}</td></tr>
+                </table>
+
+                <h2>Blockchain</h2>
+                <table class="stats">
+                    <tr><th>Files shared</th><td>{{.Today.FilesShared}}</td></tr>
+                    <tr><th>Content size</th><td>{{bytes .Today.ContentSize}}</td></tr>
+                </table>
+
+                <h2>Daily Active Peers</h2>
+                {{.ChartActive}}
+
+                <h2>Daily Peers per Special Category</h2>
+                {{.ChartKPI}}
+
+                <h2>Daily Records</h2>
+                <table class="stats">
+                    <tr><th>Date</th><th>Active</th><th>Root</th><th>NAT</th><th>Port Forward</th><th>Firewall</th></tr>
+                    {{range .Daily}}<tr><td>{{date .Date}}</td><td>{{.Active}}</td><td>{{.Root}}</td><td>{{.NAT}}</td><td>{{.PortForward}}</td><td>{{.Firewall}}</td></tr>
+                    {{else}}<tr><td colspan="6">No records yet.</td></tr>
+                    {{end}}
+                </table>
+
+                <p>Generated {{time .Generated}} UTC. Raw data: <a href="/stat/daily.json">daily.json</a>, <a href="/stat/today.json">today.json</a>, <a href="/stat/Daily Active Peers.csv">CSV</a>.</p>
+            </div>
+        </section>
+    </main>
+</body>
+
+</html>
+`))
+
+// webDashboard renders the dashboard.
+func webDashboard(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := dashboardData{Host: r.Host, Generated: time.Now().UTC()}
+
+		data.Today = localStatsToday()
+
+		// chart series in chronological order
+		var dates []time.Time
+		active := chartSeries{Name: "Active peers", Color: "#eb7e00"}
+		root := chartSeries{Name: "Root peers", Color: "#2c3e50"}
+		nat := chartSeries{Name: "Behind NAT", Color: "#27ae60"}
+		portForward := chartSeries{Name: "Port forward", Color: "#8e44ad"}
+		firewall := chartSeries{Name: "Firewall", Color: "#c0392b"}
+
+		for _, record := range summaryDaily {
+			dates = append(dates, record.Date)
+			active.Values = append(active.Values, float64(record.stats.countActive))
+			root.Values = append(root.Values, float64(record.stats.countRoot))
+			nat.Values = append(nat.Values, float64(record.stats.countNAT))
+			portForward.Values = append(portForward.Values, float64(record.stats.countPortForward))
+			firewall.Values = append(firewall.Values, float64(record.stats.countFirewall))
+
+		}
+
+		for n := len(summaryDaily) - 1; n >= 0; n-- {
+			record := summaryDaily[n]
+			data.Daily = append(data.Daily, jsonStatsDay{Date: record.Date, Active: record.stats.countActive, Root: record.stats.countRoot, NAT: record.stats.countNAT, PortForward: record.stats.countPortForward, Firewall: record.stats.countFirewall})
+		}
+
+		data.ChartActive = svgLineChart("Daily Active Peers", dates, []chartSeries{active})
+		data.ChartKPI = svgLineChart("Daily Peers per Special Category", dates, []chartSeries{root, nat, portForward, firewall})
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		CacheControlSetHeader(w, true, settings().CacheMaxAge)
+
+		if err := dashboardTemplate.Execute(w, data); err != nil {
+			backend.LogError("webDashboard", "Error rendering dashboard: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+/*
+File Name:  Federation.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Federation of statistics across multiple root peers. Each configured sibling root is periodically polled for its daily.json and today.json.
+The last successful results are stored per root in the database folder, so they survive restarts and sibling roots that are down.
+The combined view of all roots including this one is served at /stat/network.json.
+
+Note that the aggregate counts are sums of the per-root counts. Peers connected to multiple roots are counted multiple times.
+The unique count of today is estimated by merging the HyperLogLog sketches of the roots instead.
+Today's aggregate only includes roots that are currently online and reported today. The daily history of offline roots is kept.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/PeernetOfficial/core/webapi"
+)
+
+// federationIntervalDefault is the default polling interval of sibling roots.
+const federationIntervalDefault = 5 * time.Minute
+
+// federationBackoffMax is the maximum wait time between polls of a sibling root that is down.
+const federationBackoffMax = time.Hour
+
+// federationResponseMax is the maximum size of a response of a sibling root. Larger responses are rejected.
+const federationResponseMax = 16 * 1024 * 1024
+
+// federationFolder is the sub-folder in the database folder storing the results per root.
+const federationFolder = "Federation"
+
+// federatedRoot is the state of a single sibling root.
+type federatedRoot struct {
+	URL         string         `json:"url"`         // Base URL of the root
+	Today       jsonStatsToday `json:"today"`       // Last known statistics of today
+	Daily       []jsonStatsDay `json:"daily"`       // Last known daily records
+	Sketch      []byte         `json:"sketch"`      // Last known sketch of today's active peers. Empty if not supported by the root.
+	LastSuccess time.Time      `json:"lastsuccess"` // Last successful poll
+	LastAttempt time.Time      `json:"lastattempt"` // Last poll attempt
+	LastError   string         `json:"lasterror"`   // Error of the last poll, empty if successful
+	Failures    int            `json:"failures"`    // Count of consecutive failed polls
+
+	nextAttempt time.Time // Next scheduled poll
+}
+
+var federatedRoots []*federatedRoot
+var federatedRootsMutex sync.RWMutex
+
+// initFederation loads the stored results and starts polling the sibling roots.
+func initFederation(backend *core.Backend) {
+	if len(config.FederationRoots) == 0 {
+		return
+	}
+
+	interval := parseDuration(config.FederationInterval)
+	if interval <= 0 {
+		interval = federationIntervalDefault
+	}
+
+	for _, rootURL := range config.FederationRoots {
+		root := &federatedRoot{URL: strings.TrimSuffix(rootURL, "/")}
+		root.load()
+		federatedRoots = append(federatedRoots, root)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	go func() {
+		for {
+			for _, root := range federatedRoots {
+				federatedRootsMutex.RLock()
+				skip := time.Now().Before(root.nextAttempt)
+				federatedRootsMutex.RUnlock()
+
+				if !skip {
+					root.poll(client, interval)
+				}
+			}
+
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+// poll fetches the statistics from the root. In case of failure the last known data is kept and the next poll is delayed exponentially.
+func (root *federatedRoot) poll(client *http.Client, interval time.Duration) {
+	var daily jsonStatistics
+	var today jsonStatsToday
+
+	err := federationFetch(client, root.URL+"/stat/daily.json", &daily)
+	if err == nil {
+		err = federationFetch(client, root.URL+"/stat/today.json", &today)
+	}
+
+	// The sketch is optional since older roots do not provide it.
+	var sketch jsonSketch
+	if err == nil {
+		federationFetch(client, root.URL+"/stat/sketch.json", &sketch)
+	}
+
+	federatedRootsMutex.Lock()
+	defer federatedRootsMutex.Unlock()
+
+	root.LastAttempt = time.Now().UTC()
+
+	if err != nil {
+		root.Failures++
+		root.LastError = err.Error()
+
+		backoff := interval << uint(root.Failures)
+		if backoff > federationBackoffMax || backoff <= 0 {
+			backoff = federationBackoffMax
+		}
+		root.nextAttempt = time.Now().Add(backoff)
+
+		if root.Failures == 1 {
+			log.Printf("Federation: Error polling root '%s': %v\n", root.URL, err)
+		}
+		return
+	}
+
+	root.Failures = 0
+	root.LastError = ""
+	root.LastSuccess = root.LastAttempt
+	root.Today = today
+	root.Daily = daily.Daily
+	root.Sketch = sketch.Sketch
+	root.nextAttempt = time.Now().Add(interval)
+
+	root.store()
+}
+
+// federationFetch downloads and decodes JSON data from the URL.
+func federationFetch(client *http.Client, address string, data interface{}) (err error) {
+	resp, err := client.Get(address)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d for %s", resp.StatusCode, address)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, federationResponseMax+1))
+	if err != nil {
+		return err
+	} else if len(body) > federationResponseMax {
+		return fmt.Errorf("response of %s exceeds %d bytes", address, federationResponseMax)
+	}
+
+	return json.Unmarshal(body, data)
+}
+
+// filename returns the file name storing the results of the root.
+func (root *federatedRoot) filename() string {
+	name := root.URL
+	if parsed, err := url.Parse(root.URL); err == nil && parsed.Host != "" {
+		name = parsed.Host
+	}
+	name = strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(name)
+
+	return path.Join(config.DatabaseFolder, federationFolder, name+".json")
+}
+
+// store writes the root's results to disk. The caller must hold the lock.
+func (root *federatedRoot) store() {
+	if config.DatabaseFolder == "" {
+		return
+	}
+
+	os.MkdirAll(path.Join(config.DatabaseFolder, federationFolder), 0755)
+
+	data, err := json.Marshal(root)
+	if err != nil {
+		return
+	}
+
+	if err := os.WriteFile(root.filename(), data, 0644); err != nil {
+		log.Printf("Federation: Error storing results of root '%s': %v\n", root.URL, err)
+	}
+}
+
+// load reads the root's results from disk, if available.
+func (root *federatedRoot) load() {
+	if config.DatabaseFolder == "" {
+		return
+	}
+
+	data, err := os.ReadFile(root.filename())
+	if err != nil {
+		return
+	}
+
+	rootURL := root.URL
+	json.Unmarshal(data, root)
+	root.URL = rootURL
+}
+
+// ---- combined network statistics ----
+
+type jsonNetworkRoot struct {
+	URL         string         `json:"url"`         // Base URL of the root. Empty for this root.
+	Self        bool           `json:"self"`        // Whether this is the local root
+	Online      bool           `json:"online"`      // Whether the last poll was successful
+	LastSuccess time.Time      `json:"lastsuccess"` // Last successful poll
+	LastError   string         `json:"lasterror"`   // Error of the last poll
+	Today       jsonStatsToday `json:"today"`       // Statistics of today
+	Daily       []jsonStatsDay `json:"daily"`       // Daily records
+}
+
+type jsonNetworkStatistics struct {
+	Roots     []jsonNetworkRoot `json:"roots"` // Per-root statistics
+	Aggregate struct {
+		Today jsonStatsToday `json:"today"` // Sum of today's statistics of all roots
+		Daily []jsonStatsDay `json:"daily"` // Sum of daily records of all roots per date
+
+		// Estimated count of unique active peers today across all roots that provide a sketch.
+		// Unlike the sums, peers connected to multiple roots are only counted once.
+		UniqueToday uint64 `json:"uniquetoday"`
+	} `json:"aggregate"`
+}
+
+func webStatNetworkJSON(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var stats jsonNetworkStatistics
+
+		self := jsonNetworkRoot{Self: true, Online: true, LastSuccess: time.Now().UTC(), Today: localStatsToday()}
+		for _, record := range summaryDaily {
+			self.Daily = append(self.Daily, jsonStatsDay{Date: record.Date, Active: record.stats.countActive, Root: record.stats.countRoot, NAT: record.stats.countNAT, PortForward: record.stats.countPortForward, Firewall: record.stats.countFirewall})
+		}
+		stats.Roots = append(stats.Roots, self)
+
+		federatedRootsMutex.RLock()
+		for _, root := range federatedRoots {
+			stats.Roots = append(stats.Roots, jsonNetworkRoot{URL: root.URL, Online: !root.LastSuccess.IsZero() && root.Failures == 0, LastSuccess: root.LastSuccess, LastError: root.LastError, Today: root.Today, Daily: root.Daily})
+		}
+		federatedRootsMutex.RUnlock()
+
+		// merge the sketches of today
+		unique := newHyperLogLog(sketchPrecisionDaily)
+		if sketch := sketchDaily(time.Now().UTC().Truncate(time.Hour * 24)); sketch != nil {
+			unique.Merge(sketch)
+		}
+
+		federatedRootsMutex.RLock()
+		for _, root := range federatedRoots {
+			sketch := &hyperLogLog{}
+			if len(root.Sketch) > 0 && root.Failures == 0 && sketch.UnmarshalBinary(root.Sketch) == nil && root.Today.Date.UTC().Truncate(time.Hour*24).Equal(time.Now().UTC().Truncate(time.Hour*24)) {
+				unique.Merge(sketch)
+			}
+		}
+		federatedRootsMutex.RUnlock()
+
+		stats.Aggregate.UniqueToday = unique.Estimate()
+
+		// aggregate per date
+		aggregate := make(map[string]*jsonStatsDay)
+		stats.Aggregate.Today.Date = self.Today.Date
+		today := self.Today.Date.UTC().Truncate(time.Hour * 24)
+
+		for _, root := range stats.Roots {
+			if root.LastSuccess.IsZero() {
+				continue
+			}
+
+			// Today's statistics only count for roots that are online and reported the same day. Otherwise the last known ones would be added indefinitely.
+			if root.Online && root.Today.Date.UTC().Truncate(time.Hour*24).Equal(today) {
+				stats.Aggregate.Today.Active += root.Today.Active
+				stats.Aggregate.Today.Root += root.Today.Root
+				stats.Aggregate.Today.NAT += root.Today.NAT
+				stats.Aggregate.Today.PortForward += root.Today.PortForward
+				stats.Aggregate.Today.Firewall += root.Today.Firewall
+				stats.Aggregate.Today.FilesShared += root.Today.FilesShared
+				stats.Aggregate.Today.ContentSize += root.Today.ContentSize
+			}
+
+			for _, day := range root.Daily {
+				key := day.Date.UTC().Format("2006-01-02")
+				sum, ok := aggregate[key]
+				if !ok {
+					sum = &jsonStatsDay{Date: day.Date.UTC()}
+					aggregate[key] = sum
+				}
+
+				sum.Active += day.Active
+				sum.Root += day.Root
+				sum.NAT += day.NAT
+				sum.PortForward += day.PortForward
+				sum.Firewall += day.Firewall
+			}
+		}
+
+		for _, day := range aggregate {
+			stats.Aggregate.Daily = append(stats.Aggregate.Daily, *day)
+		}
+		sort.Slice(stats.Aggregate.Daily, func(i, j int) bool { return stats.Aggregate.Daily[i].Date.Before(stats.Aggregate.Daily[j].Date) })
+
+		CacheControlSetHeader(w, true, settings().CacheMaxAge)
+		webapi.EncodeJSON(backend, w, r, stats)
+	}
+}
@@ -0,0 +1,837 @@
+/*
+File Name:  File Download Parallel.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Parallel download of a file from multiple peers. The file is split into segments which are requested as ranges via the offset and limit
+of the file transfer request. Each source downloads one segment at a time and writes it at its position into the partial file.
+
+Sources are the peers passed via --peer and, unless disabled, the peers found by a DHT lookup of the file hash: The peers reported to store
+the file, followed by the peers with the node ID closest to the file hash. The lookup contacts the nodes closest to the hash, so these include
+peers that were not connected before. Peers reporting to store a hash may only store a record, therefore each candidate is probed with a
+request for the file that is terminated after the header. Only peers that answer with the file header are used.
+
+A segment is reassigned to another source if its transfer fails, if no data is received for 20 seconds, or if the source is much slower
+than the fastest source. Stalled and slow sources are dropped, failing sources after 2 failures. The last remaining source is not dropped
+for a stall, it retries the segment.
+
+Completed segments are recorded in "[target].segments". Running the same download again resumes the missing segments.
+Like regular downloads, a target can only be downloaded once at a time.
+When all segments are complete, the blake3 hash of the file is verified and the partial file is renamed to the target.
+
+download parallel [file hash] [options]
+
+--target=[name]                 Target file name in the download folder. The hash is used if omitted.
+--peer=[peer ID]                Source peer. Can be repeated or a comma separated list.
+--sources=[n]                   Max count of sources used in parallel, default 4.
+--discover=0                    Do not search for other sources than the ones passed via --peer.
+--merkle[=file]                 Verify each fragment with the merkle tree, see Merkle Verification.go.
+--merkle-root=[hash]            Trusted merkle root hash for the verification.
+--publisher=[peer ID]           Peer whose blockchain contains the file record with the merkle root hash. The sources are tried if omitted.
+
+With merkle verification, segments consist of whole fragments and a source sending an invalid fragment is dropped.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/PeernetOfficial/core/btcec"
+	"github.com/PeernetOfficial/core/dht"
+	"github.com/PeernetOfficial/core/protocol"
+	"github.com/PeernetOfficial/core/webapi"
+)
+
+// Settings of the parallel download.
+const (
+	parallelStateExtension = ".segments"      // Extension of the file recording the completed segments
+	parallelSegmentSize    = 4 * 1024 * 1024  // Size of a segment
+	parallelSourcesDefault = 4                // Default max count of sources used in parallel
+	parallelSourcesMax     = 16               // Max count of sources
+	parallelDiscoverMax    = 20               // Max count of discovered peers to probe
+	parallelLookupTimeout  = 10 * time.Second // Timeout of the DHT lookup of the file hash
+	parallelLookupIRTime   = 4 * time.Second  // Timeout of a single information request of the lookup
+	parallelLookupAlpha    = 5                // Count of nodes contacted in parallel by the lookup
+	parallelProbeTimeout   = 10 * time.Second // Timeout to probe a peer
+	parallelStallTimeout   = 20 * time.Second // A segment is reassigned if no data is received for this time
+	parallelSlowGrace      = 10 * time.Second // Min time of a segment transfer before its speed is compared
+	parallelSlowFactor     = 4                // A source is slow if it is this factor slower than the fastest one
+	parallelFailuresMax    = 2                // A source is dropped after this count of failures
+	parallelMonitorTick    = 1 * time.Second  // Interval to check the running segments
+	parallelStateVersion   = 1                // Version of the state file
+	parallelSourceIDLength = 16               // Length of peer IDs in the output
+)
+
+// parallelOptions are the options of a parallel download.
+type parallelOptions struct {
+	Target   string   // Target file name
+	Peers    []string // Peer IDs or node IDs of sources
+	Sources  int      // Max count of sources used in parallel
+	Discover bool     // Probe connected peers as sources
+	Merkle   merkleOptions
+}
+
+// parseParallelOptions parses the options. Unknown options and invalid values return an error.
+func parseParallelOptions(args []string) (options parallelOptions, err error) {
+	options.Sources = parallelSourcesDefault
+	options.Discover = true
+
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			return options, fmt.Errorf("invalid option '%s'", arg)
+		}
+
+		name, value, _ := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		name = strings.ToLower(name)
+
+		switch name {
+		case "target":
+			options.Target = value
+
+		case "peer":
+			for _, peerID := range strings.Split(value, ",") {
+				if peerID = strings.TrimSpace(peerID); !validPeerID(peerID) {
+					return options, fmt.Errorf("invalid peer ID '%s'", peerID)
+				}
+				options.Peers = append(options.Peers, peerID)
+			}
+
+		case "sources":
+			if options.Sources, err = strconv.Atoi(value); err != nil || options.Sources < 1 || options.Sources > parallelSourcesMax {
+				return options, fmt.Errorf("invalid value for option '%s', use 1 to %d", name, parallelSourcesMax)
+			}
+
+		case "discover":
+			if options.Discover, err = strconv.ParseBool(value); err != nil {
+				return options, fmt.Errorf("invalid value for option '%s', use 1 or 0", name)
+			}
+
+		default:
+			if handled, err := parseMerkleOption(name, value, &options.Merkle); err != nil {
+				return options, err
+			} else if !handled {
+				return options, fmt.Errorf("unknown option '%s'", arg)
+			}
+		}
+	}
+
+	if len(options.Peers) == 0 && !options.Discover {
+		return options, errors.New("no sources, pass peers via --peer or enable discovery")
+	}
+
+	return options, nil
+}
+
+// parseParallelOptionsQuery parses the options from the query parameters of an API request.
+func parseParallelOptionsQuery(query url.Values) (options parallelOptions, err error) {
+	var args []string
+	for name, values := range query {
+		if name == "k" || name == "hash" { // API key and file hash
+			continue
+		}
+		for _, value := range values {
+			args = append(args, "--"+name+"="+value)
+		}
+	}
+
+	return parseParallelOptions(args)
+}
+
+// parallelState records the completed segments. It is stored as JSON in the state file.
+type parallelState struct {
+	Version     int    `json:"version"`     // Version of the state file
+	FileSize    uint64 `json:"filesize"`    // Size of the file
+	SegmentSize uint64 `json:"segmentsize"` // Size of a segment
+	Done        []bool `json:"done"`        // Completed segments
+}
+
+// downloadSource is a peer offering the file.
+type downloadSource struct {
+	peer     *core.PeerInfo
+	name     string        // Shortened peer ID for the output
+	failures int           // Count of failed segments
+	dropped  bool          // No more segments are assigned
+	bytes    uint64        // Bytes of completed segments
+	duration time.Duration // Time spent on completed segments
+}
+
+// segmentTransfer is a segment downloaded by a source.
+type segmentTransfer struct {
+	index     int
+	source    *downloadSource
+	transfer  *rangeTransfer // Nil until the header is received
+	started   time.Time
+	received  atomic.Uint64 // Bytes written
+	lastData  atomic.Int64  // Time of the last data in Unix nanoseconds
+	abandoned atomic.Bool   // Reassigned by the monitor. Remaining data is discarded.
+}
+
+// speed returns the bytes per second of the segment transfer.
+func (segment *segmentTransfer) speed() float64 {
+	return float64(segment.received.Load()) / time.Since(segment.started).Seconds()
+}
+
+// segmentWriter writes the data of a segment at its position in the partial file.
+type segmentWriter struct {
+	file    *os.File
+	offset  int64
+	segment *segmentTransfer
+}
+
+func (writer *segmentWriter) Write(data []byte) (n int, err error) {
+	if writer.segment.abandoned.Load() {
+		return 0, errors.New("segment reassigned")
+	}
+
+	n, err = writer.file.WriteAt(data, writer.offset)
+	writer.offset += int64(n)
+	writer.segment.received.Add(uint64(n))
+	writer.segment.lastData.Store(time.Now().UnixNano())
+	return n, err
+}
+
+// parallelDownload is a running parallel download.
+type parallelDownload struct {
+	fileHash  []byte
+	stateFile string
+	file      *os.File
+	output    io.Writer
+	state     parallelState
+	progress  *downloadProgress
+	verifier  *merkleVerifier // Nil if fragments are not verified
+
+	sync.Mutex                           // Protects the fields below
+	cond       *sync.Cond                // Signals changes of the queue and the running segments
+	queue      []int                     // Segments to download
+	active     map[*segmentTransfer]bool // Running segments
+	sources    []*downloadSource
+}
+
+// segmentRange returns the offset and size of the segment.
+func (download *parallelDownload) segmentRange(index int) (offset, size uint64) {
+	offset = uint64(index) * download.state.SegmentSize
+	size = download.state.SegmentSize
+	if offset+size > download.state.FileSize {
+		size = download.state.FileSize - offset
+	}
+	return offset, size
+}
+
+// doneBytes returns the bytes of completed segments and running segments. The caller must hold the lock.
+func (download *parallelDownload) doneBytes() (done uint64) {
+	for index, complete := range download.state.Done {
+		if complete {
+			_, size := download.segmentRange(index)
+			done += size
+		}
+	}
+	for segment := range download.active {
+		done += segment.received.Load()
+	}
+
+	// a reassigned segment may be downloaded twice
+	if done > download.state.FileSize {
+		done = download.state.FileSize
+	}
+	return done
+}
+
+// saveState writes the state file. The caller must hold the lock.
+func (download *parallelDownload) saveState() error {
+	data, err := json.Marshal(download.state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(download.stateFile, data, 0644)
+}
+
+// nextSegment assigns the next segment to the source. It waits while other segments are running, as they may be reassigned.
+// Nil is returned if the source is dropped or no segments are left.
+func (download *parallelDownload) nextSegment(source *downloadSource) (segment *segmentTransfer) {
+	download.Lock()
+	defer download.Unlock()
+
+	for {
+		if source.dropped {
+			return nil
+		} else if len(download.queue) > 0 {
+			segment = &segmentTransfer{index: download.queue[0], source: source, started: time.Now()}
+			segment.lastData.Store(segment.started.UnixNano())
+			download.queue = download.queue[1:]
+			download.active[segment] = true
+			return segment
+		} else if len(download.active) == 0 {
+			return nil
+		}
+
+		download.cond.Wait()
+	}
+}
+
+// requeue adds the segment to the front of the queue. The caller must hold the lock.
+func (download *parallelDownload) requeue(index int) {
+	download.queue = append([]int{index}, download.queue...)
+}
+
+// worker downloads segments from the source until no segments are left or the source is dropped.
+func (download *parallelDownload) worker(source *downloadSource, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		segment := download.nextSegment(source)
+		if segment == nil {
+			return
+		}
+
+		err := download.fetchSegment(segment)
+
+		download.Lock()
+		delete(download.active, segment)
+
+		switch {
+		case err == nil:
+			// The data is complete even if the monitor reassigned the segment in the meantime.
+			download.state.Done[segment.index] = true
+			for n, index := range download.queue {
+				if index == segment.index {
+					download.queue = append(download.queue[:n], download.queue[n+1:]...)
+					break
+				}
+			}
+			source.bytes += segment.received.Load()
+			source.duration += time.Since(segment.started)
+			if errSave := download.saveState(); errSave != nil {
+				fmt.Fprintf(download.output, "Error writing state file: %s\n", errSave.Error())
+			}
+
+		case segment.abandoned.Load():
+			// already reassigned by the monitor
+
+		default:
+			download.requeue(segment.index)
+			source.failures++
+
+			// a source sending invalid data is not used again
+			var errFragment *fragmentError
+			if errors.As(err, &errFragment) {
+				source.failures = parallelFailuresMax
+			}
+
+			if source.failures >= parallelFailuresMax {
+				source.dropped = true
+				fmt.Fprintf(download.output, "Source %s dropped after %d failures. Segment %d reassigned: %s\n", source.name, source.failures, segment.index, err.Error())
+			} else {
+				fmt.Fprintf(download.output, "Source %s failed segment %d, reassigned: %s\n", source.name, segment.index, err.Error())
+			}
+		}
+
+		download.cond.Broadcast()
+		download.Unlock()
+	}
+}
+
+// fetchSegment downloads the segment from its source into the partial file.
+func (download *parallelDownload) fetchSegment(segment *segmentTransfer) (err error) {
+	offset, size := download.segmentRange(segment.index)
+
+	transfer, err := openRange(segment.source.peer, download.fileHash, offset, size)
+	if err != nil {
+		return err
+	}
+
+	download.Lock()
+	segment.transfer = transfer
+	abandoned := segment.abandoned.Load()
+	download.Unlock()
+
+	if abandoned {
+		transfer.Terminate()
+		return errors.New("segment reassigned")
+	} else if transfer.FileSize != download.state.FileSize || transfer.TransferSize != size {
+		transfer.Terminate()
+		return fmt.Errorf("remote peer offering %d bytes of file size %d, expected %d bytes of file size %d", transfer.TransferSize, transfer.FileSize, size, download.state.FileSize)
+	}
+
+	var writer io.Writer = &segmentWriter{file: download.file, offset: int64(offset), segment: segment}
+	if download.verifier != nil {
+		writer = download.verifier.newWriter(writer, offset)
+	}
+
+	_, err = transfer.copyTo(writer)
+	if err != nil {
+		err = fmt.Errorf("%w. %s", err, transfer.terminateReasonToA())
+	}
+	transfer.Close()
+
+	return err
+}
+
+// abandon reassigns the running segment and drops its source. The last usable source is not dropped, it retries the segment instead.
+// The caller must hold the lock.
+func (download *parallelDownload) abandon(segment *segmentTransfer, reason string) {
+	segment.abandoned.Store(true)
+	delete(download.active, segment)
+	download.requeue(segment.index)
+
+	if segment.transfer != nil {
+		segment.transfer.Terminate()
+	}
+
+	if download.usableSources() > 1 {
+		segment.source.dropped = true
+		fmt.Fprintf(download.output, "Source %s dropped, %s. Segment %d reassigned.\n", segment.source.name, reason, segment.index)
+	} else {
+		fmt.Fprintf(download.output, "Source %s: %s. It is the last source, segment %d is retried.\n", segment.source.name, reason, segment.index)
+	}
+	download.cond.Broadcast()
+}
+
+// usableSources returns the count of sources that are not dropped. The caller must hold the lock.
+func (download *parallelDownload) usableSources() (count int) {
+	for _, source := range download.sources {
+		if !source.dropped {
+			count++
+		}
+	}
+	return count
+}
+
+// bestSpeed returns the speed in bytes per second of the fastest source, measured by completed and running segments. The caller must hold the lock.
+func (download *parallelDownload) bestSpeed() (best float64) {
+	for _, source := range download.sources {
+		if source.duration > 0 {
+			if speed := float64(source.bytes) / source.duration.Seconds(); speed > best {
+				best = speed
+			}
+		}
+	}
+	for segment := range download.active {
+		if time.Since(segment.started) >= parallelSlowGrace {
+			if speed := segment.speed(); speed > best {
+				best = speed
+			}
+		}
+	}
+	return best
+}
+
+// monitor reassigns stalled and slow segments and reports the progress until the stop signal.
+func (download *parallelDownload) monitor(stop <-chan struct{}) {
+	ticker := time.NewTicker(parallelMonitorTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		download.Lock()
+
+		best := download.bestSpeed()
+		for segment := range download.active {
+			if idle := time.Since(time.Unix(0, segment.lastData.Load())); idle >= parallelStallTimeout {
+				download.abandon(segment, fmt.Sprintf("no data received for %s", idle.Round(time.Second).String()))
+			} else if time.Since(segment.started) >= parallelSlowGrace && download.usableSources() > 1 && segment.speed()*parallelSlowFactor < best {
+				download.abandon(segment, fmt.Sprintf("too slow with %.2f KB/s", segment.speed()/1024))
+			}
+		}
+
+		download.progress.done = download.doneBytes()
+		download.progress.report()
+
+		download.Unlock()
+	}
+}
+
+// probeResult is the answer of a peer to the probe.
+type probeResult struct {
+	peer     *core.PeerInfo
+	fileSize uint64
+	err      error
+}
+
+// probeSource requests the file to check if the peer offers it and terminates the transfer after the header.
+// No limit is set, since the remote peer rejects a limit exceeding the file size, which would fail for empty files.
+func probeSource(peer *core.PeerInfo, fileHash []byte) (fileSize uint64, err error) {
+	transfer, err := openRange(peer, fileHash, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	transfer.Terminate()
+
+	return transfer.FileSize, nil
+}
+
+// fileLookup collects the peers reported to store the hash during a DHT lookup.
+type fileLookup struct {
+	hash    []byte
+	storing []*btcec.PublicKey
+	known   map[string]bool // Peer IDs in storing
+}
+
+// fileLookups are the running lookups. Responses are passed via filterMessageIn.
+var fileLookups = make(map[*fileLookup]bool)
+var fileLookupsMutex sync.Mutex
+
+// fileLookupResponse records the peers storing a hash of a running lookup. It is called for each incoming response.
+func fileLookupResponse(response *protocol.MessageResponse) {
+	fileLookupsMutex.Lock()
+	defer fileLookupsMutex.Unlock()
+
+	for lookup := range fileLookups {
+		for _, hash2Peer := range response.Hash2Peers {
+			if !bytes.Equal(hash2Peer.ID.Hash, lookup.hash) {
+				continue
+			}
+			for _, record := range hash2Peer.Storing {
+				if record.PublicKey == nil {
+					continue
+				}
+				if peerID := string(record.PublicKey.SerializeCompressed()); !lookup.known[peerID] {
+					lookup.known[peerID] = true
+					lookup.storing = append(lookup.storing, record.PublicKey)
+				}
+			}
+		}
+	}
+}
+
+// lookupFileStoring searches the DHT for the hash and returns the peers reported to store it. Blocking until the lookup ends.
+func lookupFileStoring(backend *core.Backend, fileHash []byte) (storing []*btcec.PublicKey) {
+	lookup := &fileLookup{hash: fileHash, known: make(map[string]bool)}
+
+	fileLookupsMutex.Lock()
+	fileLookups[lookup] = true
+	fileLookupsMutex.Unlock()
+
+	search := backend.AsyncSearch(dht.ActionFindValue, fileHash, parallelLookupTimeout, parallelLookupIRTime, parallelLookupAlpha)
+	search.SearchAway()
+	<-search.TerminateSignal
+
+	fileLookupsMutex.Lock()
+	delete(fileLookups, lookup)
+	fileLookupsMutex.Unlock()
+
+	return lookup.storing
+}
+
+// discoverCandidates looks up the file hash in the DHT. It returns the peers reported to store the file, followed by the connected peers
+// with the node ID closest to the file hash. Those include the nodes contacted by the lookup.
+func discoverCandidates(backend *core.Backend, fileHash []byte, count int, output io.Writer) (peers []*core.PeerInfo) {
+	storing := lookupFileStoring(backend, fileHash)
+	if len(storing) > count {
+		storing = storing[:count]
+	}
+
+	// Peers storing the file may not be connected yet.
+	connected := make([]*core.PeerInfo, len(storing))
+	var wg sync.WaitGroup
+	for n, publicKey := range storing {
+		wg.Add(1)
+		go func(n int, publicKey *btcec.PublicKey) {
+			defer wg.Done()
+			connected[n], _ = webapi.PeerConnectPublicKey(backend, publicKey, timeoutConnectPeer)
+		}(n, publicKey)
+	}
+	wg.Wait()
+
+	known := make(map[*core.PeerInfo]bool)
+	for _, peer := range connected {
+		if peer != nil && !known[peer] {
+			peers = append(peers, peer)
+			known[peer] = true
+		}
+	}
+
+	fmt.Fprintf(output, "DHT lookup: %d peers reported to store the file, %d connected.\n", len(storing), len(peers))
+
+	closest := backend.PeerlistGet()
+	sort.Slice(closest, func(i, j int) bool {
+		return bytes.Compare(xorDistance(fileHash, closest[i].NodeID), xorDistance(fileHash, closest[j].NodeID)) < 0
+	})
+
+	for _, peer := range closest {
+		if len(peers) >= count {
+			break
+		} else if !known[peer] {
+			peers = append(peers, peer)
+			known[peer] = true
+		}
+	}
+
+	return peers
+}
+
+// findSources probes the candidates in parallel and returns up to max sources offering the file, in the order of the candidates.
+// The file size is the one reported by most sources. Peers reporting a different size are not used.
+func findSources(candidates []*core.PeerInfo, fileHash []byte, max int, output io.Writer) (sources []*downloadSource, fileSize uint64, err error) {
+	results := make(chan probeResult, len(candidates))
+	for _, peer := range candidates {
+		go func(peer *core.PeerInfo) {
+			fileSize, err := probeSource(peer, fileHash)
+			results <- probeResult{peer: peer, fileSize: fileSize, err: err}
+		}(peer)
+	}
+
+	// Probes that time out keep running in the background until the transfer times out. Their results are ignored.
+	offering := make(map[*core.PeerInfo]uint64)
+	sizeCount := make(map[uint64]int)
+	timeout := time.After(parallelProbeTimeout)
+
+collect:
+	for n := 0; n < len(candidates); n++ {
+		select {
+		case result := <-results:
+			if result.err == nil {
+				offering[result.peer] = result.fileSize
+				sizeCount[result.fileSize]++
+			}
+		case <-timeout:
+			break collect
+		}
+	}
+
+	if len(offering) == 0 {
+		return nil, 0, fmt.Errorf("none of the %d probed peers offers the file", len(candidates))
+	}
+
+	best := 0
+	for size, count := range sizeCount {
+		if count > best || (count == best && size < fileSize) {
+			fileSize, best = size, count
+		}
+	}
+
+	for _, peer := range candidates {
+		if size, ok := offering[peer]; !ok || size != fileSize || len(sources) >= max {
+			continue
+		}
+		name := shortenText(hex.EncodeToString(peer.PublicKey.SerializeCompressed()), parallelSourceIDLength)
+		sources = append(sources, &downloadSource{peer: peer, name: name})
+	}
+
+	fmt.Fprintf(output, "Probed %d peers, %d offer the file with %d bytes. Using %d sources.\n", len(candidates), len(offering), fileSize, len(sources))
+
+	return sources, fileSize, nil
+}
+
+// loadParallelState returns the state of a previous download of the partial file. A partial file of a regular download is resumed from its size.
+func loadParallelState(stateFile, partFile string, fileSize, segmentSize uint64) (state parallelState) {
+	segments := int((fileSize + segmentSize - 1) / segmentSize)
+	state = parallelState{Version: parallelStateVersion, FileSize: fileSize, SegmentSize: segmentSize, Done: make([]bool, segments)}
+
+	if data, err := os.ReadFile(stateFile); err == nil {
+		var previous parallelState
+		if json.Unmarshal(data, &previous) == nil && previous.Version == state.Version && previous.FileSize == state.FileSize && previous.SegmentSize == state.SegmentSize && len(previous.Done) == segments {
+			return previous
+		}
+		return state
+	}
+
+	// The partial file of a regular download contains the data from the start.
+	if stat, err := os.Stat(partFile); err == nil && uint64(stat.Size()) <= fileSize {
+		for index := range state.Done {
+			end := uint64(index+1) * segmentSize
+			if end > fileSize {
+				end = fileSize
+			}
+			state.Done[index] = end <= uint64(stat.Size())
+		}
+	}
+
+	return state
+}
+
+// downloadParallel downloads the file from multiple sources to the target file and verifies the hash. The progress is written to the output.
+func downloadParallel(backend *core.Backend, fileHash []byte, target string, options parallelOptions, output io.Writer) (err error) {
+	// A running regular download of the target is refused too, its partial file is still growing.
+	if err := lockDownloadTarget(target); err != nil {
+		return err
+	}
+	defer unlockDownloadTarget(target)
+
+	// an existing target is only accepted if it is the same file
+	if _, err := os.Stat(target); err == nil {
+		if hash, err := hashFile(target); err != nil {
+			return err
+		} else if !bytes.Equal(hash, fileHash) {
+			return fmt.Errorf("target file '%s' already exists with a different hash", target)
+		}
+
+		fmt.Fprintf(output, "File already downloaded: %s\n", target)
+		return nil
+	}
+
+	// candidates are the passed peers followed by the discovered ones
+	var candidates []*core.PeerInfo
+	known := make(map[*core.PeerInfo]bool)
+
+	for _, peerID := range options.Peers {
+		peer, err := connectPeer(backend, peerID, timeoutConnectPeer)
+		if err != nil {
+			fmt.Fprintf(output, "Could not connect to peer %s: %s\n", peerID, err.Error())
+			continue
+		} else if !known[peer] {
+			candidates = append(candidates, peer)
+			known[peer] = true
+		}
+	}
+
+	if options.Discover {
+		for _, peer := range discoverCandidates(backend, fileHash, parallelDiscoverMax, output) {
+			if !known[peer] {
+				candidates = append(candidates, peer)
+				known[peer] = true
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return errors.New("no peers to probe")
+	}
+
+	sources, fileSize, err := findSources(candidates, fileHash, options.Sources, output)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	partFile := target + downloadPartExtension
+	download := &parallelDownload{fileHash: fileHash, stateFile: target + parallelStateExtension, output: output, sources: sources, active: make(map[*segmentTransfer]bool)}
+	download.cond = sync.NewCond(&download.Mutex)
+
+	// With merkle verification segments consist of whole fragments
+	segmentSize := uint64(parallelSegmentSize)
+	if options.Merkle.Enabled {
+		var peers []*core.PeerInfo
+		for _, source := range sources {
+			peers = append(peers, source.peer)
+		}
+		if download.verifier, err = loadMerkleVerifier(backend, fileHash, fileSize, options.Merkle, peers, output); err != nil {
+			return err
+		}
+		segmentSize = (segmentSize + download.verifier.fragmentSize - 1) / download.verifier.fragmentSize * download.verifier.fragmentSize
+	}
+
+	download.state = loadParallelState(download.stateFile, partFile, fileSize, segmentSize)
+
+	if download.file, err = os.OpenFile(partFile, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return err
+	} else if err = download.file.Truncate(int64(fileSize)); err != nil {
+		download.file.Close()
+		return err
+	} else if err = download.saveState(); err != nil {
+		download.file.Close()
+		return err
+	}
+
+	for index, complete := range download.state.Done {
+		// completed segments are verified again, they may be from a download without verification
+		if complete && download.verifier != nil {
+			offset, size := download.segmentRange(index)
+			if complete, err = download.verifier.verifyRange(download.file, offset, size); err != nil {
+				download.file.Close()
+				return err
+			}
+			download.state.Done[index] = complete
+		}
+		if !complete {
+			download.queue = append(download.queue, index)
+		}
+	}
+
+	resumed := download.doneBytes()
+	if resumed > 0 {
+		fmt.Fprintf(output, "Resuming parallel download of %s, %d of %d segments missing\n", hex.EncodeToString(fileHash), len(download.queue), len(download.state.Done))
+	} else {
+		fmt.Fprintf(output, "Downloading %s with %d bytes in %d segments to %s\n", hex.EncodeToString(fileHash), fileSize, len(download.state.Done), target)
+	}
+	download.progress = newDownloadProgress(output, fileSize, resumed)
+
+	// one worker per source, the monitor reassigns stalled and slow segments
+	stop := make(chan struct{})
+	go download.monitor(stop)
+
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		wg.Add(1)
+		go download.worker(source, &wg)
+	}
+	wg.Wait()
+	close(stop)
+
+	download.Lock()
+	download.progress.done = download.doneBytes()
+	missing := len(download.queue)
+	download.Unlock()
+
+	if errClose := download.file.Close(); errClose != nil {
+		return errClose
+	} else if missing > 0 {
+		return fmt.Errorf("all sources failed, %d of %d segments missing. Run the download again to resume", missing, len(download.state.Done))
+	}
+
+	download.progress.finish()
+
+	err = verifyDownload(fileHash, partFile, target, output)
+
+	// The partial file is renamed if complete or deleted on a hash mismatch. The state is no longer needed in both cases.
+	if _, errStat := os.Stat(partFile); errStat != nil {
+		os.Remove(download.stateFile)
+	}
+	return err
+}
+
+// commandDownloadParallel downloads a file from multiple peers in the background.
+func commandDownloadParallel(ctx *commandContext) (terminate bool) {
+	fileHash, valid := ctx.ArgHash(0)
+	if !valid {
+		fmt.Fprintf(ctx.Output, "Invalid file hash.\n")
+		return false
+	}
+
+	options, err := parseParallelOptions(ctx.RestArgs())
+	if err != nil {
+		fmt.Fprintf(ctx.Output, "Error: %s\n", err.Error())
+		return false
+	}
+
+	target, err := downloadTargetPath(options.Target, fileHash)
+	if err != nil {
+		fmt.Fprintf(ctx.Output, "Invalid target: %s\n", err.Error())
+		return false
+	}
+
+	ctx.runTask(func() {
+		if err := downloadParallel(ctx.Backend, fileHash, target, options, ctx.Output); err != nil {
+			fmt.Fprintf(ctx.Output, "Download failed: %s\n", err.Error())
+		}
+	})
+
+	return false
+}
+
+func init() {
+	registerCommand(&consoleCommand{Name: "download parallel", Args: []commandArg{{Name: "file hash", Prompt: "Enter file hash:"}}, Help: "Downloads a file from multiple peers in parallel. Options --target=, --peer=, --sources=, --discover=0", Role: roleOperator, Options: true, Handler: commandDownloadParallel})
+}
@@ -0,0 +1,453 @@
+/*
+File Name:  File Download.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Downloads files from remote peers to disk. The data is written to a partial file "[target].part" first. If the partial file exists
+from a previous attempt, the download resumes at its size using the offset of the file transfer request.
+When complete, the blake3 hash of the file is verified and the partial file is renamed to the target. Partial files with a hash mismatch are deleted.
+With the options --merkle, --merkle-root and --publisher, each fragment is verified while receiving, see Merkle Verification.go.
+
+Targets are relative to the download folder set by DownloadFolder (default "downloads") and must not leave it.
+A target can only be downloaded by one download at a time, since all of them write into the same partial file.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/PeernetOfficial/core/protocol"
+	"github.com/PeernetOfficial/core/udt"
+	"lukechampine.com/blake3"
+)
+
+// Settings of the download.
+const (
+	downloadFolderDefault    = "downloads"     // Default download folder
+	downloadPartExtension    = ".part"         // Extension of partial files
+	downloadBufferSize       = 64 * 1024       // Size of the read buffer
+	downloadProgressInterval = 2 * time.Second // Interval to report the progress
+)
+
+// downloadFolder returns the download folder.
+func downloadFolder() string {
+	if config.DownloadFolder != "" {
+		return config.DownloadFolder
+	}
+	return downloadFolderDefault
+}
+
+// downloadTargetPath returns the target file in the download folder. If the name is empty, the hex encoded hash is used.
+func downloadTargetPath(name string, fileHash []byte) (target string, err error) {
+	if name = strings.TrimSpace(name); name == "" {
+		name = hex.EncodeToString(fileHash)
+	}
+
+	return safeFolderPath(downloadFolder(), name)
+}
+
+// safeFolderPath returns the file in the folder. Subfolders are allowed, but absolute paths and paths leaving the folder are rejected.
+func safeFolderPath(folder, name string) (path string, err error) {
+	name = filepath.Clean(filepath.FromSlash(strings.TrimSpace(name)))
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) || name == "." {
+		return "", fmt.Errorf("target must be a file name in the folder '%s'", folder)
+	}
+
+	return filepath.Join(folder, name), nil
+}
+
+// activeDownloads are the targets of running downloads, keyed by the absolute path.
+var activeDownloads = make(map[string]bool)
+var activeDownloadsMutex sync.Mutex
+
+// downloadTargetKey returns the key of the target in activeDownloads.
+func downloadTargetKey(target string) string {
+	if path, err := filepath.Abs(target); err == nil {
+		return path
+	}
+	return filepath.Clean(target)
+}
+
+// lockDownloadTarget marks the target as being downloaded. It fails if another download of the target is running.
+func lockDownloadTarget(target string) (err error) {
+	key := downloadTargetKey(target)
+
+	activeDownloadsMutex.Lock()
+	defer activeDownloadsMutex.Unlock()
+
+	if activeDownloads[key] {
+		return fmt.Errorf("another download of '%s' is already running", target)
+	}
+	activeDownloads[key] = true
+	return nil
+}
+
+// unlockDownloadTarget removes the mark set by lockDownloadTarget.
+func unlockDownloadTarget(target string) {
+	activeDownloadsMutex.Lock()
+	delete(activeDownloads, downloadTargetKey(target))
+	activeDownloadsMutex.Unlock()
+}
+
+// hashFile returns the blake3 hash of the file.
+func hashFile(filename string) (hash []byte, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hasher := blake3.New(protocol.HashSize, nil)
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, err
+	}
+
+	return hasher.Sum(nil), nil
+}
+
+// downloadProgress reports the progress of a download at regular intervals.
+type downloadProgress struct {
+	output     io.Writer
+	total      uint64    // Total size of the file
+	done       uint64    // Bytes available, including the resumed part
+	started    time.Time // Start of the transfer
+	resumed    uint64    // Bytes available at the start
+	lastUpdate time.Time // Last report
+	lastDone   uint64    // Bytes available at the last report
+}
+
+func newDownloadProgress(output io.Writer, total, resumed uint64) *downloadProgress {
+	now := time.Now()
+	return &downloadProgress{output: output, total: total, done: resumed, resumed: resumed, started: now, lastUpdate: now, lastDone: resumed}
+}
+
+// add records received data and prints the progress if the interval passed.
+func (progress *downloadProgress) add(n uint64) {
+	progress.done += n
+	progress.report()
+}
+
+// report prints the progress if the interval passed.
+func (progress *downloadProgress) report() {
+	if time.Since(progress.lastUpdate) < downloadProgressInterval {
+		return
+	}
+
+	var speed float64
+	if progress.done > progress.lastDone { // the parallel download may reassign data
+		speed = float64(progress.done-progress.lastDone) / time.Since(progress.lastUpdate).Seconds()
+	}
+	fmt.Fprintf(progress.output, "Progress %.2f %%   %d of %d bytes   Speed: %.2f KB/s   ETA: %s\n", progress.percent(), progress.done, progress.total, speed/1024, progress.eta(speed))
+
+	progress.lastUpdate = time.Now()
+	progress.lastDone = progress.done
+}
+
+func (progress *downloadProgress) percent() float64 {
+	if progress.total == 0 {
+		return 100
+	}
+	return float64(progress.done) * 100 / float64(progress.total)
+}
+
+func (progress *downloadProgress) eta(speed float64) string {
+	if progress.done >= progress.total {
+		return etaToA(0, true)
+	} else if speed <= 0 {
+		return etaToA(0, false)
+	}
+	return etaToA(time.Duration(float64(progress.total-progress.done)/speed*float64(time.Second)), true)
+}
+
+// finish prints the summary of the transfer.
+func (progress *downloadProgress) finish() {
+	duration := time.Since(progress.started)
+	speed := float64(progress.done-progress.resumed) / duration.Seconds()
+	fmt.Fprintf(progress.output, "Transferred %d bytes in %s. Average speed is %.2f KB/s\n", progress.done-progress.resumed, duration.Round(time.Millisecond).String(), speed/1024)
+}
+
+// rangeTransfer is an incoming transfer of a range of a file.
+type rangeTransfer struct {
+	udtConn      *udt.UDTSocket
+	virtualConn  *core.VirtualPacketConn
+	FileSize     uint64 // Size of the entire file as reported by the remote peer
+	TransferSize uint64 // Size of the data that follows
+}
+
+// openRange requests the range of the file from the peer and reads the header. Limit 0 requests the rest of the file.
+func openRange(peer *core.PeerInfo, fileHash []byte, offset, limit uint64) (transfer *rangeTransfer, err error) {
+	if !peer.IsConnectionActive() {
+		return nil, errors.New("peer has no active connection")
+	}
+
+	udtConn, virtualConn, err := peer.FileTransferRequestUDT(fileHash, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("opening UDT connection: %w", err)
+	}
+
+	fileSize, transferSize, err := protocol.FileTransferReadHeader(udtConn)
+	if err != nil {
+		udtConn.Close()
+		if reason := virtualConn.GetTerminateReason(); reason > 0 {
+			return nil, fmt.Errorf("reading file transfer header: %w. Terminate reason %d: %s", err, reason, translateTerminateReason(reason))
+		}
+		return nil, fmt.Errorf("reading file transfer header: %w", err)
+	}
+	virtualConn.Stats.(*core.FileTransferStats).FileSize = fileSize
+
+	return &rangeTransfer{udtConn: udtConn, virtualConn: virtualConn, FileSize: fileSize, TransferSize: transferSize}, nil
+}
+
+// copyTo writes the data of the transfer to the writer and returns the count of bytes written.
+func (transfer *rangeTransfer) copyTo(writer io.Writer) (written uint64, err error) {
+	buffer := make([]byte, downloadBufferSize)
+	for written < transfer.TransferSize {
+		readSize := uint64(len(buffer))
+		if remaining := transfer.TransferSize - written; remaining < readSize {
+			readSize = remaining
+		}
+
+		n, err := transfer.udtConn.Read(buffer[:readSize])
+		if n > 0 {
+			if _, errWrite := writer.Write(buffer[:n]); errWrite != nil {
+				return written, errWrite
+			}
+			written += uint64(n)
+		} else if err == nil {
+			err = errors.New("empty read")
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// Close closes the connection after the data was read.
+func (transfer *rangeTransfer) Close() {
+	transfer.udtConn.Close()
+}
+
+// Terminate aborts the transfer immediately. A pending read fails.
+func (transfer *rangeTransfer) Terminate() {
+	transfer.udtConn.Terminate()
+}
+
+// terminateReasonToA returns the terminate reason of the connection as text.
+func (transfer *rangeTransfer) terminateReasonToA() string {
+	reason := transfer.virtualConn.GetTerminateReason()
+	return fmt.Sprintf("Terminate reason %d: %s", reason, translateTerminateReason(reason))
+}
+
+// progressWriter writes to the file and records the progress.
+type progressWriter struct {
+	file     io.Writer
+	progress *downloadProgress
+}
+
+func (writer *progressWriter) Write(data []byte) (n int, err error) {
+	n, err = writer.file.Write(data)
+	writer.progress.add(uint64(n))
+	return n, err
+}
+
+// downloadFile downloads the file from the peer to the target file and verifies the hash. An existing partial file is resumed.
+// If merkle verification is enabled, each fragment is verified when received and the download stops at the first invalid fragment.
+// The progress is written to the output.
+func downloadFile(peer *core.PeerInfo, fileHash []byte, target string, merkleOptions merkleOptions, output io.Writer) (err error) {
+	if err := lockDownloadTarget(target); err != nil {
+		return err
+	}
+	defer unlockDownloadTarget(target)
+
+	// an existing target is only accepted if it is the same file
+	if _, err := os.Stat(target); err == nil {
+		if hash, err := hashFile(target); err != nil {
+			return err
+		} else if !bytes.Equal(hash, fileHash) {
+			return fmt.Errorf("target file '%s' already exists with a different hash", target)
+		}
+
+		fmt.Fprintf(output, "File already downloaded: %s\n", target)
+		return nil
+	}
+
+	// The partial file of a parallel download has the full size and cannot be resumed at its end.
+	if _, err := os.Stat(target + parallelStateExtension); err == nil {
+		return errors.New("the partial file belongs to a parallel download, use download parallel to resume it")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	partFile := target + downloadPartExtension
+	file, err := os.OpenFile(partFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	offset := uint64(stat.Size())
+
+	// request the remaining data
+	transfer, err := openRange(peer, fileHash, offset, 0)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	fileSize := transfer.FileSize
+
+	// With merkle verification the download resumes after the last valid fragment of the partial file.
+	// The transfer is restarted since looking up the file record may take longer than the transfer stays idle.
+	var verifier *merkleVerifier
+	if merkleOptions.Enabled {
+		transfer.Terminate()
+
+		var validSize uint64
+		if verifier, err = loadMerkleVerifier(peer.Backend, fileHash, fileSize, merkleOptions, []*core.PeerInfo{peer}, output); err == nil {
+			validSize, err = verifier.verifyPartial(file, offset)
+		}
+		if err == nil && validSize != offset {
+			fmt.Fprintf(output, "Partial file verified up to %d of %d bytes, resuming from there\n", validSize, offset)
+			offset = validSize
+			err = file.Truncate(int64(offset))
+		}
+		if err == nil {
+			transfer, err = openRange(peer, fileHash, offset, 0)
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if offset > 0 {
+		fmt.Fprintf(output, "Resuming download of %s at offset %d of %d bytes\n", hex.EncodeToString(fileHash), offset, fileSize)
+	} else {
+		fmt.Fprintf(output, "Downloading %s with %d bytes to %s\n", hex.EncodeToString(fileHash), fileSize, target)
+	}
+
+	if offset+transfer.TransferSize != fileSize {
+		transfer.Close()
+		file.Close()
+		return fmt.Errorf("remote peer only offering %d bytes at offset %d of total file size %d", transfer.TransferSize, offset, fileSize)
+	}
+
+	// write the data at the end of the partial file
+	progress := newDownloadProgress(output, fileSize, offset)
+	var writer io.Writer = &progressWriter{file: file, progress: progress}
+	if verifier != nil {
+		writer = verifier.newWriter(writer, offset)
+	}
+
+	if _, err = file.Seek(int64(offset), io.SeekStart); err == nil {
+		_, err = transfer.copyTo(writer)
+	}
+
+	// An invalid fragment is removed from the partial file and the download stops.
+	var errFragment *fragmentError
+	if errors.As(err, &errFragment) {
+		transfer.Terminate()
+		if errTruncate := file.Truncate(int64(errFragment.Offset)); errTruncate != nil {
+			err = errTruncate
+		}
+		file.Close()
+		return fmt.Errorf("%w. The download was stopped, the partial file keeps %d verified bytes", err, errFragment.Offset)
+	}
+
+	transfer.Close()
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		return fmt.Errorf("transfer interrupted after %d of %d bytes, run the download again to resume: %w. %s", progress.done, fileSize, err, transfer.terminateReasonToA())
+	}
+
+	progress.finish()
+
+	return verifyDownload(fileHash, partFile, target, output)
+}
+
+// verifyDownload verifies the hash of the partial file and renames it to the target. On a mismatch the partial file is deleted.
+func verifyDownload(fileHash []byte, partFile, target string, output io.Writer) (err error) {
+	hash, err := hashFile(partFile)
+	if err != nil {
+		return err
+	} else if !bytes.Equal(hash, fileHash) {
+		os.Remove(partFile)
+		return fmt.Errorf("hash mismatch, the downloaded file has hash %s. The partial file was deleted", hex.EncodeToString(hash))
+	}
+
+	if err := os.Rename(partFile, target); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(output, "Download complete. Hash verified. File: %s\n", target)
+	return nil
+}
+
+// commandDownload downloads a file from a peer in the background.
+func commandDownload(ctx *commandContext) (terminate bool) {
+	fileHash, valid := ctx.ArgHash(1)
+	if !validPeerID(ctx.Arg(0)) {
+		fmt.Fprintf(ctx.Output, "Invalid peer ID or node ID.\n")
+		return false
+	} else if !valid {
+		fmt.Fprintf(ctx.Output, "Invalid file hash.\n")
+		return false
+	}
+
+	// The target is optional, options may follow directly after the hash.
+	targetName, args := ctx.Arg(2), ctx.RestArgs()
+	if strings.HasPrefix(targetName, "--") {
+		targetName, args = "", append([]string{targetName}, args...)
+	}
+
+	merkleOptions, err := parseDownloadOptions(args)
+	if err != nil {
+		fmt.Fprintf(ctx.Output, "Error: %s\n", err.Error())
+		return false
+	}
+
+	target, err := downloadTargetPath(targetName, fileHash)
+	if err != nil {
+		fmt.Fprintf(ctx.Output, "Invalid target: %s\n", err.Error())
+		return false
+	}
+
+	peer, err := connectPeer(ctx.Backend, ctx.Arg(0), timeoutConnectPeer)
+	if err != nil {
+		fmt.Fprintf(ctx.Output, "Could not connect to peer: %s\n", err.Error())
+		return false
+	}
+
+	ctx.runTask(func() {
+		if err := downloadFile(peer, fileHash, target, merkleOptions, ctx.Output); err != nil {
+			fmt.Fprintf(ctx.Output, "Download failed: %s\n", err.Error())
+		}
+	})
+
+	return false
+}
+
+func init() {
+	registerCommand(&consoleCommand{Name: "download", Args: []commandArg{{Name: "peer ID", Complete: completePeerIDs, Prompt: "Enter peer ID or node ID:"}, {Name: "file hash", Prompt: "Enter file hash:"}, {Name: "target", Optional: true}}, Help: "Downloads a file from a peer to the download folder. Resumes partial downloads. Target is optional. Options --merkle[=file], --merkle-root=, --publisher= verify each fragment", Role: roleOperator, Options: true, Handler: commandDownload})
+}
@@ -0,0 +1,501 @@
+/*
+File Name:  File Transfer Benchmark.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Benchmark mode of "probe file transfer" for regression testing of UDT. It is used if any of the options is passed:
+
+--runs=[n]                      Count of measured runs, default 1.
+--concurrency=[n]               Count of simultaneous transfers per run, default 1.
+--warmup=[n]                    Count of runs before the measured ones that are excluded from the statistics, default 0.
+--limit=[bytes]                 Transfer only the first bytes of the file. Default is the entire file.
+--report=[name]                 Name of the report files in the report folder. Default is probe_[date]_[time].
+
+Each transfer records the handshake latency (until the UDT connection is established), the header latency, the throughput,
+the UDT packet counts shown by outputUDTMetrics and the terminate reason. Transfers of the entire file are verified by the hash.
+The report is written as CSV (one line per transfer) and as JSON (summary and transfers) to the folder set by ReportFolder (default "reports").
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/PeernetOfficial/core/protocol"
+	"lukechampine.com/blake3"
+)
+
+// Settings of the benchmark.
+const (
+	reportFolderDefault     = "reports" // Default folder of the benchmark reports
+	benchmarkRunsMax        = 1000      // Max count of runs
+	benchmarkConcurrencyMax = 32        // Max count of simultaneous transfers
+	benchmarkWarmupMax      = 100       // Max count of warm-up runs
+)
+
+// reportFolder returns the folder of the benchmark reports.
+func reportFolder() string {
+	if config.ReportFolder != "" {
+		return config.ReportFolder
+	}
+	return reportFolderDefault
+}
+
+// benchmarkOptions are the options of the benchmark mode.
+type benchmarkOptions struct {
+	Enabled     bool   // Benchmark mode instead of the comparison with the local file
+	Runs        int    // Count of measured runs
+	Concurrency int    // Simultaneous transfers per run
+	Warmup      int    // Runs excluded from the statistics
+	Limit       uint64 // Bytes to transfer. 0 for the entire file.
+	Report      string // Name of the report files
+}
+
+// parseBenchmarkOptions parses the options. Unknown options and invalid values return an error.
+func parseBenchmarkOptions(args []string) (options benchmarkOptions, err error) {
+	options.Runs = 1
+	options.Concurrency = 1
+
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			return options, fmt.Errorf("invalid option '%s'", arg)
+		}
+
+		name, value, _ := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		name = strings.ToLower(name)
+		options.Enabled = true
+
+		switch name {
+		case "runs", "concurrency", "warmup":
+			number, err := strconv.Atoi(value)
+			switch {
+			case name == "runs" && err == nil && number >= 1 && number <= benchmarkRunsMax:
+				options.Runs = number
+			case name == "concurrency" && err == nil && number >= 1 && number <= benchmarkConcurrencyMax:
+				options.Concurrency = number
+			case name == "warmup" && err == nil && number >= 0 && number <= benchmarkWarmupMax:
+				options.Warmup = number
+			default:
+				return options, fmt.Errorf("invalid value for option '%s'", name)
+			}
+
+		case "limit":
+			if options.Limit, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return options, fmt.Errorf("invalid value for option '%s'", name)
+			}
+
+		case "report":
+			options.Report = strings.TrimSuffix(strings.TrimSuffix(value, ".csv"), ".json")
+
+		default:
+			return options, fmt.Errorf("unknown option '%s'", arg)
+		}
+	}
+
+	return options, nil
+}
+
+// parseBenchmarkOptionsQuery parses the options from the query parameters of an API request.
+func parseBenchmarkOptionsQuery(query url.Values) (options benchmarkOptions, err error) {
+	var args []string
+	for _, name := range []string{"runs", "concurrency", "warmup", "limit", "report"} {
+		if query.Has(name) {
+			args = append(args, "--"+name+"="+query.Get(name))
+		}
+	}
+
+	return parseBenchmarkOptions(args)
+}
+
+// benchmarkTransfer is the result of a single transfer.
+type benchmarkTransfer struct {
+	Run             int       `json:"run"`             // Run number starting with 1, warm-up runs first
+	Warmup          bool      `json:"warmup"`          // Warm-up run, excluded from the statistics
+	Started         time.Time `json:"started"`         // Start of the transfer
+	Handshake       float64   `json:"handshake"`       // Milliseconds until the UDT connection is established
+	Header          float64   `json:"header"`          // Milliseconds until the header is received
+	Duration        float64   `json:"duration"`        // Milliseconds to receive the data after the header
+	FileSize        uint64    `json:"filesize"`        // File size reported by the remote peer
+	Bytes           uint64    `json:"bytes"`           // Bytes of file data received
+	Throughput      float64   `json:"throughput"`      // Bytes per second of the data phase
+	Verified        string    `json:"verified"`        // Hash check: "valid", "invalid", or empty if only a part of the file was transferred
+	PktSentACK      uint64    `json:"pktsentack"`      // ACK packets sent
+	PktRecvACK2     uint64    `json:"pktrecvack2"`     // ACK2 packets received
+	PktSentNAK      uint64    `json:"pktsentnak"`      // NAK packets sent
+	PktRecvData     uint64    `json:"pktrecvdata"`     // Data packets received
+	PktRcvLoss      uint64    `json:"pktrcvloss"`      // Lost packets detected by the receiver
+	PktHandShake    uint64    `json:"pkthandshake"`    // Handshake packets sent and received
+	PktShutdown     uint64    `json:"pktshutdown"`     // Shutdown packets sent and received
+	TerminateReason int       `json:"terminatereason"` // Terminate reason of the virtual connection. 0 if none.
+	Error           string    `json:"error,omitempty"` // Error, if the transfer failed
+}
+
+// benchmarkPercentiles are statistics of a measurement.
+type benchmarkPercentiles struct {
+	Min  float64 `json:"min"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+}
+
+// benchmarkSummary are the statistics of the measured transfers.
+type benchmarkSummary struct {
+	Transfers        int                  `json:"transfers"`        // Measured transfers
+	Failed           int                  `json:"failed"`           // Transfers with an error
+	Invalid          int                  `json:"invalid"`          // Transfers with a hash mismatch
+	Bytes            uint64               `json:"bytes"`            // Total bytes received
+	Throughput       benchmarkPercentiles `json:"throughput"`       // Bytes per second of the successful transfers
+	Handshake        benchmarkPercentiles `json:"handshake"`        // Milliseconds of the established connections
+	Header           benchmarkPercentiles `json:"header"`           // Milliseconds of the received headers
+	NAKPerACK        float64              `json:"nakperack"`        // NAK packets per ACK packet sent
+	PktRcvLoss       uint64               `json:"pktrcvloss"`       // Lost packets detected by the receiver
+	TerminateReasons map[int]int          `json:"terminatereasons"` // Count of transfers per terminate reason
+}
+
+// benchmarkReport is the report written as JSON.
+type benchmarkReport struct {
+	PeerID      string              `json:"peerid"`      // Remote peer
+	FileHash    string              `json:"filehash"`    // File transferred
+	Started     time.Time           `json:"started"`     // Start of the benchmark
+	Runs        int                 `json:"runs"`        // Measured runs
+	Concurrency int                 `json:"concurrency"` // Simultaneous transfers per run
+	Warmup      int                 `json:"warmup"`      // Warm-up runs
+	Limit       uint64              `json:"limit"`       // Bytes per transfer, 0 for the entire file
+	Summary     benchmarkSummary    `json:"summary"`     // Statistics of the measured transfers
+	Transfers   []benchmarkTransfer `json:"transfers"`   // All transfers including warm-up
+	ReportFiles []string            `json:"reportfiles"` // CSV and JSON report files
+}
+
+// milliseconds returns the duration in milliseconds.
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
+
+// runBenchmarkTransfer transfers the file (or the first limit bytes) from the peer and measures it. The data is discarded.
+func runBenchmarkTransfer(peer *core.PeerInfo, fileHash []byte, limit uint64, run int, warmup bool) (result benchmarkTransfer) {
+	result = benchmarkTransfer{Run: run, Warmup: warmup, Started: time.Now()}
+
+	if !peer.IsConnectionActive() {
+		result.Error = "peer has no active connection"
+		return result
+	}
+
+	udtConn, virtualConn, err := peer.FileTransferRequestUDT(fileHash, 0, limit)
+	if err != nil {
+		result.Error = "opening UDT connection: " + err.Error()
+		return result
+	}
+	result.Handshake = milliseconds(time.Since(result.Started))
+
+	defer func() {
+		metrics := udtConn.Metrics
+		result.PktSentACK, result.PktRecvACK2, result.PktSentNAK = metrics.PktSentACK, metrics.PktRecvACK2, metrics.PktSentNAK
+		result.PktRecvData, result.PktRcvLoss = metrics.PktRecvData, metrics.PktRcvLoss
+		result.PktHandShake = metrics.PktSendHandShake + metrics.PktRecvHandShake
+		result.PktShutdown = metrics.PktSentShutdown + metrics.PktRecvShutdown
+		result.TerminateReason = virtualConn.GetTerminateReason()
+	}()
+
+	fileSize, transferSize, err := protocol.FileTransferReadHeader(udtConn)
+	if err != nil {
+		udtConn.Close()
+		result.Error = "reading file transfer header: " + err.Error()
+		return result
+	}
+	result.Header = milliseconds(time.Since(result.Started))
+	result.FileSize = fileSize
+	virtualConn.Stats.(*core.FileTransferStats).FileSize = fileSize
+
+	// only the entire file can be verified
+	var hasher *blake3.Hasher
+	if transferSize == fileSize {
+		hasher = blake3.New(protocol.HashSize, nil)
+	}
+
+	dataStart := time.Now()
+	buffer := make([]byte, downloadBufferSize)
+
+	for result.Bytes < transferSize {
+		readSize := uint64(len(buffer))
+		if remaining := transferSize - result.Bytes; remaining < readSize {
+			readSize = remaining
+		}
+
+		n, err := udtConn.Read(buffer[:readSize])
+		if n > 0 {
+			if hasher != nil {
+				hasher.Write(buffer[:n])
+			}
+			result.Bytes += uint64(n)
+		} else if err == nil {
+			err = errors.New("empty read")
+		}
+		if err != nil {
+			result.Error = fmt.Sprintf("transfer interrupted after %d of %d bytes: %s", result.Bytes, transferSize, err.Error())
+			break
+		}
+	}
+
+	duration := time.Since(dataStart)
+	result.Duration = milliseconds(duration)
+	if duration > 0 {
+		result.Throughput = float64(result.Bytes) / duration.Seconds()
+	}
+
+	if result.Error == "" && hasher != nil {
+		if bytes.Equal(hasher.Sum(nil), fileHash) {
+			result.Verified = "valid"
+		} else {
+			result.Verified = "invalid"
+		}
+	}
+
+	udtConn.Close()
+	return result
+}
+
+// calculatePercentiles returns the statistics of the values. Percentiles use the nearest rank.
+func calculatePercentiles(values []float64) (result benchmarkPercentiles) {
+	if len(values) == 0 {
+		return result
+	}
+
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	rank := func(percentile float64) float64 {
+		index := int(math.Ceil(percentile/100*float64(len(sorted)))) - 1
+		if index < 0 {
+			index = 0
+		}
+		return sorted[index]
+	}
+
+	var sum float64
+	for _, value := range sorted {
+		sum += value
+	}
+
+	return benchmarkPercentiles{Min: sorted[0], P50: rank(50), P90: rank(90), P99: rank(99), Max: sorted[len(sorted)-1], Mean: sum / float64(len(sorted))}
+}
+
+// summarizeBenchmark returns the statistics of the transfers. Warm-up transfers are excluded.
+func summarizeBenchmark(transfers []benchmarkTransfer) (summary benchmarkSummary) {
+	summary.TerminateReasons = make(map[int]int)
+	var throughput, handshake, header []float64
+	var sentACK, sentNAK uint64
+
+	for _, transfer := range transfers {
+		if transfer.Warmup {
+			continue
+		}
+
+		summary.Transfers++
+		summary.Bytes += transfer.Bytes
+		summary.PktRcvLoss += transfer.PktRcvLoss
+		sentACK += transfer.PktSentACK
+		sentNAK += transfer.PktSentNAK
+		if transfer.TerminateReason != 0 {
+			summary.TerminateReasons[transfer.TerminateReason]++
+		}
+
+		if transfer.Handshake > 0 {
+			handshake = append(handshake, transfer.Handshake)
+		}
+		if transfer.Header > 0 {
+			header = append(header, transfer.Header)
+		}
+
+		switch {
+		case transfer.Error != "":
+			summary.Failed++
+		case transfer.Verified == "invalid":
+			summary.Invalid++
+		default:
+			throughput = append(throughput, transfer.Throughput)
+		}
+	}
+
+	summary.Throughput = calculatePercentiles(throughput)
+	summary.Handshake = calculatePercentiles(handshake)
+	summary.Header = calculatePercentiles(header)
+	if sentACK > 0 {
+		summary.NAKPerACK = float64(sentNAK) / float64(sentACK)
+	}
+
+	return summary
+}
+
+// writeBenchmarkCSV writes one line per transfer.
+func writeBenchmarkCSV(filename string, transfers []benchmarkTransfer) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"run", "warmup", "started", "handshake", "header", "duration", "filesize", "bytes", "throughput", "verified", "pktsentack", "pktrecvack2", "pktsentnak", "pktrecvdata", "pktrcvloss", "pkthandshake", "pktshutdown", "terminatereason", "error"})
+
+	for _, t := range transfers {
+		writer.Write([]string{strconv.Itoa(t.Run), strconv.FormatBool(t.Warmup), t.Started.UTC().Format(time.RFC3339Nano),
+			strconv.FormatFloat(t.Handshake, 'f', 3, 64), strconv.FormatFloat(t.Header, 'f', 3, 64), strconv.FormatFloat(t.Duration, 'f', 3, 64),
+			strconv.FormatUint(t.FileSize, 10), strconv.FormatUint(t.Bytes, 10), strconv.FormatFloat(t.Throughput, 'f', 0, 64), t.Verified,
+			strconv.FormatUint(t.PktSentACK, 10), strconv.FormatUint(t.PktRecvACK2, 10), strconv.FormatUint(t.PktSentNAK, 10), strconv.FormatUint(t.PktRecvData, 10),
+			strconv.FormatUint(t.PktRcvLoss, 10), strconv.FormatUint(t.PktHandShake, 10), strconv.FormatUint(t.PktShutdown, 10),
+			strconv.Itoa(t.TerminateReason), t.Error})
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeBenchmarkReport writes the report as CSV and JSON into the report folder and returns the filenames.
+func writeBenchmarkReport(report *benchmarkReport, name string) (files []string, err error) {
+	if name == "" {
+		name = "probe_" + report.Started.Format("20060102_150405")
+	}
+
+	base, err := safeFolderPath(reportFolder(), name)
+	if err != nil {
+		return nil, err
+	} else if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		return nil, err
+	}
+
+	files = []string{base + ".csv", base + ".json"}
+	report.ReportFiles = files
+
+	if err := writeBenchmarkCSV(files[0], report.Transfers); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return files, os.WriteFile(files[1], data, 0644)
+}
+
+// transferBenchmark runs the benchmark and writes the report. In JSON mode the report is written to the output instead of the text.
+func transferBenchmark(peer *core.PeerInfo, fileHash []byte, options benchmarkOptions, output io.Writer, jsonOutput bool) {
+	report := &benchmarkReport{PeerID: hex.EncodeToString(peer.PublicKey.SerializeCompressed()), FileHash: hex.EncodeToString(fileHash), Started: time.Now(),
+		Runs: options.Runs, Concurrency: options.Concurrency, Warmup: options.Warmup, Limit: options.Limit}
+
+	if !jsonOutput {
+		limitText := "entire file"
+		if options.Limit > 0 {
+			limitText = fmt.Sprintf("%d bytes", options.Limit)
+		}
+		fmt.Fprintf(output, "Benchmark of file %s: %d runs, %d concurrent transfers, %d warm-up runs, %s\n", report.FileHash, options.Runs, options.Concurrency, options.Warmup, limitText)
+	}
+
+	for run := 1; run <= options.Warmup+options.Runs; run++ {
+		warmup := run <= options.Warmup
+		results := make([]benchmarkTransfer, options.Concurrency)
+
+		var wg sync.WaitGroup
+		for n := range results {
+			wg.Add(1)
+			go func(n, run int, warmup bool) {
+				defer wg.Done()
+				results[n] = runBenchmarkTransfer(peer, fileHash, options.Limit, run, warmup)
+			}(n, run, warmup)
+		}
+		wg.Wait()
+
+		report.Transfers = append(report.Transfers, results...)
+
+		if !jsonOutput {
+			for _, result := range results {
+				fmt.Fprintln(output, benchmarkTransferToA(result))
+			}
+		}
+	}
+
+	report.Summary = summarizeBenchmark(report.Transfers)
+	_, errReport := writeBenchmarkReport(report, options.Report)
+
+	if jsonOutput {
+		if errReport != nil {
+			writeJSONError(output, "Error writing report: "+errReport.Error())
+			return
+		}
+		writeJSON(output, report)
+		return
+	}
+
+	outputBenchmarkSummary(report.Summary, output)
+
+	if errReport != nil {
+		fmt.Fprintf(output, "Error writing report: %s\n", errReport.Error())
+	} else {
+		fmt.Fprintf(output, "Report: %s\n", strings.Join(report.ReportFiles, ", "))
+	}
+}
+
+// benchmarkTransferToA returns the result of a transfer as text.
+func benchmarkTransferToA(result benchmarkTransfer) string {
+	text := fmt.Sprintf("Run %d", result.Run)
+	if result.Warmup {
+		text += " (warm-up)"
+	}
+
+	if result.Error != "" {
+		text += ": " + result.Error
+	} else {
+		text += fmt.Sprintf(": %d bytes in %.0f ms, %.2f KB/s, handshake %.0f ms, header %.0f ms, ACK %d NAK %d loss %d", result.Bytes, result.Duration, result.Throughput/1024, result.Handshake, result.Header, result.PktSentACK, result.PktSentNAK, result.PktRcvLoss)
+		if result.Verified != "" {
+			text += ", hash " + result.Verified
+		}
+	}
+
+	if result.TerminateReason != 0 {
+		text += fmt.Sprintf(". Terminate reason %d: %s", result.TerminateReason, translateTerminateReason(result.TerminateReason))
+	}
+
+	return text
+}
+
+// outputBenchmarkSummary writes the statistics as text.
+func outputBenchmarkSummary(summary benchmarkSummary, output io.Writer) {
+	fmt.Fprintf(output, "---- Benchmark Summary ----\n")
+	fmt.Fprintf(output, "Transfers %d, failed %d, invalid hash %d, received %d bytes\n", summary.Transfers, summary.Failed, summary.Invalid, summary.Bytes)
+	fmt.Fprintf(output, "                    Min         P50         P90         P99         Max         Mean\n")
+
+	row := func(name string, p benchmarkPercentiles, factor float64) {
+		fmt.Fprintf(output, "%-18s  %-10.2f  %-10.2f  %-10.2f  %-10.2f  %-10.2f  %.2f\n", name, p.Min/factor, p.P50/factor, p.P90/factor, p.P99/factor, p.Max/factor, p.Mean/factor)
+	}
+	row("Throughput KB/s", summary.Throughput, 1024)
+	row("Handshake ms", summary.Handshake, 1)
+	row("Header ms", summary.Header, 1)
+
+	fmt.Fprintf(output, "NAK/ACK ratio %.4f, lost packets %d\n", summary.NAKPerACK, summary.PktRcvLoss)
+
+	reasons := make([]int, 0, len(summary.TerminateReasons))
+	for reason := range summary.TerminateReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Ints(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(output, "Terminate reason %d: %s  %d transfers\n", reason, translateTerminateReason(reason), summary.TerminateReasons[reason])
+	}
+}
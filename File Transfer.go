@@ -200,34 +200,3 @@ func outputUDTMetrics(metrics *udt.Metrics, output io.Writer) {
 	//fmt.Fprintf(output, "User-defined        %-8d  %-8d\n", metrics.PktSendUserDefined, metrics.PktRecvUserDefined)
 	//fmt.Fprintf(output, "Other               %-8d  %-8d\n", metrics.PktSentOther, metrics.PktRecvOther)
 }
-
-/*
-// downloadFile downloads the file from the target peer
-func downloadFile(output io.Writer, publicKey *btcec.PublicKey, hash []byte) (data []byte, err error) {
-	peer := core.PeerlistLookup(publicKey)
-	if peer == nil {
-		return nil, errors.New("peer not connected")
-	}
-
-	udtConn, _, err := peer.FileTransferRequestUDT(hash, 0, 0)
-	if err != nil {
-		return nil, err
-	}
-	defer udtConn.Close()
-
-	fileSize, transferSize, err := core.FileTransferReadHeaderUDT(udtConn)
-	if err != nil {
-		return nil, err
-	}
-
-	fmt.Fprintf(output, "* Indicated file size = %d. Target transfer size = %d\n", fileSize, transferSize)
-
-	// read all data
-	data = make([]byte, transferSize)
-	n, err := udtConn.Read(data)
-
-	fmt.Fprintf(output, "* Read %d bytes (target %d), error: %v\n", n, transferSize, err)
-
-	return data, err
-}
-*/
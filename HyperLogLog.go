@@ -0,0 +1,131 @@
+/*
+File Name:  HyperLogLog.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+HyperLogLog sketch to estimate the count of unique items with fixed memory usage. Sketches with the same precision can be merged,
+which allows estimating unique counts across multiple days or multiple root peers without the raw data.
+
+The standard error is 1.04 / sqrt(2^precision), for example 0.81% for precision 14 (16 KB).
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// hyperLogLog is a HyperLogLog sketch. It is not safe for concurrent use.
+type hyperLogLog struct {
+	precision uint8   // Count of bits used for the register index. Valid range 4-16.
+	registers []uint8 // 2^precision registers storing the max rank
+}
+
+// newHyperLogLog creates a new empty sketch with the given precision.
+func newHyperLogLog(precision uint8) *hyperLogLog {
+	return &hyperLogLog{precision: precision, registers: make([]uint8, 1<<precision)}
+}
+
+// hyperLogLogHash returns the 64-bit hash of the item used for adding it to sketches.
+func hyperLogLogHash(data []byte) uint64 {
+	hash := core.Data2Hash(data)
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+// Add adds the item to the sketch.
+func (h *hyperLogLog) Add(data []byte) {
+	h.AddHash(hyperLogLogHash(data))
+}
+
+// AddHash adds the item identified by its hash returned by hyperLogLogHash.
+func (h *hyperLogLog) AddHash(hash uint64) {
+	index := hash >> (64 - h.precision)
+	rank := uint8(bits.LeadingZeros64(hash<<h.precision|1<<(h.precision-1))) + 1
+
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// Merge merges the other sketch into this one. Both must have the same precision.
+func (h *hyperLogLog) Merge(other *hyperLogLog) error {
+	if h.precision != other.precision {
+		return errors.New("precision mismatch")
+	}
+
+	for n, rank := range other.registers {
+		if rank > h.registers[n] {
+			h.registers[n] = rank
+		}
+	}
+
+	return nil
+}
+
+// Clone returns a copy of the sketch.
+func (h *hyperLogLog) Clone() *hyperLogLog {
+	clone := &hyperLogLog{precision: h.precision, registers: make([]uint8, len(h.registers))}
+	copy(clone.registers, h.registers)
+	return clone
+}
+
+// Estimate returns the estimated count of unique items.
+func (h *hyperLogLog) Estimate() uint64 {
+	m := float64(len(h.registers))
+
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha * m * m / sum
+
+	// small range correction via linear counting
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+// MarshalBinary encodes the sketch as precision byte followed by the registers.
+func (h *hyperLogLog) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, 1+len(h.registers))
+	data[0] = h.precision
+	copy(data[1:], h.registers)
+	return data, nil
+}
+
+// UnmarshalBinary decodes a sketch encoded by MarshalBinary.
+func (h *hyperLogLog) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 || data[0] < 4 || data[0] > 16 || len(data) != 1+1<<data[0] {
+		return errors.New("invalid sketch encoding")
+	}
+
+	h.precision = data[0]
+	h.registers = make([]uint8, 1<<h.precision)
+	copy(h.registers, data[1:])
+
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+File Name:  HyperLogLog_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// testSketch returns a sketch with the items from (inclusive) to (exclusive).
+func testSketch(precision uint8, from, to uint64) *hyperLogLog {
+	sketch := newHyperLogLog(precision)
+	var item [8]byte
+	for n := from; n < to; n++ {
+		binary.BigEndian.PutUint64(item[:], n)
+		sketch.Add(item[:])
+	}
+	return sketch
+}
+
+// testEstimateError returns the relative error of the estimate.
+func testEstimateError(estimate, actual uint64) float64 {
+	return math.Abs(float64(estimate)-float64(actual)) / float64(actual)
+}
+
+func TestHyperLogLogMarshal(t *testing.T) {
+	sketch := testSketch(sketchPrecisionDaily, 0, 5000)
+
+	data, err := sketch.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(data) != 1+1<<sketchPrecisionDaily || data[0] != sketchPrecisionDaily {
+		t.Fatalf("invalid encoding: %d bytes, precision %d", len(data), data[0])
+	}
+
+	var loaded hyperLogLog
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.precision != sketch.precision || !bytes.Equal(loaded.registers, sketch.registers) {
+		t.Fatal("reloaded sketch differs")
+	}
+	if loaded.Estimate() != sketch.Estimate() {
+		t.Fatalf("estimate %d after reload, expected %d", loaded.Estimate(), sketch.Estimate())
+	}
+
+	invalid := map[string][]byte{
+		"empty":              {},
+		"precision too low":  append([]byte{3}, make([]byte, 1<<3)...),
+		"precision too high": {17},
+		"missing registers":  data[:len(data)-1],
+		"extra data":         append(data, 0),
+	}
+	for name, data := range invalid {
+		if err := (&hyperLogLog{}).UnmarshalBinary(data); err == nil {
+			t.Errorf("%s: invalid encoding accepted", name)
+		}
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a := testSketch(sketchPrecisionDaily, 0, 10000)
+	b := testSketch(sketchPrecisionDaily, 5000, 15000)
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// The merged sketch is the same as the sketch of the union.
+	union := testSketch(sketchPrecisionDaily, 0, 15000)
+	if !bytes.Equal(a.registers, union.registers) {
+		t.Fatal("merged sketch differs from the sketch of the union")
+	}
+	if e := testEstimateError(a.Estimate(), 15000); e > 0.03 {
+		t.Fatalf("merged estimate %d, error %.2f%%", a.Estimate(), e*100)
+	}
+
+	if err := a.Merge(newHyperLogLog(sketchPrecisionHourly)); err == nil {
+		t.Fatal("merge of different precision accepted")
+	}
+}
+
+func TestHyperLogLogErrorBound(t *testing.T) {
+	for _, test := range []struct {
+		precision uint8
+		count     uint64
+	}{
+		{sketchPrecisionDaily, 100},
+		{sketchPrecisionDaily, 100000},
+		{sketchPrecisionHourly, 50000},
+	} {
+		// 3 times the standard error of 1.04 / sqrt(2^precision)
+		bound := 3 * 1.04 / math.Sqrt(float64(uint64(1)<<test.precision))
+
+		estimate := testSketch(test.precision, 0, test.count).Estimate()
+		if e := testEstimateError(estimate, test.count); e > bound {
+			t.Errorf("precision %d, count %d: estimate %d, error %.2f%% exceeds %.2f%%", test.precision, test.count, estimate, e*100, bound*100)
+		}
+	}
+
+	if estimate := newHyperLogLog(sketchPrecisionDaily).Estimate(); estimate != 0 {
+		t.Errorf("empty sketch estimate %d", estimate)
+	}
+}
@@ -0,0 +1,321 @@
+/*
+File Name:  Line Editor.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Line editing for the local terminal. If stdin and stdout are a terminal, commands are read with line editing (arrow keys, home/end),
+a history of previous lines (up/down) and tab completion of command names and peer IDs. The history is kept in a file between restarts.
+Pipes, redirected input and the /console websocket use plain line reading.
+
+The terminal is put into raw mode. Ctrl+C clears the line that is edited. Ctrl+C and Ctrl+D on an empty line shut down the root peer the same as
+the exit command. Raw mode disables the SIGINT signal of Ctrl+C, and keys are only read at the prompt: While a command is running, Ctrl+C does
+not trigger the graceful shutdown. Send SIGINT or SIGTERM to the process instead, for example via kill.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/google/uuid"
+	"golang.org/x/term"
+)
+
+// Settings of the command history.
+const (
+	historyFileDefault = "console_history.txt" // Default file name in the database folder
+	historyMax         = 1000                  // Max count of lines kept
+)
+
+// lineEditor reads lines from the terminal. It implements io.Reader and io.Writer. Output is printed without breaking the line that is currently edited.
+type lineEditor struct {
+	backend     *core.Backend
+	role        string // Role for completion of commands
+	terminal    *term.Terminal
+	stdio       *swapReadWriter
+	state       *term.State // Terminal state before raw mode
+	historyFile string      // File of the history. Empty if not persistent.
+	history     *os.File    // Open history file for appending
+	pending     []byte      // Rest of the line not yet returned by Read
+	sync.Mutex              // Protects state and history
+}
+
+// localLineEditor is the line editor of the local terminal. Nil if not used.
+var localLineEditor *lineEditor
+
+// keyInterrupt is the key passed to the terminal for Ctrl+C, which term.Terminal would otherwise always return as io.EOF.
+// It is a private use character handled by autoComplete, which receives the current line.
+const keyInterrupt = '\uE000'
+
+// interruptReader replaces Ctrl+C in the input by keyInterrupt.
+type interruptReader struct {
+	reader  io.Reader
+	pending []byte
+}
+
+func (reader *interruptReader) Read(p []byte) (n int, err error) {
+	if len(reader.pending) == 0 {
+		buffer := make([]byte, 256)
+		if n, err = reader.reader.Read(buffer); n == 0 {
+			return 0, err
+		}
+		reader.pending = bytes.ReplaceAll(buffer[:n], []byte{3}, []byte(string(keyInterrupt)))
+	}
+
+	n = copy(p, reader.pending)
+	reader.pending = reader.pending[n:]
+	return n, nil
+}
+
+// swapReadWriter forwards to a reader and writer that can be swapped. It is required to load the history into the terminal.
+type swapReadWriter struct {
+	io.Reader
+	io.Writer
+}
+
+// newLineEditor puts the terminal into raw mode and loads the history. It fails if stdin or stdout is not a terminal.
+func newLineEditor(backend *core.Backend, role, historyFile string) (editor *lineEditor, err error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return nil, errors.New("not a terminal")
+	}
+
+	editor = &lineEditor{backend: backend, role: role, historyFile: historyFile, stdio: &swapReadWriter{Writer: io.Discard}}
+	editor.terminal = term.NewTerminal(editor.stdio, "> ")
+	editor.terminal.AutoCompleteCallback = editor.autoComplete
+
+	// The terminal has no function to set the history. Previous lines are entered while the output is discarded instead.
+	if lines := readHistory(historyFile); len(lines) > 0 {
+		editor.stdio.Reader = strings.NewReader(strings.Join(lines, "\r") + "\r")
+		for range lines {
+			editor.terminal.ReadLine()
+		}
+	}
+
+	if editor.state, err = term.MakeRaw(int(os.Stdin.Fd())); err != nil {
+		return nil, err
+	}
+	editor.stdio.Reader, editor.stdio.Writer = &interruptReader{reader: os.Stdin}, os.Stdout
+
+	if width, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+		editor.terminal.SetSize(width, height)
+	}
+
+	if historyFile != "" {
+		if editor.history, err = os.OpenFile(historyFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			backend.LogError("newLineEditor", "opening history file '%s': %v\n", historyFile, err)
+		}
+	}
+
+	return editor, nil
+}
+
+// readHistory reads the last lines of the history file. If the file exceeds the limit, it is shortened.
+func readHistory(filename string) (lines []string) {
+	if filename == "" {
+		return nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(file)
+	total := 0
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+			total++
+		}
+	}
+	file.Close()
+
+	if len(lines) > historyMax {
+		lines = lines[len(lines)-historyMax:]
+	}
+
+	// shorten the file if it grew to twice the limit
+	if total > 2*historyMax {
+		os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	}
+
+	return lines
+}
+
+// ReadString reads the next line. The delimiter is ignored, lines always end with \n. It implements the line reader used by consoleReader.
+func (editor *lineEditor) ReadString(delim byte) (line string, err error) {
+	line, err = editor.terminal.ReadLine()
+	if errors.Is(err, io.EOF) {
+		editor.Close()
+		shutdown(editor.backend, "user terminal Ctrl+D")
+	} else if err != nil && !errors.Is(err, term.ErrPasteIndicator) {
+		return "", err
+	}
+
+	if line = strings.TrimSpace(line); line != "" {
+		editor.Lock()
+		if editor.history != nil {
+			editor.history.WriteString(line + "\n")
+		}
+		editor.Unlock()
+	}
+
+	return line + "\n", nil
+}
+
+// Read implements io.Reader by returning the lines read by ReadString.
+func (editor *lineEditor) Read(p []byte) (n int, err error) {
+	if len(editor.pending) == 0 {
+		line, err := editor.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		editor.pending = []byte(line)
+	}
+
+	n = copy(p, editor.pending)
+	editor.pending = editor.pending[n:]
+	return n, nil
+}
+
+// Write prints the output above the line that is currently edited.
+func (editor *lineEditor) Write(p []byte) (n int, err error) {
+	return editor.terminal.Write(p)
+}
+
+// Close restores the terminal and the output of the standard logger, and closes the history file.
+func (editor *lineEditor) Close() {
+	editor.Lock()
+	defer editor.Unlock()
+
+	if editor.state != nil {
+		log.SetOutput(os.Stderr)
+		term.Restore(int(os.Stdin.Fd()), editor.state)
+		editor.state = nil
+	}
+	if editor.history != nil {
+		editor.history.Close()
+		editor.history = nil
+	}
+}
+
+// autoComplete completes the command or argument at the cursor when tab is pressed.
+// If multiple completions exist, the common prefix is completed, or if there is none, the candidates are listed.
+// It also handles Ctrl+C: A line with text is cleared, on an empty line the root peer is shut down.
+func (editor *lineEditor) autoComplete(line string, pos int, key rune) (newLine string, newPos int, ok bool) {
+	if key == keyInterrupt {
+		if line == "" {
+			editor.Close()
+			shutdown(editor.backend, "user terminal Ctrl+C")
+		}
+		return "", 0, true
+	} else if key != '\t' {
+		return "", 0, false
+	}
+
+	before := line[:pos]
+	fields := strings.Fields(before)
+	current := ""
+	if len(fields) > 0 && !strings.HasSuffix(before, " ") {
+		current = fields[len(fields)-1]
+		fields = fields[:len(fields)-1]
+	}
+
+	var candidates []string
+
+	// complete the command name, which may consist of multiple words
+	typed := strings.ToLower(strings.Join(append(fields, current), " "))
+	for _, name := range completeCommand(typed, editor.role) {
+		candidates = append(candidates, name[len(typed)-len(current):])
+	}
+
+	// otherwise complete the argument of the command
+	if command := lookupCommandPrefix(fields); len(candidates) == 0 && command != nil {
+		argIndex := len(fields) - len(strings.Fields(command.Name))
+		if argIndex < len(command.Args) && command.Args[argIndex].Complete != nil {
+			for _, candidate := range command.Args[argIndex].Complete(editor.backend) {
+				if strings.HasPrefix(candidate, current) {
+					candidates = append(candidates, candidate)
+				}
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", 0, false
+	}
+
+	completion := commonPrefix(candidates)
+	if len(candidates) == 1 {
+		completion += " "
+	} else if completion == current {
+		sort.Strings(candidates)
+		editor.terminal.Write([]byte(strings.Join(candidates, "  ") + "\n"))
+		return "", 0, false
+	}
+
+	newLine = before[:len(before)-len(current)] + completion + line[pos:]
+	return newLine, len(before) - len(current) + len(completion), true
+}
+
+// lookupCommandPrefix returns the registered command if the words start with a complete command name.
+func lookupCommandPrefix(words []string) (command *consoleCommand) {
+	if name, _ := matchCommand(words); name != "" {
+		return lookupCommand(name)
+	}
+	return nil
+}
+
+// commonPrefix returns the longest common prefix of all texts.
+func commonPrefix(texts []string) (prefix string) {
+	prefix = texts[0]
+	for _, text := range texts[1:] {
+		for !strings.HasPrefix(text, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// completePeerIDs returns the peer IDs of all current peers for completion.
+func completePeerIDs(backend *core.Backend) (peerIDs []string) {
+	for _, peer := range GetPeerlistSorted(backend) {
+		peerIDs = append(peerIDs, hex.EncodeToString(peer.PublicKey.SerializeCompressed()))
+	}
+	return peerIDs
+}
+
+// localConsole runs the command handler for the local terminal. The line editor is used if stdin is a terminal.
+// The backend output is redirected to the line editor, so it does not break the line that is currently edited.
+func localConsole(backend *core.Backend, stdoutID uuid.UUID) {
+	historyFile := config.ConsoleHistoryFile
+	if historyFile == "" && config.DatabaseFolder != "" {
+		historyFile = filepath.Join(config.DatabaseFolder, historyFileDefault)
+	}
+
+	editor, err := newLineEditor(backend, localSession.Role, historyFile)
+	if err != nil {
+		userCommands(backend, os.Stdin, os.Stdout, nil, localSession)
+		return
+	}
+
+	localLineEditor = editor
+	backend.Stdout.Unsubscribe(stdoutID)
+	backend.Stdout.Subscribe(editor)
+
+	// Messages of the standard logger are written via the editor. In raw mode they need \r\n and the edited line is redrawn after them.
+	log.SetOutput(editor)
+
+	userCommands(backend, editor, editor, nil, localSession)
+}
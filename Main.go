@@ -7,6 +7,7 @@ Author:     Peter Kleissner
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
@@ -14,27 +15,60 @@ import (
 	"github.com/google/uuid"
 )
 
-const configFile = "Config.yaml"
+// configFile is the path of the config file. It can be changed via the -config flag.
+var configFile = "Config.yaml"
+
 const appName = "Peernet Root"
 
-var config struct {
+// rootConfig contains the root specific settings. They are stored in the same config file as the core settings.
+type rootConfig struct {
 	// Statistics web server settings
 	WebListen       []string `yaml:"WebListen"`       // WebListen is in format IP:Port and declares where the web-interface should listen on. IP can also be ommitted to listen on any.
 	UseSSL          bool     `yaml:"UseSSL"`          // Enables SSL.
 	CertificateFile string   `yaml:"CertificateFile"` // This is the certificate received from the CA. This can also include the intermediate certificate from the CA.
 	CertificateKey  string   `yaml:"CertificateKey"`  // This is the private key.
 	HTTPAccessAllow string   `yaml:"HTTPAccessAllow"` // Sets the Access-Control-Allow-Origin HTTP header required for cross domain access. Specify * for all or URL.
+	CacheMaxAge     string   `yaml:"CacheMaxAge"`     // Cache time of the statistics JSON responses and the dashboard. Default 1m.
+	CacheMaxAgeCSV  string   `yaml:"CacheMaxAgeCSV"`  // Cache time of the daily summary CSV file. Default 10m.
+
+	// Built-in ACME client to obtain certificates. Leave CertificateFile/CertificateKey (or the API equivalents) empty to use the ACME certificates.
+	ACMEDomains     []string `yaml:"ACMEDomains"`     // Domains to obtain certificates for. Empty to disable ACME.
+	ACMEEmail       string   `yaml:"ACMEEmail"`       // Contact email address for the CA.
+	ACMEDirectory   string   `yaml:"ACMEDirectory"`   // ACME directory URL. Default is Let's Encrypt production.
+	ACMEDirectoryCA string   `yaml:"ACMEDirectoryCA"` // Optional PEM file of a CA to trust for the directory. Required for test servers like pebble.
+	ACMEFolder      string   `yaml:"ACMEFolder"`      // Folder to store the account key and certificates. Default "certificates".
+	ACMEHTTPListen  []string `yaml:"ACMEHTTPListen"`  // Optional plain HTTP listeners for the HTTP-01 challenge (usually port 80). Other requests are redirected to HTTPS.
 
 	// HTTP Server Timeouts. Valid units are ms, s, m, h.
 	HTTPTimeoutRead  string `yaml:"HTTPTimeoutRead"`  // The maximum duration for reading the entire request, including the body.
 	HTTPTimeoutWrite string `yaml:"HTTPTimeoutWrite"` // The maximum duration before timing out writes of the response. This includes processing time and is therefore the max time any HTTP function may take.
 
-	// WebFiles is the directory holding all HTML and other files to be served by the server
+	// Response compression via gzip and brotli. Responses smaller than the minimum size in bytes are sent uncompressed (0 = default 1024).
+	HTTPCompression        bool `yaml:"HTTPCompression"`
+	HTTPCompressionMinSize int  `yaml:"HTTPCompressionMinSize"`
+
+	// Rate limiting per client IP for the statistics web server. Each rule defines Path (prefix), Rate (requests per second) and Burst.
+	RateLimit      []rateLimitRule `yaml:"RateLimit"`      // Empty to disable.
+	RateLimitAllow []string        `yaml:"RateLimitAllow"` // IPs or CIDRs that are never limited.
+
+	// Access log of the statistics web server and the API. Formats are common, combined (default) and json.
+	AccessLogFile      string `yaml:"AccessLogFile"`      // Empty to disable.
+	AccessLogFormat    string `yaml:"AccessLogFormat"`    // Log format.
+	AccessLogMaxSize   int    `yaml:"AccessLogMaxSize"`   // Max size in MB before the file is rotated. 0 = no rotation.
+	AccessLogMaxFiles  int    `yaml:"AccessLogMaxFiles"`  // Count of rotated files to keep.
+	AccessLogAnonymize bool   `yaml:"AccessLogAnonymize"` // Anonymize client IPs by zeroing the last IPv4 octet and last 80 bits of IPv6.
+
+	// WebFiles is the directory holding all HTML and other files to be served by the server. The default web files are embedded in the binary.
+	// If empty, only the embedded files are served. Otherwise files in the directory override the embedded files.
 	WebFiles string `yaml:"WebFiles"`
 
 	// DatabaseFolder defines where all the database files are stored. Currently they are uncompressed unencrypted CSV files.
 	DatabaseFolder string `yaml:"DatabaseFolder"`
 
+	// Federation with sibling root peers. Their daily.json and today.json are polled and combined in /stat/network.json.
+	FederationRoots    []string `yaml:"FederationRoots"`    // Base URLs of sibling roots, for example "https://2.peernet.network". Empty to disable.
+	FederationInterval string   `yaml:"FederationInterval"` // Polling interval. Default 5m.
+
 	// API settings
 	APIListen          []string  `yaml:"APIListen"`          // WebListen is in format IP:Port and declares where the web-interface should listen on. IP can also be ommitted to listen on any.
 	APIUseSSL          bool      `yaml:"APIUseSSL"`          // Enables SSL.
@@ -42,10 +76,34 @@ var config struct {
 	APICertificateKey  string    `yaml:"APICertificateKey"`  // This is the private key.
 	APITimeoutRead     string    `yaml:"APITimeoutRead"`     // The maximum duration for reading the entire request, including the body.
 	APITimeoutWrite    string    `yaml:"APITimeoutWrite"`    // The maximum duration before timing out writes of the response. This includes processing time and is therefore the max time any HTTP function may take.
-	APIKey             uuid.UUID `yaml:"APIKey"`             // API key. Empty UUID 00000000-0000-0000-0000-000000000000 = not used.
+	APIKey             uuid.UUID `yaml:"APIKey"`             // API key with the admin role. Empty UUID 00000000-0000-0000-0000-000000000000 = not used.
+
+	// Additional API keys with roles readonly, operator or admin. The role defines which console commands are allowed.
+	APIKeys []apiKeyConfig `yaml:"APIKeys"`
+
+	// AuditLogFile is the append-only log of all console commands. Empty to disable.
+	AuditLogFile string `yaml:"AuditLogFile"`
+
+	// DownloadFolder is the folder for files downloaded via the download command. Default "downloads".
+	DownloadFolder string `yaml:"DownloadFolder"`
+
+	// ReportFolder is the folder for the benchmark reports of "probe file transfer". Default "reports".
+	ReportFolder string `yaml:"ReportFolder"`
+
+	// ConsoleHistoryFile stores the command history of the local terminal. Default is console_history.txt in the database folder.
+	ConsoleHistoryFile string `yaml:"ConsoleHistoryFile"`
 }
 
+var config rootConfig
+
 func main() {
+	flag.StringVar(&configFile, "config", configFile, "Path of the config file")
+	headless := flag.Bool("headless", false, "Run without reading commands from stdin, for example as daemon or systemd service")
+	pidFilename := flag.String("pidfile", "", "Write the process ID into this file. It is deleted on exit.")
+	runFilename := flag.String("run", "", "Run the commands from this script file and exit. Commands can also be passed as arguments.")
+	jsonOutput := flag.Bool("json", false, "Command line mode: Write JSON instead of text")
+	flag.Parse()
+
 	userAgent := appName + "/" + core.Version
 
 	filters := &core.Filters{
@@ -79,9 +137,41 @@ func main() {
 		os.Exit(status)
 	}
 
-	backend.Stdout.Subscribe(os.Stdout)
+	// In command line mode only the commands are executed.
+	if *runFilename != "" || flag.NArg() > 0 {
+		if !*jsonOutput { // backend messages would break the JSON output
+			backend.Stdout.Subscribe(os.Stdout)
+		}
+		runCommandLine(backend, *runFilename, flag.Args(), *jsonOutput)
+	}
+
+	if errs := validateConfig(&config); len(errs) > 0 {
+		fmt.Printf("Invalid settings in config file '%s':\n", configFile)
+		for _, err := range errs {
+			fmt.Printf("* %s\n", err.Error())
+		}
+		os.Exit(exitErrorConfigInvalid)
+	}
+
+	initRuntimeSettings()
+
+	if *pidFilename != "" {
+		if err := writePIDFile(*pidFilename); err != nil {
+			fmt.Printf("Error creating PID file '%s': %s\n", *pidFilename, err.Error())
+			os.Exit(exitErrorPIDFile)
+		}
+	}
+
+	stdoutID := backend.Stdout.Subscribe(os.Stdout)
+
+	go handleSignals(backend)
 
 	initStatistics(backend)
+	initFederation(backend)
+	initACME()
+	initAccessLog()
+	initAuditLog()
+	startACMEHTTPListeners()
 	startStatisticsWebServer(backend)
 	go startKPIs(backend)
 
@@ -89,5 +179,11 @@ func main() {
 
 	backend.Connect()
 
-	userCommands(backend, os.Stdin, os.Stdout, nil)
+	sdNotifyReady()
+
+	if *headless {
+		select {}
+	}
+
+	localConsole(backend, stdoutID)
 }
@@ -0,0 +1,422 @@
+/*
+File Name:  Merkle Verification.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Verification of downloads fragment by fragment against the merkle tree of the file. A file record in the blockchain contains the merkle root hash
+and the fragment size. Each fragment received is hashed and compared with its hash in the merkle tree. A download from an untrusted peer stops at
+the first invalid fragment instead of after the entire file.
+
+The trusted merkle root hash is either passed via --merkle-root=[hash], or read from the file record in the blockchain of the publisher.
+The publisher is set via --publisher=[peer ID], otherwise the source peers are tried. The blocks are read from the global blockchain cache,
+or downloaded from the publisher. Blocks are signed by the owner of the blockchain, only records signed by the publisher are accepted.
+Without a trusted root hash, merkle verification is refused.
+
+Peers do not serve merkle trees yet, therefore the tree is read from a merkle tree file in the download folder (option --merkle=[file],
+default "[file hash].merkle"). The file format is the one of the warehouse companion files, "merkle export" writes it on a peer storing the file.
+Before use, every fragment hash of the tree is verified against the trusted root hash.
+Files up to the minimum fragment size of 256 KB have a single fragment and the merkle root hash is the file hash; no tree or record is needed.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/PeernetOfficial/core/blockchain"
+	"github.com/PeernetOfficial/core/merkle"
+	"github.com/PeernetOfficial/core/protocol"
+	"github.com/PeernetOfficial/core/warehouse"
+	"github.com/PeernetOfficial/core/webapi"
+	"lukechampine.com/blake3"
+)
+
+// Settings of the merkle verification.
+const (
+	merkleTreeExtension   = ".merkle" // Extension of merkle tree files written by "merkle export"
+	merklePublishersMax   = 4         // Max count of source peers whose blockchain is searched for the file record
+	merkleRecordBlocksMax = 1024      // Max count of blocks downloaded from a publisher to find the file record
+)
+
+// merkleOptions are the options for merkle verification of a download.
+type merkleOptions struct {
+	Enabled   bool   // Verify each fragment
+	TreeFile  string // Merkle tree file in the download folder. Empty for "[file hash].merkle".
+	RootHash  []byte // Trusted merkle root hash. Nil to read it from the file record in the blockchain.
+	Publisher string // Peer ID or node ID of the publisher of the file record. Empty to try the source peers.
+}
+
+// parseMerkleOption parses the option --merkle, --merkle-root or --publisher. Handled is false for other options.
+func parseMerkleOption(name, value string, options *merkleOptions) (handled bool, err error) {
+	switch name {
+	case "merkle":
+		options.Enabled = true
+		options.TreeFile = value
+
+	case "merkle-root":
+		var valid bool
+		if options.RootHash, valid = webapi.DecodeBlake3Hash(value); !valid {
+			return true, errors.New("invalid merkle root hash")
+		}
+		options.Enabled = true
+
+	case "publisher":
+		if !validPeerID(value) {
+			return true, fmt.Errorf("invalid peer ID '%s'", value)
+		}
+		options.Publisher = value
+		options.Enabled = true
+
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// parseDownloadOptions parses the options of the download command.
+func parseDownloadOptions(args []string) (options merkleOptions, err error) {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			return options, fmt.Errorf("invalid option '%s'", arg)
+		}
+
+		name, value, _ := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		if handled, err := parseMerkleOption(strings.ToLower(name), value, &options); err != nil {
+			return options, err
+		} else if !handled {
+			return options, fmt.Errorf("unknown option '%s'", arg)
+		}
+	}
+
+	return options, nil
+}
+
+// parseDownloadOptionsQuery parses the merkle options from the query parameters of an API request.
+func parseDownloadOptionsQuery(query url.Values) (options merkleOptions, err error) {
+	var args []string
+	for _, name := range []string{"merkle", "merkle-root", "publisher"} {
+		if query.Has(name) {
+			args = append(args, "--"+name+"="+query.Get(name))
+		}
+	}
+
+	return parseDownloadOptions(args)
+}
+
+// merkleTreePath returns the merkle tree file in the download folder. If the name is empty, the hex encoded hash with the extension .merkle is used.
+func merkleTreePath(name string, fileHash []byte) (path string, err error) {
+	if strings.TrimSpace(name) == "" {
+		name = hex.EncodeToString(fileHash) + merkleTreeExtension
+	}
+	return downloadTargetPath(name, fileHash)
+}
+
+// merkleVerifier verifies the fragments of a file.
+type merkleVerifier struct {
+	fileSize     uint64
+	fragmentSize uint64
+	hashes       [][]byte // Expected hash of each fragment
+}
+
+// fragmentError is returned if a fragment does not match the merkle tree.
+type fragmentError struct {
+	Index  uint64 // Index of the fragment
+	Offset uint64 // Offset of the fragment in the file
+}
+
+func (err *fragmentError) Error() string {
+	return fmt.Sprintf("fragment %d at offset %d does not match the merkle tree", err.Index, err.Offset)
+}
+
+// loadMerkleVerifier returns the verifier for the file. The trusted root hash is the one passed as option, or the one of the file record in the
+// blockchain of the publisher. If no publisher is set, the blockchains of the source peers are searched. The merkle tree is read from the tree file.
+func loadMerkleVerifier(backend *core.Backend, fileHash []byte, fileSize uint64, options merkleOptions, sources []*core.PeerInfo, output io.Writer) (verifier *merkleVerifier, err error) {
+	// Single fragment: The merkle root hash is the file hash.
+	if fileSize <= merkle.MinimumFragmentSize {
+		if options.RootHash != nil && !bytes.Equal(options.RootHash, fileHash) {
+			return nil, errors.New("merkle root hash must be the file hash for files up to the minimum fragment size")
+		}
+
+		verifier = &merkleVerifier{fileSize: fileSize, fragmentSize: merkle.MinimumFragmentSize}
+		if fileSize > 0 {
+			verifier.hashes = [][]byte{fileHash}
+		}
+		return verifier, nil
+	}
+
+	// The trusted root hash. The fragment size is only known from the file record.
+	rootHash, fragmentSize := options.RootHash, uint64(0)
+
+	if rootHash == nil {
+		if options.Publisher != "" {
+			publisher, err := connectPeer(backend, options.Publisher, timeoutConnectPeer)
+			if err != nil {
+				return nil, fmt.Errorf("could not connect to publisher: %w", err)
+			}
+			sources = []*core.PeerInfo{publisher}
+		} else if len(sources) > merklePublishersMax {
+			sources = sources[:merklePublishersMax]
+		}
+
+		for _, publisher := range sources {
+			file, found, err := lookupFileRecord(backend, publisher, fileHash, fileSize)
+			if err != nil {
+				fmt.Fprintf(output, "Error reading the blockchain of peer %s: %s\n", hex.EncodeToString(publisher.PublicKey.SerializeCompressed()), err.Error())
+			} else if found {
+				fmt.Fprintf(output, "Merkle root hash %s from file record %s in the blockchain of peer %s\n", hex.EncodeToString(file.MerkleRootHash), file.ID.String(), hex.EncodeToString(publisher.PublicKey.SerializeCompressed()))
+				rootHash, fragmentSize = file.MerkleRootHash, file.FragmentSize
+				break
+			}
+		}
+
+		if rootHash == nil {
+			return nil, errors.New("no trusted merkle root hash: the file record was not found in the blockchain of the publisher, pass --publisher=[peer ID] or --merkle-root=[hash]")
+		}
+	}
+
+	path, err := merkleTreePath(options.TreeFile, fileHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree *merkle.MerkleTree
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading merkle tree file: %w", err)
+	} else if len(data) < merkle.MerkleTreeFileHeaderSize || binary.LittleEndian.Uint64(data[8:16]) == 0 { // fragment size 0 is invalid
+		return nil, errors.New("invalid merkle tree file")
+	} else if tree = merkle.ImportMerkleTree(data); tree == nil {
+		return nil, errors.New("invalid merkle tree file")
+	}
+
+	return newMerkleVerifier(tree, fileSize, rootHash, fragmentSize)
+}
+
+// lookupFileRecord searches the blockchain of the publisher for the file record with the hash and size. The blocks are read from the global
+// blockchain cache, or downloaded from the publisher if the record is not cached. Only blocks signed by the publisher are accepted.
+func lookupFileRecord(backend *core.Backend, publisher *core.PeerInfo, fileHash []byte, fileSize uint64) (file blockchain.BlockRecordFile, found bool, err error) {
+	match := func(decoded *blockchain.BlockDecoded) bool {
+		if !decoded.OwnerPublicKey.IsEqual(publisher.PublicKey) {
+			return false
+		}
+		for _, decodedR := range decoded.RecordsDecoded {
+			if record, ok := decodedR.(blockchain.BlockRecordFile); ok && bytes.Equal(record.Hash, fileHash) && record.Size == fileSize && len(record.MerkleRootHash) == protocol.HashSize && record.FragmentSize > 0 {
+				file, found = record, true
+				return true
+			}
+		}
+		return false
+	}
+
+	if backend.GlobalBlockchainCache != nil {
+		if header, cached, _ := backend.GlobalBlockchainCache.Store.ReadBlockchainHeader(publisher.PublicKey); cached {
+			for _, blockNumber := range header.ListBlocks {
+				if decoded, _, ok, _ := backend.ReadBlock(publisher.PublicKey, header.Version, blockNumber); ok && match(decoded) {
+					return file, true, nil
+				}
+			}
+		}
+	}
+
+	height := publisher.BlockchainHeight
+	if height == 0 {
+		return file, false, nil
+	} else if height > merkleRecordBlocksMax {
+		height = merkleRecordBlocksMax
+	}
+
+	err = publisher.BlockDownload(publisher.PublicKey, height, maxBlockSize, []protocol.BlockRange{{Offset: 0, Limit: height}}, func(data []byte, targetBlock protocol.BlockRange, blockSize uint64, availability uint8) {
+		if found || availability != protocol.GetBlockStatusAvailable {
+			return
+		}
+		if decoded, status, err := blockchain.DecodeBlockRaw(data); err == nil && status == blockchain.StatusOK {
+			match(decoded)
+		}
+	})
+
+	return file, found, err
+}
+
+// newMerkleVerifier verifies all fragment hashes of the tree against the trusted root hash and returns the verifier.
+// If the fragment size is not 0, it must match the tree.
+func newMerkleVerifier(tree *merkle.MerkleTree, fileSize uint64, rootHash []byte, fragmentSize uint64) (verifier *merkleVerifier, err error) {
+	if tree.FileSize != fileSize {
+		return nil, fmt.Errorf("merkle tree is for file size %d instead of %d", tree.FileSize, fileSize)
+	} else if !bytes.Equal(tree.RootHash, rootHash) {
+		return nil, fmt.Errorf("merkle tree has root hash %s instead of %s", hex.EncodeToString(tree.RootHash), hex.EncodeToString(rootHash))
+	} else if fragmentSize != 0 && tree.FragmentSize != fragmentSize {
+		return nil, fmt.Errorf("merkle tree has fragment size %d instead of %d", tree.FragmentSize, fragmentSize)
+	}
+
+	verifier = &merkleVerifier{fileSize: fileSize, fragmentSize: tree.FragmentSize}
+
+	if tree.FragmentCount <= 1 {
+		verifier.hashes = [][]byte{tree.RootHash}
+		return verifier, nil
+	}
+
+	for n := uint64(0); n < tree.FragmentCount; n++ {
+		if !merkle.MerkleVerify(tree.RootHash, tree.FragmentHashes[n], tree.CreateVerification(n)) {
+			return nil, fmt.Errorf("merkle tree is corrupt, fragment hash %d does not match the root hash", n)
+		}
+	}
+	verifier.hashes = tree.FragmentHashes
+
+	return verifier, nil
+}
+
+// fragmentRange returns the offset and size of the fragment.
+func (verifier *merkleVerifier) fragmentRange(index uint64) (offset, size uint64) {
+	offset = index * verifier.fragmentSize
+	size = verifier.fragmentSize
+	if offset+size > verifier.fileSize {
+		size = verifier.fileSize - offset
+	}
+	return offset, size
+}
+
+// verifyPartial verifies the fragments stored in the first bytes of the file and returns the size up to the end of the last valid fragment.
+// An incomplete last fragment is not counted.
+func (verifier *merkleVerifier) verifyPartial(file io.ReaderAt, size uint64) (validSize uint64, err error) {
+	for index := range verifier.hashes {
+		offset, fragmentSize := verifier.fragmentRange(uint64(index))
+		if offset+fragmentSize > size {
+			break
+		}
+
+		if valid, err := verifier.verifyRange(file, offset, fragmentSize); err != nil {
+			return validSize, err
+		} else if !valid {
+			break
+		}
+		validSize = offset + fragmentSize
+	}
+
+	return validSize, nil
+}
+
+// verifyRange verifies the fragments in the range of the file. The offset must be at the start of a fragment.
+func (verifier *merkleVerifier) verifyRange(file io.ReaderAt, offset, size uint64) (valid bool, err error) {
+	buffer := make([]byte, downloadBufferSize)
+
+	for end := offset + size; offset < end; {
+		index := offset / verifier.fragmentSize
+		_, fragmentSize := verifier.fragmentRange(index)
+
+		hasher := blake3.New(protocol.HashSize, nil)
+		if _, err := io.CopyBuffer(hasher, io.NewSectionReader(file, int64(offset), int64(fragmentSize)), buffer); err != nil {
+			return false, err
+		} else if !bytes.Equal(hasher.Sum(nil), verifier.hashes[index]) {
+			return false, nil
+		}
+
+		offset += fragmentSize
+	}
+
+	return true, nil
+}
+
+// newWriter returns a writer that verifies each fragment while passing the data to the output. The offset must be at the start of a fragment.
+// After the last byte of a fragment is written, the writer returns a fragmentError if the fragment is invalid.
+func (verifier *merkleVerifier) newWriter(output io.Writer, offset uint64) *merkleWriter {
+	return &merkleWriter{verifier: verifier, output: output, index: offset / verifier.fragmentSize, hasher: blake3.New(protocol.HashSize, nil)}
+}
+
+// merkleWriter verifies the fragments of the data written.
+type merkleWriter struct {
+	verifier *merkleVerifier
+	output   io.Writer
+	index    uint64         // Current fragment
+	position uint64         // Bytes of the current fragment written
+	hasher   *blake3.Hasher // Hash of the current fragment
+}
+
+func (writer *merkleWriter) Write(data []byte) (n int, err error) {
+	for len(data) > 0 {
+		if writer.index >= uint64(len(writer.verifier.hashes)) {
+			return n, errors.New("data exceeds the file size")
+		}
+
+		offset, fragmentSize := writer.verifier.fragmentRange(writer.index)
+		part := data
+		if remaining := fragmentSize - writer.position; uint64(len(part)) > remaining {
+			part = part[:remaining]
+		}
+
+		written, err := writer.output.Write(part)
+		writer.hasher.Write(part[:written])
+		writer.position += uint64(written)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		data = data[written:]
+
+		if writer.position == fragmentSize {
+			if !bytes.Equal(writer.hasher.Sum(nil), writer.verifier.hashes[writer.index]) {
+				return n, &fragmentError{Index: writer.index, Offset: offset}
+			}
+			writer.index++
+			writer.position = 0
+			writer.hasher.Reset()
+		}
+	}
+
+	return n, nil
+}
+
+// commandMerkleExport writes the merkle tree of a file in the local warehouse to the download folder.
+func commandMerkleExport(ctx *commandContext) (terminate bool) {
+	fileHash, valid := ctx.ArgHash(0)
+	if !valid {
+		fmt.Fprintf(ctx.Output, "Invalid file hash.\n")
+		return false
+	}
+
+	_, fileSize, status, _ := ctx.Backend.UserWarehouse.FileExists(fileHash)
+	if status != warehouse.StatusOK {
+		fmt.Fprintf(ctx.Output, "File does not exist in local warehouse: %s\n", hex.EncodeToString(fileHash))
+		return false
+	} else if fileSize <= merkle.MinimumFragmentSize {
+		fmt.Fprintf(ctx.Output, "The file has a single fragment and needs no merkle tree. The merkle root hash is the file hash.\n")
+		return false
+	}
+
+	tree, status, err := ctx.Backend.UserWarehouse.ReadMerkleTree(fileHash, false)
+	if status != warehouse.StatusOK {
+		fmt.Fprintf(ctx.Output, "Error reading merkle tree: %v\n", err)
+		return false
+	}
+
+	target, err := merkleTreePath(ctx.Arg(1), fileHash)
+	if err != nil {
+		fmt.Fprintf(ctx.Output, "Invalid target: %s\n", err.Error())
+		return false
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		fmt.Fprintf(ctx.Output, "Error: %s\n", err.Error())
+		return false
+	} else if err := os.WriteFile(target, tree.Export(), 0644); err != nil {
+		fmt.Fprintf(ctx.Output, "Error writing merkle tree: %s\n", err.Error())
+		return false
+	}
+
+	fmt.Fprintf(ctx.Output, "Merkle tree written to %s\nMerkle Root Hash    %s\nFragment Size       %d\nFragment Count      %d\n", target, hex.EncodeToString(tree.RootHash), tree.FragmentSize, tree.FragmentCount)
+	return false
+}
+
+func init() {
+	registerCommand(&consoleCommand{Name: "merkle export", Args: []commandArg{{Name: "file hash", Prompt: "Enter file hash:"}, {Name: "target", Optional: true}}, Help: "Writes the merkle tree of a file in the local warehouse to the download folder for download --merkle=[file]", Role: roleOperator, Handler: commandMerkleExport})
+}
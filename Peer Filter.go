@@ -0,0 +1,302 @@
+/*
+File Name:  Peer Filter.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Filtering, sorting and paging of the peers shown by "peer list" and the peer table of "status". The options are passed after the command:
+
+--root, --nat, --firewall       Only root peers, peers behind a NAT, peers that reported a firewall. Use =0 for the opposite, for example --root=0.
+--ipv4, --ipv6                  Only peers with an active connection via IPv4 or IPv6.
+--agent=[text]                  User agent contains the text (case insensitive).
+--min-packets=[n]               Minimum count of packets sent and received.
+--sort=rtt|packets|distance     Sort by round-trip time (lowest first), packets (most first) or node ID distance to this peer (closest first).
+--limit=[n] --page=[n]          Limit the output to n peers (max 10000) and show the page (starting with 1).
+--count                         Only show the count of matching peers.
+
+The API endpoint /root/peer/list accepts the same options as query parameters without the dashes, for example ?root=1&sort=rtt&limit=20.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// peerPageSizeDefault is the count of peers per page if a page is requested without limit.
+const peerPageSizeDefault = 50
+
+// Upper limits for the paging options. They keep the offset of the page within the int range.
+const (
+	peerPageSizeMax = 10000
+	peerPageMax     = 1000000
+)
+
+// peerFilter contains the options to filter, sort and page the peer list.
+type peerFilter struct {
+	Root       *bool  // Root peer. Nil for any.
+	NAT        *bool  // Behind NAT. Nil for any.
+	Firewall   *bool  // Firewall reported. Nil for any.
+	IPVersion  int    // 4 or 6 for peers with an active connection via the IP version. 0 for any.
+	UserAgent  string // User agent must contain the text. Lower case.
+	MinPackets uint64 // Minimum count of packets sent and received
+	Sort       string // Sort order: Empty for default, "rtt", "packets" or "distance"
+	Limit      int    // Max count of peers to return. 0 for no limit.
+	Page       int    // Page to return, starting with 1
+	Count      bool   // Only the summary is requested
+}
+
+// peerSummary counts the peers matching the filter.
+type peerSummary struct {
+	Total    int `json:"total"`    // Count of all peers
+	Matched  int `json:"matched"`  // Count of peers matching the filter
+	Root     int `json:"root"`     // Matching root peers
+	NAT      int `json:"nat"`      // Matching peers behind a NAT
+	Firewall int `json:"firewall"` // Matching peers that reported a firewall
+	IPv4     int `json:"ipv4"`     // Matching peers with an active IPv4 connection
+	IPv6     int `json:"ipv6"`     // Matching peers with an active IPv6 connection
+}
+
+// parsePeerFilter parses the options. Unknown options and invalid values return an error.
+func parsePeerFilter(args []string) (filter peerFilter, err error) {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			return filter, fmt.Errorf("invalid option '%s'", arg)
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		name = strings.ToLower(name)
+
+		switch name {
+		case "root", "nat", "firewall":
+			enabled := true
+			if hasValue {
+				if enabled, err = strconv.ParseBool(value); err != nil {
+					return filter, fmt.Errorf("invalid value for option '%s', use 1 or 0", name)
+				}
+			}
+			switch name {
+			case "root":
+				filter.Root = &enabled
+			case "nat":
+				filter.NAT = &enabled
+			case "firewall":
+				filter.Firewall = &enabled
+			}
+
+		case "ipv4":
+			filter.IPVersion = 4
+		case "ipv6":
+			filter.IPVersion = 6
+
+		case "agent":
+			filter.UserAgent = strings.ToLower(value)
+
+		case "min-packets":
+			if filter.MinPackets, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return filter, fmt.Errorf("invalid value for option '%s'", name)
+			}
+
+		case "sort":
+			switch value = strings.ToLower(value); value {
+			case "rtt", "packets", "distance":
+				filter.Sort = value
+			default:
+				return filter, errors.New("invalid sort order, use rtt, packets or distance")
+			}
+
+		case "limit", "page":
+			number, err := strconv.Atoi(value)
+			if err != nil || number < 1 {
+				return filter, fmt.Errorf("invalid value for option '%s'", name)
+			} else if name == "limit" && number > peerPageSizeMax {
+				return filter, fmt.Errorf("limit exceeds the maximum of %d", peerPageSizeMax)
+			} else if name == "page" && number > peerPageMax {
+				return filter, fmt.Errorf("page exceeds the maximum of %d", peerPageMax)
+			}
+			if name == "limit" {
+				filter.Limit = number
+			} else {
+				filter.Page = number
+			}
+
+		case "count":
+			filter.Count = true
+
+		default:
+			return filter, fmt.Errorf("unknown option '%s'", arg)
+		}
+	}
+
+	if filter.Page > 0 && filter.Limit == 0 {
+		filter.Limit = peerPageSizeDefault
+	}
+
+	return filter, nil
+}
+
+// parsePeerFilterQuery parses the options from the query parameters of an API request.
+func parsePeerFilterQuery(query url.Values) (filter peerFilter, err error) {
+	var args []string
+	for name, values := range query {
+		if name == "k" { // API key
+			continue
+		}
+		for _, value := range values {
+			if value == "" {
+				args = append(args, "--"+name)
+			} else {
+				args = append(args, "--"+name+"="+value)
+			}
+		}
+	}
+
+	return parsePeerFilter(args)
+}
+
+// peerIPVersion checks if the peer has an active connection via the IP version.
+func peerIPVersion(peer *core.PeerInfo, ipVersion int) bool {
+	for _, connection := range peer.GetConnections(true) {
+		if isIPv4 := connection.Address.IP.To4() != nil; isIPv4 == (ipVersion == 4) {
+			return true
+		}
+	}
+	return false
+}
+
+// match checks if the peer matches the filter.
+func (filter *peerFilter) match(peer *core.PeerInfo) bool {
+	if filter.Root != nil && peer.IsRootPeer != *filter.Root {
+		return false
+	} else if filter.NAT != nil && peer.IsBehindNAT() != *filter.NAT {
+		return false
+	} else if filter.Firewall != nil && peer.IsFirewallReported() != *filter.Firewall {
+		return false
+	} else if filter.IPVersion != 0 && !peerIPVersion(peer, filter.IPVersion) {
+		return false
+	} else if filter.UserAgent != "" && !strings.Contains(strings.ToLower(peer.UserAgent), filter.UserAgent) {
+		return false
+	} else if peer.StatsPacketSent+peer.StatsPacketReceived < filter.MinPackets {
+		return false
+	}
+
+	return true
+}
+
+// apply returns the matching peers of the requested page in the requested order, and the summary of all matching peers.
+func (filter *peerFilter) apply(backend *core.Backend) (peers []*core.PeerInfo, summary peerSummary) {
+	all := GetPeerlistSorted(backend)
+	summary.Total = len(all)
+
+	for _, peer := range all {
+		if !filter.match(peer) {
+			continue
+		}
+
+		peers = append(peers, peer)
+		summary.Matched++
+		if peer.IsRootPeer {
+			summary.Root++
+		}
+		if peer.IsBehindNAT() {
+			summary.NAT++
+		}
+		if peer.IsFirewallReported() {
+			summary.Firewall++
+		}
+		if peerIPVersion(peer, 4) {
+			summary.IPv4++
+		}
+		if peerIPVersion(peer, 6) {
+			summary.IPv6++
+		}
+	}
+
+	switch filter.Sort {
+	case "rtt": // peers with unknown RTT last
+		sort.SliceStable(peers, func(i, j int) bool {
+			rttI, rttJ := peers[i].GetRTT(), peers[j].GetRTT()
+			if rttI == 0 || rttJ == 0 {
+				return rttJ == 0 && rttI != 0
+			}
+			return rttI < rttJ
+		})
+
+	case "packets":
+		sort.SliceStable(peers, func(i, j int) bool {
+			return peers[i].StatsPacketSent+peers[i].StatsPacketReceived > peers[j].StatsPacketSent+peers[j].StatsPacketReceived
+		})
+
+	case "distance":
+		self := backend.SelfNodeID()
+		sort.SliceStable(peers, func(i, j int) bool {
+			return bytes.Compare(xorDistance(self, peers[i].NodeID), xorDistance(self, peers[j].NodeID)) < 0
+		})
+	}
+
+	if filter.Limit > 0 {
+		page := filter.Page
+		if page < 1 {
+			page = 1
+		}
+		// Compare the page against the page count first, so the offset is only calculated for existing pages.
+		if pages := (len(peers) + filter.Limit - 1) / filter.Limit; page > pages {
+			return nil, summary
+		}
+		start := (page - 1) * filter.Limit
+		end := len(peers)
+		if end-start > filter.Limit {
+			end = start + filter.Limit
+		}
+		peers = peers[start:end]
+	}
+
+	return peers, summary
+}
+
+// xorDistance returns the XOR distance of the node IDs.
+func xorDistance(a, b []byte) (distance []byte) {
+	distance = make([]byte, len(a))
+	for n := range a {
+		if n < len(b) {
+			distance[n] = a[n] ^ b[n]
+		}
+	}
+	return distance
+}
+
+// peerSummaryToA returns the summary as text.
+func peerSummaryToA(summary peerSummary) string {
+	return fmt.Sprintf("Peers: %d of %d match (root %d, NAT %d, firewall %d, IPv4 %d, IPv6 %d)\n", summary.Matched, summary.Total, summary.Root, summary.NAT, summary.Firewall, summary.IPv4, summary.IPv6)
+}
+
+// peerPageToA returns the footer if the output is limited, for example "Showing peers 51-100 of 230. Next page: --page=3".
+func (filter *peerFilter) peerPageToA(count int, summary peerSummary) string {
+	if filter.Limit == 0 || count == summary.Matched {
+		return ""
+	}
+
+	page := filter.Page
+	if page < 1 {
+		page = 1
+	}
+
+	if count == 0 {
+		return fmt.Sprintf("No peers on page %d, %d peers match.\n", page, summary.Matched)
+	}
+
+	start := (page - 1) * filter.Limit // only reached for existing pages
+
+	text := fmt.Sprintf("Showing peers %d-%d of %d.", start+1, start+count, summary.Matched)
+	if start+count < summary.Matched {
+		text += fmt.Sprintf(" Next page: --page=%d", page+1)
+	}
+	return text + "\n"
+}
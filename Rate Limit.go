@@ -0,0 +1,297 @@
+/*
+File Name:  Rate Limit.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Per-client rate limiting for the public statistics web server. Each client IP has a token bucket per rule.
+Rules are matched by the longest path prefix. Requests exceeding the limit are answered with 429 and a Retry-After header.
+Clients on the allowlist (IPs or CIDRs) are never limited.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitRule defines the quota for a path prefix.
+type rateLimitRule struct {
+	Path  string  `yaml:"Path"`  // Path prefix the rule applies to. The longest matching prefix wins. Use "/" for a default rule.
+	Rate  float64 `yaml:"Rate"`  // Sustained requests per second.
+	Burst int     `yaml:"Burst"` // Maximum requests in a burst. This is the bucket size.
+
+	rejected uint64 // Count of rejected requests
+	allowed  uint64 // Count of allowed requests
+}
+
+// tokenBucket is the bucket of a single client for a single rule.
+type tokenBucket struct {
+	tokens   float64   // Current tokens in the bucket
+	last     time.Time // Last time tokens were refilled
+	rejected uint64    // Count of rejected requests of this client
+}
+
+// rateLimitIdleTime is the time after which buckets of inactive clients are removed. The bucket is full again by then anyway in most cases.
+const rateLimitIdleTime = 10 * time.Minute
+
+// rateLimiter holds all rules and buckets.
+type rateLimiter struct {
+	sync.Mutex
+	rules   []*rateLimitRule
+	allow   []*net.IPNet
+	buckets map[rateLimitKey]*tokenBucket
+
+	configRules []rateLimitRule // Rules as configured, to detect changes on reload
+	configAllow []string        // Allow list as configured
+}
+
+type rateLimitKey struct {
+	rule int    // Index of the rule
+	ip   string // Client IP
+}
+
+// statRateLimiter is the rate limiter of the statistics web server. Nil if disabled.
+var statRateLimiter *rateLimiter
+
+// newRateLimiter creates a rate limiter. The allow list contains IPs or CIDRs.
+func newRateLimiter(rules []rateLimitRule, allow []string) (limiter *rateLimiter, err error) {
+	limiter = &rateLimiter{buckets: make(map[rateLimitKey]*tokenBucket), configRules: rules, configAllow: allow}
+
+	if limiter.rules, limiter.allow, err = parseRateLimitRules(rules, allow); err != nil {
+		return nil, err
+	}
+
+	go limiter.cleanup()
+
+	return limiter, nil
+}
+
+// parseRateLimitRules validates the rules and parses the allow list. The returned rules are sorted by path length descending so the first match is the longest prefix.
+func parseRateLimitRules(rules []rateLimitRule, allow []string) (parsedRules []*rateLimitRule, parsedAllow []*net.IPNet, err error) {
+	for n := range rules {
+		rule := rules[n]
+		if rule.Rate <= 0 || rule.Burst <= 0 {
+			return nil, nil, fmt.Errorf("invalid rate limit rule for path '%s': rate and burst must be positive", rule.Path)
+		}
+		parsedRules = append(parsedRules, &rule)
+	}
+
+	sort.SliceStable(parsedRules, func(i, j int) bool { return len(parsedRules[i].Path) > len(parsedRules[j].Path) })
+
+	for _, entry := range allow {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid rate limit allow entry '%s': %v", entry, err)
+		}
+		parsedAllow = append(parsedAllow, network)
+	}
+
+	return parsedRules, parsedAllow, nil
+}
+
+// update replaces the rules and the allow list if they changed. All buckets and counters are reset then. Changed is false if the settings are the same.
+func (limiter *rateLimiter) update(rules []rateLimitRule, allow []string) (changed bool, err error) {
+	limiter.Lock()
+	same := sameRateLimitSettings(limiter.configRules, limiter.configAllow, rules, allow)
+	limiter.Unlock()
+
+	if same {
+		return false, nil
+	}
+
+	parsedRules, parsedAllow, err := parseRateLimitRules(rules, allow)
+	if err != nil {
+		return false, err
+	}
+
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	limiter.rules = parsedRules
+	limiter.allow = parsedAllow
+	limiter.buckets = make(map[rateLimitKey]*tokenBucket)
+	limiter.configRules = rules
+	limiter.configAllow = allow
+
+	return true, nil
+}
+
+// sameRateLimitSettings checks if the rules and allow lists are the same, including the order.
+func sameRateLimitSettings(rulesA []rateLimitRule, allowA []string, rulesB []rateLimitRule, allowB []string) bool {
+	if len(rulesA) != len(rulesB) || len(allowA) != len(allowB) {
+		return false
+	}
+
+	for n := range rulesA {
+		if rulesA[n].Path != rulesB[n].Path || rulesA[n].Rate != rulesB[n].Rate || rulesA[n].Burst != rulesB[n].Burst {
+			return false
+		}
+	}
+	for n := range allowA {
+		if allowA[n] != allowB[n] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isAllowed checks if the IP is on the allowlist.
+func (limiter *rateLimiter) isAllowed(ip net.IP) bool {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	for _, network := range limiter.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// take takes a token from the bucket of the client. If no token is available, it returns the time to wait until the next token.
+func (limiter *rateLimiter) take(path, ip string) (allowed bool, retryAfter time.Duration) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	for n, rule := range limiter.rules {
+		if !strings.HasPrefix(path, rule.Path) {
+			continue
+		}
+
+		now := time.Now()
+		key := rateLimitKey{rule: n, ip: ip}
+
+		bucket, ok := limiter.buckets[key]
+		if !ok {
+			bucket = &tokenBucket{tokens: float64(rule.Burst), last: now}
+			limiter.buckets[key] = bucket
+		}
+
+		// refill
+		bucket.tokens = math.Min(float64(rule.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rule.Rate)
+		bucket.last = now
+
+		if bucket.tokens >= 1 {
+			bucket.tokens--
+			rule.allowed++
+			return true, 0
+		}
+
+		rule.rejected++
+		bucket.rejected++
+
+		return false, time.Duration((1 - bucket.tokens) / rule.Rate * float64(time.Second))
+	}
+
+	// no rule matches
+	return true, 0
+}
+
+// cleanup removes buckets of inactive clients.
+func (limiter *rateLimiter) cleanup() {
+	for {
+		time.Sleep(rateLimitIdleTime)
+
+		threshold := time.Now().Add(-rateLimitIdleTime)
+
+		limiter.Lock()
+		for key, bucket := range limiter.buckets {
+			if bucket.last.Before(threshold) {
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.Unlock()
+	}
+}
+
+// RateLimitMiddleware applies the rate limiter. It returns a middleware function that wraps the entire handler of the web server,
+// so that requests not matching any route are limited too.
+func RateLimitMiddleware(limiter *rateLimiter) func(http.Handler) http.Handler {
+	return (func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+
+			if ip := net.ParseIP(host); ip == nil || !limiter.isAllowed(ip) {
+				if allowed, retryAfter := limiter.take(r.URL.Path, host); !allowed {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					http.Error(w, "Too many requests", http.StatusTooManyRequests)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+func init() {
+	registerCommand(&consoleCommand{Name: "ratelimit status", Help: "Show allowed and rejected requests of the statistics web server", Role: roleReadOnly, Handler: func(ctx *commandContext) bool {
+		if statRateLimiter == nil {
+			fmt.Fprintf(ctx.Output, "Rate limiting is disabled.\n")
+			return false
+		}
+
+		statRateLimiter.Status(ctx.Output)
+		return false
+	}})
+}
+
+// Status prints the counters of allowed and rejected requests per rule and the clients with the most rejected requests.
+func (limiter *rateLimiter) Status(output io.Writer) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	fmt.Fprintf(output, "Path                            Rate/s    Burst   Allowed     Rejected\n")
+	for _, rule := range limiter.rules {
+		fmt.Fprintf(output, "%-30s  %-8.2f  %-6d  %-10d  %-10d\n", rule.Path, rule.Rate, rule.Burst, rule.allowed, rule.rejected)
+	}
+
+	type clientRejected struct {
+		ip       string
+		path     string
+		rejected uint64
+	}
+	var clients []clientRejected
+
+	for key, bucket := range limiter.buckets {
+		if bucket.rejected > 0 {
+			clients = append(clients, clientRejected{ip: key.ip, path: limiter.rules[key.rule].Path, rejected: bucket.rejected})
+		}
+	}
+
+	if len(clients) == 0 {
+		fmt.Fprintf(output, "\nNo clients currently limited.\n")
+		return
+	}
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].rejected > clients[j].rejected })
+	if len(clients) > 20 {
+		clients = clients[:20]
+	}
+
+	fmt.Fprintf(output, "\nClient IP                                 Path                            Rejected\n")
+	for _, client := range clients {
+		fmt.Fprintf(output, "%-40s  %-30s  %d\n", client.ip, client.path, client.rejected)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+File Name:  Shutdown.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Orderly shutdown of the root peer. It is triggered by the exit command or by SIGINT/SIGTERM.
+Pending statistics are written to disk before the process exits. SIGHUP reloads the settings that can change at runtime.
+*/
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// shutdownTimeout is the maximum time active HTTP requests are given to complete.
+const shutdownTimeout = 10 * time.Second
+
+var shutdownOnce sync.Once
+
+// shutdown stops the web servers, flushes all statistics and exits the process. Only the first call has an effect, concurrent callers block until the exit.
+func shutdown(backend *core.Backend, reason string) {
+	shutdownOnce.Do(func() {
+		backend.LogError("shutdown", "graceful exit: %s\n", reason)
+		sdNotify("STOPPING=1")
+
+		shutdownWebServers(shutdownTimeout)
+		shutdownStatistics()
+
+		if accessLog != nil {
+			accessLog.Close()
+		}
+		if auditLog != nil {
+			auditLog.Close()
+		}
+		if localLineEditor != nil {
+			localLineEditor.Close()
+		}
+
+		removePIDFile()
+
+		os.Exit(core.ExitGraceful)
+	})
+
+	// In case of a concurrent call wait until the first caller exits the process.
+	select {}
+}
+
+// handleSignals initiates the shutdown on SIGINT or SIGTERM and reloads the config on SIGHUP.
+func handleSignals(backend *core.Backend) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			changes, err := reloadConfig()
+			if err != nil {
+				backend.LogError("handleSignals", "reloading config: %v\n", err)
+				continue
+			}
+			backend.LogError("handleSignals", "config reloaded: %s\n", strings.Join(changes, ", "))
+			continue
+		}
+
+		shutdown(backend, "received signal "+sig.String())
+	}
+}
@@ -40,7 +40,7 @@ type recordSummaryDaily struct {
 }
 
 // statWriteSummary writes a summary file. It should be called at midnight.
-func statWriteSummary(filename string, summary timeStat) {
+func statWriteSummary(filename string, date time.Time, summary timeStat) {
 	stats, err := os.Stat(filename)
 	header := err != nil && os.IsNotExist(err) || err == nil && stats.Size() == 0
 
@@ -61,9 +61,7 @@ func statWriteSummary(filename string, summary timeStat) {
 	}
 
 	// write as CSV record
-	todayA := time.Now().UTC().Round(time.Hour * 24).Format(dateFormat)
-
-	csvWriter.Write([]string{todayA, strconv.FormatUint(summary.countActive, 10), strconv.FormatUint(summary.countRoot, 10), strconv.FormatUint(summary.countNAT, 10), strconv.FormatUint(summary.countPortForward, 10), strconv.FormatUint(summary.countFirewall, 10)})
+	csvWriter.Write([]string{date.Format(dateFormat), strconv.FormatUint(summary.countActive, 10), strconv.FormatUint(summary.countRoot, 10), strconv.FormatUint(summary.countNAT, 10), strconv.FormatUint(summary.countPortForward, 10), strconv.FormatUint(summary.countFirewall, 10)})
 	csvWriter.Flush()
 }
 
@@ -73,6 +71,7 @@ func statReadSummary(filename string) (records []recordSummaryDaily, err error)
 	if err != nil {
 		return records, err
 	}
+	defer file.Close()
 
 	csvReader := csv.NewReader(file)
 	csvReader.LazyQuotes = true
@@ -120,12 +119,68 @@ func statReadSummary(filename string) (records []recordSummaryDaily, err error)
 	}
 }
 
+// ---- checkpoint of the current day ----
+
+// statWriteCheckpoint writes the statistics of the current (partial) day into the checkpoint file. It replaces any previous checkpoint.
+// It uses the same format as the daily summary file.
+func statWriteCheckpoint(filename string, date time.Time, summary timeStat) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Printf("Error storing checkpoint file '%s': %s\n", filename, err.Error())
+		return
+	}
+	defer file.Close()
+
+	csvWriter := csv.NewWriter(file)
+	csvWriter.UseCRLF = true
+
+	csvWriter.Write(csvHeaderSummaryDaily)
+	csvWriter.Write([]string{date.Format(dateFormat), strconv.FormatUint(summary.countActive, 10), strconv.FormatUint(summary.countRoot, 10), strconv.FormatUint(summary.countNAT, 10), strconv.FormatUint(summary.countPortForward, 10), strconv.FormatUint(summary.countFirewall, 10)})
+	csvWriter.Flush()
+}
+
+// statRecoverCheckpoint checks if a checkpoint from a previous day exists. This happens if the service was not running at midnight.
+// In that case the checkpoint is appended to the summary file. Checkpoints of the current day are ignored since the stats are read from the daily log.
+func statRecoverCheckpoint(summaryFilename string) {
+	filename := path.Join(config.DatabaseFolder, filenameCheckpoint)
+
+	records, err := statReadSummary(filename)
+	if err != nil || len(records) == 0 {
+		return
+	}
+
+	checkpoint := records[len(records)-1]
+	today := time.Now().UTC().Truncate(time.Hour * 24)
+
+	if !checkpoint.Date.Before(today) {
+		return
+	}
+
+	// Summary records are written at midnight and therefore carry the date of the following day.
+	date := checkpoint.Date.Truncate(time.Hour * 24).Add(time.Hour * 24)
+
+	for _, record := range summaryDaily {
+		if record.Date.Equal(date) {
+			os.Remove(filename)
+			return
+		}
+	}
+
+	summaryDaily = append(summaryDaily, recordSummaryDaily{Date: date, stats: checkpoint.stats})
+	statWriteSummary(summaryFilename, date, checkpoint.stats)
+
+	os.Remove(filename)
+}
+
 // ---- full log ----
 
 var csvHeaderFull = []string{"Date", "Peer ID", "Node ID", "IPv4", "IPv4 Port", "IPv4 Reported Internal", "IPv4 Reported External", "IPv6", "IPv6 Port", "IPv6 Reported Internal", "IPv6 Reported External", "User Agent", "Blockchain Height", "Blockchain Version", "Flags"}
 
 var dailyLogMutex sync.Mutex
 
+// dailyLogWriters tracks the go routines writing the daily log files. It is used to wait until all records are flushed.
+var dailyLogWriters sync.WaitGroup
+
 // createDailyLog creates the daily log file which contains records of all new peers.
 // If the file already exists, it will read it to parse the peer IDs. This means that the serivce can be stopped and started anytime.
 func createDailyLog(directory string, records <-chan *peerStat) (filename string, readStats timeStat, err error) {
@@ -182,7 +237,11 @@ func createDailyLog(directory string, records <-chan *peerStat) (filename string
 		csvWriter.Flush()
 	}
 
+	dailyLogWriters.Add(1)
+
 	go func() {
+		defer dailyLogWriters.Done()
+
 		for stat := range records {
 			userAgent := stat.peer.UserAgent
 			blockchainHeightA := strconv.FormatUint(uint64(stat.peer.BlockchainHeight), 10)
@@ -271,7 +330,7 @@ func readDailyFile(filename string, callback func(record []string)) (err error)
 // ---- files served via web server ----
 
 func webStatDailyActive(w http.ResponseWriter, r *http.Request) {
-	CacheControlSetHeader(w, true, 10*60) // 10 minutes
+	CacheControlSetHeader(w, true, settings().CacheMaxAgeCSV)
 
 	csvWriter := csv.NewWriter(w)
 	csvWriter.UseCRLF = true
@@ -38,7 +38,7 @@ func webStatDailyJSON(backend *core.Backend) func(w http.ResponseWriter, r *http
 
 		stats.Today = jsonStatsDay{Date: time.Now().UTC(), Active: dailyStat.countActive, Root: dailyStat.countRoot, NAT: dailyStat.countNAT, PortForward: dailyStat.countPortForward, Firewall: dailyStat.countFirewall}
 
-		CacheControlSetHeader(w, true, 60) // 1 minute
+		CacheControlSetHeader(w, true, settings().CacheMaxAge)
 		webapi.EncodeJSON(backend, w, r, stats)
 	}
 }
@@ -51,23 +51,34 @@ type jsonStatsToday struct {
 	NAT         uint64 `json:"nat"`         // Count of peers behind a NAT
 	PortForward uint64 `json:"portforward"` // Count of peers with port forwarding enabled
 	Firewall    uint64 `json:"firewall"`    // Count of peers reported behind a firewall
+	// Estimates based on HyperLogLog sketches
+	ActiveWeek  uint64 `json:"activeweek"`  // Estimated count of unique active peers in the last 7 days
+	ActiveMonth uint64 `json:"activemonth"` // Estimated count of unique active peers in the last 30 days
 	// File Statistics
 	FilesShared uint64 `json:"filesshared"` // Count of files shared across all blockchains
 	ContentSize uint64 `json:"contentsize"` // Total size of shared content in bytes across all blockchains
 }
 
-func webStatTodayJSON(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		stats := jsonStatsToday{Date: time.Now().UTC(), Active: dailyStat.countActive, Root: dailyStat.countRoot, NAT: dailyStat.countNAT, PortForward: dailyStat.countPortForward, Firewall: dailyStat.countFirewall}
+// localStatsToday returns the current statistics of this root.
+func localStatsToday() (stats jsonStatsToday) {
+	stats = jsonStatsToday{Date: time.Now().UTC(), Active: dailyStat.countActive, Root: dailyStat.countRoot, NAT: dailyStat.countNAT, PortForward: dailyStat.countPortForward, Firewall: dailyStat.countFirewall}
+
+	stats.ActiveWeek = sketchActiveLastDays(7)
+	stats.ActiveMonth = sketchActiveLastDays(30)
 
-		globalBlockchainStats.Lock()
+	globalBlockchainStats.Lock()
+	stats.FilesShared = globalBlockchainStats.CountFileRecords
+	stats.ContentSize = globalBlockchainStats.SizeAllFiles
+	globalBlockchainStats.Unlock()
 
-		stats.FilesShared = globalBlockchainStats.CountFileRecords
-		stats.ContentSize = globalBlockchainStats.SizeAllFiles
+	return stats
+}
 
-		globalBlockchainStats.Unlock()
+func webStatTodayJSON(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := localStatsToday()
 
-		CacheControlSetHeader(w, true, 60) // 1 minute
+		CacheControlSetHeader(w, true, settings().CacheMaxAge)
 		webapi.EncodeJSON(backend, w, r, stats)
 	}
 }
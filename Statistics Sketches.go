@@ -0,0 +1,436 @@
+/*
+File Name:  Statistics Sketches.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+HyperLogLog sketches of active peers per day and per hour, maintained alongside the exact counts.
+The sketches of each day are stored in the database folder next to the daily log as "YYYY_MM_DD.hll": The daily sketch followed by 24 hourly sketches.
+
+Unlike the exact counts, sketches can be merged. This allows estimating the unique active peers per week, per month and across multiple root peers.
+Connected peers are sampled every minute so that the hourly sketches contain all peers active during the hour, not only newly discovered ones.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/PeernetOfficial/core/btcec"
+	"github.com/PeernetOfficial/core/webapi"
+)
+
+const (
+	sketchPrecisionDaily  = 14 // 16 KB per daily sketch, standard error 0.81%
+	sketchPrecisionHourly = 12 // 4 KB per hourly sketch, standard error 1.63%
+	sketchRangeMax        = 62 // Max count of days that can be merged in one request
+	sketchCacheMax        = 62 // Max count of daily sketches of previous days kept in memory. Must be at least sketchRangeMax.
+)
+
+// daySketches are the sketches of a single day.
+type daySketches struct {
+	date   time.Time        // Date (midnight UTC)
+	daily  *hyperLogLog     // Unique peers active during the day
+	hourly [24]*hyperLogLog // Unique peers active during each hour
+}
+
+// todaySketches are the sketches of the current day. Nil if statistics are disabled.
+var todaySketches *daySketches
+var sketchesMutex sync.Mutex
+
+// pastDailySketches caches daily sketches of previous days read from disk, keyed by date. Nil for days without sketch. It holds at most sketchCacheMax entries.
+var pastDailySketches = make(map[time.Time]*hyperLogLog)
+
+// pastMergedSketches caches the merged daily sketches of the previous days for sketchActiveLastDays, keyed by the count of days.
+// Previous days do not change, the cache is valid until midnight.
+var pastMergedSketches = make(map[int]*hyperLogLog)
+var pastMergedDate time.Time // Date the merged sketches were created for
+var pastMergedMutex sync.Mutex
+
+func newDaySketches(date time.Time) (sketches *daySketches) {
+	sketches = &daySketches{date: date, daily: newHyperLogLog(sketchPrecisionDaily)}
+	for n := range sketches.hourly {
+		sketches.hourly[n] = newHyperLogLog(sketchPrecisionHourly)
+	}
+	return sketches
+}
+
+// sketchFilename returns the file name storing the sketches of the day.
+func sketchFilename(date time.Time) string {
+	return path.Join(config.DatabaseFolder, fmt.Sprintf("%d_%02d_%02d.hll", date.Year(), date.Month(), date.Day()))
+}
+
+// initSketches loads the sketches of today and starts sampling the connected peers. Must be called after the daily log was read.
+func initSketches(backend *core.Backend) {
+	today := time.Now().UTC().Truncate(time.Hour * 24)
+
+	sketches, err := readDaySketches(sketchFilename(today))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading sketch file '%s': %s\n", sketchFilename(today), err.Error())
+		}
+		sketches = newDaySketches(today)
+	}
+	sketches.date = today
+
+	// Peers from the daily log are added to the daily sketch. Their hour is unknown.
+	todayPeersMutex.Lock()
+	for peerID := range todayPeers {
+		sketches.daily.Add(peerID[:])
+	}
+	todayPeersMutex.Unlock()
+
+	sketchesMutex.Lock()
+	todaySketches = sketches
+	sketchesMutex.Unlock()
+
+	go func() {
+		for minute := 1; ; minute++ {
+			time.Sleep(time.Minute)
+
+			for _, peer := range backend.PeerlistGet() {
+				peerID := publicKey2Compressed(peer.PublicKey)
+				sketchAdd(peerID, time.Now().UTC())
+			}
+
+			if minute%10 == 0 {
+				sketchesWrite()
+			}
+		}
+	}()
+}
+
+// sketchAdd adds the peer to todays daily and hourly sketch. At the first call after midnight the sketches of the previous day are written and new ones started.
+func sketchAdd(peerID [btcec.PubKeyBytesLenCompressed]byte, now time.Time) {
+	hash := hyperLogLogHash(peerID[:])
+
+	sketchesMutex.Lock()
+	defer sketchesMutex.Unlock()
+
+	if todaySketches == nil {
+		return
+	}
+
+	if date := now.Truncate(time.Hour * 24); !date.Equal(todaySketches.date) {
+		if err := todaySketches.write(sketchFilename(todaySketches.date)); err != nil {
+			log.Printf("Error writing sketch file '%s': %s\n", sketchFilename(todaySketches.date), err.Error())
+		}
+		cachePastSketch(todaySketches.date, todaySketches.daily)
+		todaySketches = newDaySketches(date)
+	}
+
+	todaySketches.daily.AddHash(hash)
+	todaySketches.hourly[now.Hour()].AddHash(hash)
+}
+
+// sketchesWrite writes todays sketches to disk.
+func sketchesWrite() {
+	sketchesMutex.Lock()
+	defer sketchesMutex.Unlock()
+
+	if todaySketches == nil {
+		return
+	}
+
+	if err := todaySketches.write(sketchFilename(todaySketches.date)); err != nil {
+		log.Printf("Error writing sketch file '%s': %s\n", sketchFilename(todaySketches.date), err.Error())
+	}
+}
+
+// write stores the sketches into the file. A temporary file is used so that a crash does not leave a partial file.
+func (sketches *daySketches) write(filename string) (err error) {
+	var data []byte
+	for _, sketch := range append([]*hyperLogLog{sketches.daily}, sketches.hourly[:]...) {
+		encoded, _ := sketch.MarshalBinary()
+		data = append(data, encoded...)
+	}
+
+	if err = os.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(filename+".tmp", filename)
+}
+
+// readDaySketches reads the sketches from the file.
+func readDaySketches(filename string) (sketches *daySketches, err error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*hyperLogLog
+	for len(data) > 0 {
+		if data[0] < 4 || data[0] > 16 || 1+1<<data[0] > len(data) {
+			return nil, fmt.Errorf("invalid sketch encoding")
+		}
+		size := 1 + 1<<data[0]
+
+		sketch := &hyperLogLog{}
+		if err = sketch.UnmarshalBinary(data[:size]); err != nil {
+			return nil, err
+		}
+		list = append(list, sketch)
+		data = data[size:]
+	}
+
+	if len(list) != 25 {
+		return nil, fmt.Errorf("invalid count of sketches %d", len(list))
+	}
+
+	sketches = &daySketches{daily: list[0]}
+	copy(sketches.hourly[:], list[1:])
+
+	return sketches, nil
+}
+
+// readDailySketch reads only the daily sketch from the file, which is stored first.
+func readDailySketch(filename string) (sketch *hyperLogLog, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var precision [1]byte
+	if _, err = io.ReadFull(file, precision[:]); err != nil {
+		return nil, err
+	} else if precision[0] < 4 || precision[0] > 16 {
+		return nil, fmt.Errorf("invalid sketch encoding")
+	}
+
+	data := make([]byte, 1+1<<precision[0])
+	data[0] = precision[0]
+	if _, err = io.ReadFull(file, data[1:]); err != nil {
+		return nil, err
+	}
+
+	sketch = &hyperLogLog{}
+	if err = sketch.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return sketch, nil
+}
+
+// sketchDaily returns a copy of the daily sketch of the given date. Nil if not available.
+// The file is read without holding sketchesMutex, so that reading previous days does not block recording.
+func sketchDaily(date time.Time) *hyperLogLog {
+	sketchesMutex.Lock()
+	if todaySketches != nil && date.Equal(todaySketches.date) {
+		sketch := todaySketches.daily.Clone()
+		sketchesMutex.Unlock()
+		return sketch
+	}
+	sketch, cached := pastDailySketches[date]
+	sketchesMutex.Unlock()
+
+	if cached {
+		if sketch == nil {
+			return nil
+		}
+		return sketch.Clone()
+	}
+
+	if config.DatabaseFolder == "" || !date.Before(time.Now().UTC().Truncate(time.Hour*24)) {
+		return nil
+	}
+
+	sketch, err := readDailySketch(sketchFilename(date))
+	if err != nil && !os.IsNotExist(err) {
+		return nil // Not cached as missing, the file may be in use.
+	}
+
+	sketchesMutex.Lock()
+	if _, ok := pastDailySketches[date]; !ok { // the day may have been cached at midnight in the meantime
+		cachePastSketch(date, sketch)
+	}
+	sketchesMutex.Unlock()
+
+	if sketch == nil {
+		return nil
+	}
+	return sketch.Clone()
+}
+
+// cachePastSketch adds the daily sketch of a previous day to the cache. If the cache is full, the sketch of the oldest day is removed.
+// The caller must hold sketchesMutex.
+func cachePastSketch(date time.Time, sketch *hyperLogLog) {
+	if _, ok := pastDailySketches[date]; !ok && len(pastDailySketches) >= sketchCacheMax {
+		var oldest time.Time
+		for cached := range pastDailySketches {
+			if oldest.IsZero() || cached.Before(oldest) {
+				oldest = cached
+			}
+		}
+		delete(pastDailySketches, oldest)
+	}
+
+	pastDailySketches[date] = sketch
+}
+
+// sketchRange merges the daily sketches of all days from (inclusive) to (inclusive). Days without sketch are skipped.
+func sketchRange(from, to time.Time) (merged *hyperLogLog, days int) {
+	merged = newHyperLogLog(sketchPrecisionDaily)
+
+	for date := from; !date.After(to); date = date.Add(time.Hour * 24) {
+		if sketch := sketchDaily(date); sketch != nil && merged.Merge(sketch) == nil {
+			days++
+		}
+	}
+
+	return merged, days
+}
+
+// sketchActiveLastDays returns the estimated count of unique active peers in the last days including today.
+// The merged sketch of the previous days is cached until midnight, only today's sketch is merged per call.
+func sketchActiveLastDays(days int) uint64 {
+	today := time.Now().UTC().Truncate(time.Hour * 24)
+
+	pastMergedMutex.Lock()
+	if !pastMergedDate.Equal(today) {
+		pastMergedSketches = make(map[int]*hyperLogLog)
+		pastMergedDate = today
+	}
+	past, ok := pastMergedSketches[days]
+	if !ok {
+		past, _ = sketchRange(today.AddDate(0, 0, -(days-1)), today.AddDate(0, 0, -1))
+		pastMergedSketches[days] = past
+	}
+	merged := past.Clone()
+	pastMergedMutex.Unlock()
+
+	if sketch := sketchDaily(today); sketch != nil {
+		merged.Merge(sketch)
+	}
+	return merged.Estimate()
+}
+
+// shutdownSketches writes todays sketches and stops recording.
+func shutdownSketches() {
+	sketchesWrite()
+
+	sketchesMutex.Lock()
+	todaySketches = nil
+	sketchesMutex.Unlock()
+}
+
+// ---- API ----
+
+type jsonSketch struct {
+	From      time.Time `json:"from"`      // First date (inclusive)
+	To        time.Time `json:"to"`        // Last date (inclusive)
+	Days      int       `json:"days"`      // Count of days with a sketch in the range
+	Estimate  uint64    `json:"estimate"`  // Estimated count of unique active peers
+	Precision uint8     `json:"precision"` // Precision of the sketch
+	Sketch    []byte    `json:"sketch"`    // Encoded sketch: Precision byte followed by the registers. Base64 in JSON.
+}
+
+type jsonSketchHour struct {
+	Hour      int    `json:"hour"`      // Hour (UTC)
+	Estimate  uint64 `json:"estimate"`  // Estimated count of unique active peers
+	Precision uint8  `json:"precision"` // Precision of the sketch
+	Sketch    []byte `json:"sketch"`    // Encoded sketch
+}
+
+type jsonSketchHourly struct {
+	Date  time.Time        `json:"date"`  // Date
+	Hours []jsonSketchHour `json:"hours"` // Sketches per hour
+}
+
+// parseSketchDate parses a date parameter in the format YYYY-MM-DD. If empty, the default is returned.
+func parseSketchDate(text string, defaultDate time.Time) (date time.Time, err error) {
+	if text == "" {
+		return defaultDate, nil
+	}
+	return time.Parse("2006-01-02", text)
+}
+
+/*
+webStatSketchJSON returns the merged daily sketch of a date range.
+
+Request:    GET /stat/sketch.json?from=[date]&to=[date]
+
+	Dates are in the format YYYY-MM-DD (UTC). Both default to today.
+
+Response:   200 with JSON structure jsonSketch
+
+	400 if the dates are invalid or the range exceeds 62 days
+*/
+func webStatSketchJSON(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		today := time.Now().UTC().Truncate(time.Hour * 24)
+
+		from, err1 := parseSketchDate(r.URL.Query().Get("from"), today)
+		to, err2 := parseSketchDate(r.URL.Query().Get("to"), today)
+		if err1 != nil || err2 != nil || to.Before(from) || to.Sub(from) >= sketchRangeMax*time.Hour*24 {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		merged, days := sketchRange(from, to)
+		encoded, _ := merged.MarshalBinary()
+
+		CacheControlSetHeader(w, true, settings().CacheMaxAge)
+		webapi.EncodeJSON(backend, w, r, jsonSketch{From: from, To: to, Days: days, Estimate: merged.Estimate(), Precision: merged.precision, Sketch: encoded})
+	}
+}
+
+/*
+webStatSketchHourlyJSON returns the hourly sketches of a single day.
+
+Request:    GET /stat/sketch/hourly.json?date=[date]
+
+	The date is in the format YYYY-MM-DD (UTC) and defaults to today.
+
+Response:   200 with JSON structure jsonSketchHourly
+
+	400 if the date is invalid
+	404 if no sketches are available for the date
+*/
+func webStatSketchHourlyJSON(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		today := time.Now().UTC().Truncate(time.Hour * 24)
+
+		date, err := parseSketchDate(r.URL.Query().Get("date"), today)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		var hourly [24]*hyperLogLog
+
+		sketchesMutex.Lock()
+		if todaySketches != nil && date.Equal(todaySketches.date) {
+			for n := range hourly {
+				hourly[n] = todaySketches.hourly[n].Clone()
+			}
+		}
+		sketchesMutex.Unlock()
+
+		if hourly[0] == nil {
+			sketches, err := readDaySketches(sketchFilename(date))
+			if err != nil {
+				http.Error(w, "", http.StatusNotFound)
+				return
+			}
+			hourly = sketches.hourly
+		}
+
+		result := jsonSketchHourly{Date: date}
+		for n, sketch := range hourly {
+			encoded, _ := sketch.MarshalBinary()
+			result.Hours = append(result.Hours, jsonSketchHour{Hour: n, Estimate: sketch.Estimate(), Precision: sketch.precision, Sketch: encoded})
+		}
+
+		CacheControlSetHeader(w, true, settings().CacheMaxAge)
+		webapi.EncodeJSON(backend, w, r, result)
+	}
+}
@@ -5,6 +5,7 @@ Author:     Peter Kleissner
 
 Code to collect the necessary data for creating the KPIs:
 * Daily active peers
+* Estimated unique active peers per hour, day, week and month via HyperLogLog sketches
 * Full log of new peers
 
 Every 10 second it will write the statistics file. This gives incoming peers some time to connect to both IPv4 and IPv6.
@@ -25,6 +26,7 @@ import (
 )
 
 const filenameDailySummary = "Daily Active Peers.csv"
+const filenameCheckpoint = "Today Checkpoint.csv"
 
 type peerStat struct {
 	added         time.Time                            // Added to the list of stats
@@ -60,20 +62,26 @@ var dailyStat timeStat
 // summaryDaily contains all daily records
 var summaryDaily []recordSummaryDaily
 
+// All new peers waiting to be added to the CSV list after the wait time.
+// Waiting makes sure that both IPv4 and IPv6 connections are recorded.
+var statQueue map[[btcec.PubKeyBytesLenCompressed]byte]*peerStat
+var statQueueMutex sync.Mutex
+
+// newRecordsChan receives all records to be written to the daily log. It is replaced at midnight.
+var newRecordsChan chan *peerStat
+var newRecordsChanMutex sync.Mutex
+
+// statCron runs the midnight job. It is stopped on shutdown.
+var statCron *cron.Cron
+
 func initStatistics(backend *core.Backend) {
 	if config.DatabaseFolder == "" {
 		return
 	}
 
 	todayPeers = make(map[[btcec.PubKeyBytesLenCompressed]byte]struct{})
-
-	// All new peers waiting to be added to the CSV list after the wait time.
-	// Waiting makes sure that both IPv4 and IPv6 connections are recorded.
-	statQueue := make(map[[btcec.PubKeyBytesLenCompressed]byte]*peerStat)
-	var statQueueMutex sync.Mutex
-
-	newRecordsChan := make(chan *peerStat)
-	var newRecordsChanMutex sync.Mutex
+	statQueue = make(map[[btcec.PubKeyBytesLenCompressed]byte]*peerStat)
+	newRecordsChan = make(chan *peerStat)
 
 	var err error
 	var filename string
@@ -84,16 +92,22 @@ func initStatistics(backend *core.Backend) {
 		return
 	}
 
+	initSketches(backend)
+
 	// Read the daily summary file.
 	summaryDailyFilename := path.Join(config.DatabaseFolder, filenameDailySummary)
 	summaryDaily, err = statReadSummary(summaryDailyFilename)
 
+	// If the service was not running at midnight, the summary of the last day is recovered from the checkpoint.
+	statRecoverCheckpoint(summaryDailyFilename)
+
 	// Every midnight create a new database file.
-	c := cron.New(cron.WithLocation(time.UTC))
-	c.AddFunc("0 0 * * *", func() {
+	statCron = cron.New(cron.WithLocation(time.UTC))
+	statCron.AddFunc("0 0 * * *", func() {
 		// write last day into summary file "Daily Active Peers.csv"
-		summaryDaily = append(summaryDaily, recordSummaryDaily{Date: time.Now().UTC().Round(time.Hour * 24), stats: dailyStat})
-		statWriteSummary(summaryDailyFilename, dailyStat)
+		date := time.Now().UTC().Round(time.Hour * 24)
+		summaryDaily = append(summaryDaily, recordSummaryDaily{Date: date, stats: dailyStat})
+		statWriteSummary(summaryDailyFilename, date, dailyStat)
 
 		// reset daily peer list and counter
 		todayPeersMutex.Lock()
@@ -119,15 +133,20 @@ func initStatistics(backend *core.Backend) {
 		// Process all current connected peers
 		statQueueCurrentPeers(backend)
 	})
-	c.Start()
+	statCron.Start()
 
 	// register the filter to be called each time a new peer is discovered
 	backend.Filters.NewPeer = func(peer *core.PeerInfo, connection *core.Connection) {
 		// New peers are added to the wait list, and after 10 seconds written into the file.
 		// This gives peers a little bit of time to connect both via IPv4 and IPv6.
 		peerID := publicKey2Compressed(peer.PublicKey)
+		sketchAdd(peerID, time.Now().UTC())
+
 		todayPeersMutex.Lock()
 		_, ok := todayPeers[peerID]
+		if !ok {
+			todayPeers[peerID] = struct{}{}
+		}
 		todayPeersMutex.Unlock()
 		if ok {
 			return
@@ -140,8 +159,9 @@ func initStatistics(backend *core.Backend) {
 			peer:       peer,
 		}
 
-		todayPeers[peerID] = struct{}{}
+		statQueueMutex.Lock()
 		statQueue[peerID] = stat
+		statQueueMutex.Unlock()
 	}
 
 	// filter for each new peer connection
@@ -168,47 +188,75 @@ func initStatistics(backend *core.Backend) {
 		for {
 			time.Sleep(time.Second * peerWaitTime)
 
-			threshold := time.Now().Add(-time.Second * peerWaitTime)
-			statQueueMutex.Lock()
-
-			for id, stat := range statQueue {
-				if stat.added.After(threshold) {
-					continue
-				}
-				delete(statQueue, id)
-
-				// process
-				stat.isNAT = (stat.connection4 != nil && stat.connection4.IsBehindNAT()) || (stat.connection6 != nil && stat.connection6.IsBehindNAT())
-				stat.isPortForward = (stat.connection4 != nil && stat.connection4.IsPortForward()) || (stat.connection6 != nil && stat.connection6.IsPortForward())
-				stat.isFirewall = stat.peer.IsFirewallReported()
-
-				// register the counts
-				dailyStat.countActive++
-
-				if stat.isRootPeer {
-					dailyStat.countRoot++
-				}
-				if stat.isNAT {
-					dailyStat.countNAT++
-				}
-				if stat.isPortForward {
-					dailyStat.countPortForward++
-				}
-				if stat.isFirewall {
-					dailyStat.countFirewall++
-				}
-
-				// send as record
-				newRecordsChanMutex.Lock()
-				newRecordsChan <- stat
-				newRecordsChanMutex.Unlock()
-			}
-
-			statQueueMutex.Unlock()
+			statQueueProcess(time.Now().Add(-time.Second * peerWaitTime))
 		}
 	}()
 }
 
+// statQueueProcess counts and writes out all queued peers that were added before the threshold.
+// A zero threshold processes the entire queue which is used when draining it on shutdown.
+func statQueueProcess(threshold time.Time) {
+	statQueueMutex.Lock()
+	defer statQueueMutex.Unlock()
+
+	for id, stat := range statQueue {
+		if !threshold.IsZero() && stat.added.After(threshold) {
+			continue
+		}
+		delete(statQueue, id)
+
+		// process
+		stat.isNAT = (stat.connection4 != nil && stat.connection4.IsBehindNAT()) || (stat.connection6 != nil && stat.connection6.IsBehindNAT())
+		stat.isPortForward = (stat.connection4 != nil && stat.connection4.IsPortForward()) || (stat.connection6 != nil && stat.connection6.IsPortForward())
+		stat.isFirewall = stat.peer.IsFirewallReported()
+
+		// register the counts
+		dailyStat.countActive++
+
+		if stat.isRootPeer {
+			dailyStat.countRoot++
+		}
+		if stat.isNAT {
+			dailyStat.countNAT++
+		}
+		if stat.isPortForward {
+			dailyStat.countPortForward++
+		}
+		if stat.isFirewall {
+			dailyStat.countFirewall++
+		}
+
+		// send as record
+		newRecordsChanMutex.Lock()
+		newRecordsChan <- stat
+		newRecordsChanMutex.Unlock()
+	}
+}
+
+// shutdownStatistics stops the midnight job, drains the queue, flushes the daily log and writes a checkpoint of todays statistics.
+func shutdownStatistics() {
+	if statCron == nil {
+		return
+	}
+
+	// Wait for a running midnight job to finish so the log file is not swapped during shutdown.
+	<-statCron.Stop().Done()
+
+	statQueueProcess(time.Time{})
+
+	// Closing the channel makes the writer flush and close the file.
+	newRecordsChanMutex.Lock()
+	close(newRecordsChan)
+	newRecordsChan = make(chan *peerStat)
+	newRecordsChanMutex.Unlock()
+
+	dailyLogWriters.Wait()
+
+	statWriteCheckpoint(path.Join(config.DatabaseFolder, filenameCheckpoint), time.Now().UTC(), dailyStat)
+
+	shutdownSketches()
+}
+
 func publicKey2Compressed(publicKey *btcec.PublicKey) [btcec.PubKeyBytesLenCompressed]byte {
 	var key [btcec.PubKeyBytesLenCompressed]byte
 	copy(key[:], publicKey.SerializeCompressed())
@@ -0,0 +1,265 @@
+/*
+File Name:  Transfer Control.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Progress and ETA of file transfers, the live transfer monitor "transfer watch" and "transfer cancel" to terminate a transfer.
+
+Transfers are identified by their lite ID. The shortened form shown by "transfer list" (for example "1a2b...9f0e") and unique prefixes are accepted.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/PeernetOfficial/core/protocol"
+	"github.com/PeernetOfficial/core/udt"
+)
+
+// transferHeaderSize is the size of the header sent before the file data.
+const transferHeaderSize = 16
+
+// Settings for transfer watch and cancel.
+const (
+	transferWatchIntervalDefault = 2 * time.Second        // Default refresh interval of transfer watch
+	transferCancelWait           = 2 * time.Second        // Max time to wait for the transfer to report the terminate reason
+	transferCancelPoll           = 100 * time.Millisecond // Interval to check the terminate reason
+)
+
+// transferProgress returns the transferred and the expected bytes of the file data. Total is 0 if not known.
+func transferProgress(fileStats *core.FileTransferStats) (done, total uint64) {
+	if fileStats.UDTConn == nil {
+		return 0, 0
+	}
+
+	metrics := fileStats.UDTConn.Metrics
+	switch fileStats.Direction {
+	case core.DirectionIn:
+		done = metrics.DataReceived
+	case core.DirectionOut:
+		done = metrics.DataSent
+	default:
+		return 0, 0
+	}
+
+	if done >= transferHeaderSize {
+		done -= transferHeaderSize
+	} else {
+		done = 0
+	}
+
+	if fileStats.FileSize > fileStats.Offset {
+		total = fileStats.FileSize - fileStats.Offset
+	}
+	if fileStats.Limit > 0 && (total == 0 || fileStats.Limit < total) {
+		total = fileStats.Limit
+	}
+
+	return done, total
+}
+
+// transferETA returns the progress in percent and the estimated remaining time of the file transfer. Valid is false if not known.
+// The ETA is calculated from the remaining bytes and the current speed reported by UDT.
+func transferETA(fileStats *core.FileTransferStats) (percent float64, eta time.Duration, validPercent, validETA bool) {
+	done, total := transferProgress(fileStats)
+	if total == 0 {
+		return 0, 0, false, false
+	}
+
+	percent = float64(done) * 100 / float64(total)
+	if done >= total {
+		return percent, 0, true, true
+	}
+
+	speed := fileStats.UDTConn.Metrics.SpeedReceive
+	if fileStats.Direction == core.DirectionOut {
+		speed = fileStats.UDTConn.Metrics.SpeedSend
+	}
+	if speed <= 0 {
+		return percent, 0, true, false
+	}
+
+	eta = time.Duration(float64(total-done) / speed * float64(time.Second))
+	return percent, eta, true, true
+}
+
+// etaToA returns the ETA as text, for example "1m30s". "?" if not known.
+func etaToA(eta time.Duration, valid bool) string {
+	if !valid {
+		return "?"
+	}
+	return eta.Round(time.Second).String()
+}
+
+// findLiteSession finds the transfer by lite ID. The full ID, a unique prefix, or the shortened form "1a2b...9f0e" is accepted.
+func findLiteSession(backend *core.Backend, text string) (session *protocol.LiteID, virtualConn *core.VirtualPacketConn, err error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if text == "" {
+		return nil, nil, errors.New("missing lite ID")
+	}
+
+	prefix, suffix, _ := strings.Cut(text, "...")
+
+	for _, s := range backend.LiteSessions() {
+		conn, ok := s.Data.(*core.VirtualPacketConn)
+		if !ok {
+			continue
+		}
+
+		id := s.ID.String()
+		if !strings.HasPrefix(id, prefix) || !strings.HasSuffix(id, suffix) {
+			continue
+		} else if session != nil {
+			return nil, nil, errors.New("lite ID is ambiguous, use more characters")
+		}
+		session, virtualConn = s, conn
+	}
+
+	if session == nil {
+		return nil, nil, errors.New("transfer not found")
+	}
+
+	return session, virtualConn, nil
+}
+
+// cancelTransfer terminates the transfer via the UDT connection, or the virtual connection if UDT is not yet established.
+// It waits until the terminate reason is known and returns it.
+func cancelTransfer(virtualConn *core.VirtualPacketConn) (reason int, alreadyTerminated bool) {
+	if reason = virtualConn.GetTerminateReason(); reason > 0 {
+		return reason, true
+	}
+
+	var udtConn *udt.UDTSocket
+	switch stats := virtualConn.Stats.(type) {
+	case *core.FileTransferStats:
+		udtConn = stats.UDTConn
+	case *core.BlockTransferStats:
+		udtConn = stats.UDTConn
+	}
+
+	if udtConn != nil {
+		udtConn.Terminate()
+	} else {
+		virtualConn.Close(udt.TerminateReasonSignal)
+	}
+
+	for waited := time.Duration(0); waited < transferCancelWait; waited += transferCancelPoll {
+		if reason = virtualConn.GetTerminateReason(); reason > 0 {
+			break
+		}
+		time.Sleep(transferCancelPoll)
+	}
+
+	return reason, false
+}
+
+// completeLiteIDs returns the lite IDs of all transfers for completion.
+func completeLiteIDs(backend *core.Backend) (ids []string) {
+	for _, session := range backend.LiteSessions() {
+		if _, ok := session.Data.(*core.VirtualPacketConn); ok {
+			ids = append(ids, session.ID.String())
+		}
+	}
+	return ids
+}
+
+// activeTransfers returns the count of transfers that are not terminated.
+func activeTransfers(backend *core.Backend) (count int) {
+	for _, session := range backend.LiteSessions() {
+		if virtualConn, ok := session.Data.(*core.VirtualPacketConn); ok && virtualConn.GetTerminateReason() == 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// commandTransferWatch shows the transfer list periodically. The optional argument sets the interval in seconds.
+// In interactive sessions it stops when Enter is pressed. In batch sessions and scripts it stops when no transfer is active, so that following commands are not consumed.
+func commandTransferWatch(ctx *commandContext) (terminate bool) {
+	interval := transferWatchIntervalDefault
+	if ctx.Arg(0) != "" {
+		seconds, err := strconv.Atoi(ctx.Arg(0))
+		if err != nil || seconds < 1 {
+			ctx.writeError("Invalid interval, use seconds.")
+			return false
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+
+	interactive := !ctx.Session.Batch && len(ctx.Reader.lines) == 0
+
+	// In interactive sessions any input stops the watch. The input is read only by this goroutine until the watch ends.
+	stop := make(chan bool, 1)
+	if interactive {
+		go func() {
+			_, _, terminate := readUserText(ctx.Reader, ctx.TerminateSignal)
+			stop <- terminate
+		}()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if ctx.Reader.jsonOutput() {
+			writeJSON(ctx.Output, consoleTransferListJSON(ctx.Backend))
+		} else {
+			stopText := "press Enter to stop"
+			if !interactive {
+				stopText = "until all transfers are finished"
+			}
+			fmt.Fprintf(ctx.Output, "---- %s, refresh every %s, %s ----\n", time.Now().Format(dateFormat), interval.String(), stopText)
+			commandTransferList(ctx)
+		}
+
+		if !interactive && activeTransfers(ctx.Backend) == 0 {
+			return false
+		}
+
+		select {
+		case terminate = <-stop:
+			return terminate
+		case <-ctx.TerminateSignal:
+			return true
+		case <-ticker.C:
+		}
+	}
+}
+
+// commandTransferCancel terminates the transfer and reports the terminate reason.
+func commandTransferCancel(ctx *commandContext) (terminate bool) {
+	session, virtualConn, err := findLiteSession(ctx.Backend, ctx.Arg(0))
+	if err != nil {
+		ctx.writeError("Error: " + err.Error())
+		return false
+	}
+
+	reason, alreadyTerminated := cancelTransfer(virtualConn)
+
+	if ctx.Reader.jsonOutput() {
+		writeJSON(ctx.Output, transferCancelJSON(session, reason, alreadyTerminated))
+		return false
+	}
+
+	switch {
+	case alreadyTerminated:
+		fmt.Fprintf(ctx.Output, "Transfer %s was already terminated: %s (%d)\n", session.ID.String(), translateTerminateReason(reason), reason)
+	case reason == 0:
+		fmt.Fprintf(ctx.Output, "Transfer %s was signaled to terminate, but did not report a terminate reason yet.\n", session.ID.String())
+	default:
+		fmt.Fprintf(ctx.Output, "Transfer %s terminated: %s (%d)\n", session.ID.String(), translateTerminateReason(reason), reason)
+	}
+
+	return false
+}
+
+func init() {
+	registerCommand(&consoleCommand{Name: "transfer watch", Args: []commandArg{{Name: "interval", Optional: true}}, Help: "Refreshes the list of transfers until Enter is pressed. Optional interval in seconds, default 2.", Role: roleReadOnly, Handler: commandTransferWatch})
+	registerCommand(&consoleCommand{Name: "transfer cancel", Args: []commandArg{{Name: "lite ID", Complete: completeLiteIDs, Prompt: "Enter the lite ID of the transfer as shown by transfer list:"}}, Help: "Terminates a transfer and shows the reason", Role: roleOperator, Handler: commandTransferCancel})
+}
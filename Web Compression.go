@@ -0,0 +1,348 @@
+/*
+File Name:  Web Compression.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Response compression for the statistics web server. Supported encodings are brotli and gzip, negotiated via the Accept-Encoding header.
+Responses smaller than the minimum size are sent uncompressed, since the overhead is not worth it.
+Static web files can be precompressed as "file.br" or "file.gz" next to the original file and are served as-is. Like dynamic compression,
+precompressed files are only served if HTTPCompression is enabled. All responses that depend on the Accept-Encoding header set "Vary: Accept-Encoding".
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressionMinSizeDefault is the default threshold in bytes if none is set in the config.
+const compressionMinSizeDefault = 1024
+
+const (
+	encodingIdentity = ""
+	encodingGzip     = "gzip"
+	encodingBrotli   = "br"
+)
+
+// acceptedEncodings parses the Accept-Encoding header and returns the quality values for brotli and gzip. A value of 0 means not accepted.
+func acceptedEncodings(acceptEncoding string) (qualityBrotli, qualityGzip float64) {
+	qualityBrotli, qualityGzip = -1, -1
+	qualityAny := 0.0
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		quality := 1.0
+
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if q, err := strconv.ParseFloat(params[2:], 64); err == nil {
+				quality = q
+			}
+		}
+
+		switch name {
+		case encodingBrotli:
+			qualityBrotli = quality
+		case encodingGzip:
+			qualityGzip = quality
+		case "*":
+			qualityAny = quality
+		}
+	}
+
+	// the wildcard applies to all encodings not explicitly listed
+	if qualityBrotli < 0 {
+		qualityBrotli = qualityAny
+	}
+	if qualityGzip < 0 {
+		qualityGzip = qualityAny
+	}
+
+	return qualityBrotli, qualityGzip
+}
+
+// negotiateEncoding returns the preferred encoding accepted by the client. Brotli is preferred over gzip if both have the same quality value.
+func negotiateEncoding(acceptEncoding string) (encoding string) {
+	qualityBrotli, qualityGzip := acceptedEncodings(acceptEncoding)
+
+	if qualityBrotli > 0 && qualityBrotli >= qualityGzip {
+		return encodingBrotli
+	} else if qualityGzip > 0 {
+		return encodingGzip
+	}
+
+	return encodingIdentity
+}
+
+// isCompressibleType checks if the content type benefits from compression. Images, archives and videos are already compressed.
+func isCompressibleType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/xhtml+xml", "image/svg+xml", "application/wasm":
+		return true
+	}
+
+	return false
+}
+
+// CompressionMiddleware compresses responses with brotli or gzip if the client supports it. Responses below MinSize bytes are sent uncompressed.
+// It returns a middleware function to be used with mux.Router.Use().
+func CompressionMiddleware(MinSize int) func(http.Handler) http.Handler {
+	if MinSize <= 0 {
+		MinSize = compressionMinSizeDefault
+	}
+
+	return (func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			setVaryEncoding(w.Header())
+
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+
+			// Range requests return partial content which cannot be compressed on the fly. HEAD requests have no body.
+			if encoding == encodingIdentity || r.Header.Get("Range") != "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: MinSize}
+			defer cw.Close()
+
+			next.ServeHTTP(cw, r)
+		})
+	})
+}
+
+// compressWriter buffers the response until the minimum size is reached and then decides whether to compress.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding   string         // Negotiated encoding
+	minSize    int            // Minimum size of the response to compress
+	buffer     []byte         // Buffered data until the decision is made
+	status     int            // Status code to send. 0 if WriteHeader was not called yet.
+	decided    bool           // Whether the decision to compress was made and headers were sent
+	compressor io.WriteCloser // Compressor if compression is used
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(data []byte) (n int, err error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	if cw.decided {
+		if cw.compressor != nil {
+			return cw.compressor.Write(data)
+		}
+		return cw.ResponseWriter.Write(data)
+	}
+
+	cw.buffer = append(cw.buffer, data...)
+	if len(cw.buffer) < cw.minSize {
+		return len(data), nil
+	}
+
+	if err = cw.decide(true); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// decide sends the headers and the buffered data. Compression is only used if the threshold is reached and the content is compressible.
+func (cw *compressWriter) decide(thresholdReached bool) (err error) {
+	cw.decided = true
+	header := cw.Header()
+
+	if header.Get("Content-Type") == "" && len(cw.buffer) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buffer))
+	}
+
+	compress := thresholdReached && header.Get("Content-Encoding") == "" && cw.status == http.StatusOK && isCompressibleType(header.Get("Content-Type"))
+
+	if compress {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+
+		switch cw.encoding {
+		case encodingBrotli:
+			cw.compressor = brotli.NewWriterLevel(cw.ResponseWriter, brotli.DefaultCompression)
+		case encodingGzip:
+			cw.compressor, _ = gzip.NewWriterLevel(cw.ResponseWriter, gzip.DefaultCompression)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	if len(cw.buffer) > 0 {
+		if cw.compressor != nil {
+			_, err = cw.compressor.Write(cw.buffer)
+		} else {
+			_, err = cw.ResponseWriter.Write(cw.buffer)
+		}
+	}
+	cw.buffer = nil
+
+	return err
+}
+
+// Close flushes any buffered data and finalizes the compression stream.
+func (cw *compressWriter) Close() (err error) {
+	if !cw.decided {
+		if cw.status == 0 { // nothing was written by the handler
+			return nil
+		}
+		if err = cw.decide(false); err != nil {
+			return err
+		}
+	}
+
+	if cw.compressor != nil {
+		return cw.compressor.Close()
+	}
+
+	return nil
+}
+
+// Flush sends any buffered data to the client. It implements http.Flusher.
+func (cw *compressWriter) Flush() {
+	if !cw.decided && cw.status != 0 {
+		cw.decide(len(cw.buffer) >= cw.minSize)
+	}
+
+	if flusher, ok := cw.compressor.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker which is required for websockets.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		cw.decided = true
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("hijacking not supported")
+}
+
+// setVaryEncoding adds "Accept-Encoding" to the Vary header unless already present, so that caches do not serve an encoding the client does not support.
+func setVaryEncoding(header http.Header) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
+
+// ---- precompressed static files ----
+
+// precompressedFileServer serves static files from the file system. If enabled and the client accepts brotli or gzip and a precompressed
+// version of the file exists (same name with .br or .gz extension), that version is served instead.
+func precompressedFileServer(root http.FileSystem, enabled bool) http.Handler {
+	fileServer := http.FileServer(root)
+	if !enabled {
+		return fileServer
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on the Accept-Encoding header, even if the original file is served.
+		setVaryEncoding(w.Header())
+
+		if r.Header.Get("Range") != "" {
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+
+		filePath := path.Clean("/" + r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") {
+			filePath = path.Join(filePath, "index.html")
+		}
+
+		// Try the preferred encoding first, then fall back to the other one.
+		qualityBrotli, qualityGzip := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+
+		if qualityBrotli > 0 && qualityBrotli >= qualityGzip && servePrecompressed(w, r, root, filePath, encodingBrotli, ".br") {
+			return
+		}
+		if qualityGzip > 0 && servePrecompressed(w, r, root, filePath, encodingGzip, ".gz") {
+			return
+		}
+		if qualityBrotli > 0 && qualityBrotli < qualityGzip && servePrecompressed(w, r, root, filePath, encodingBrotli, ".br") {
+			return
+		}
+
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// servePrecompressed serves the precompressed file if it exists. It returns false if the file does not exist.
+// Precompressed files older than the original are ignored since they are likely stale.
+func servePrecompressed(w http.ResponseWriter, r *http.Request, root http.FileSystem, filePath, encoding, extension string) (served bool) {
+	original, err := root.Open(filePath)
+	if err != nil {
+		return false
+	}
+	statOriginal, err := original.Stat()
+	original.Close()
+	if err != nil || statOriginal.IsDir() {
+		return false
+	}
+
+	file, err := root.Open(filePath + extension)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() || stat.ModTime().Before(statOriginal.ModTime()) {
+		return false
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(filePath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Encoding", encoding)
+
+	http.ServeContent(w, r, filePath, stat.ModTime(), file)
+	return true
+}
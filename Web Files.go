@@ -0,0 +1,79 @@
+/*
+File Name:  Web Files.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+The default web files are embedded into the binary. If the WebFiles setting is set, files in that directory override the embedded files
+individually. Directory listings are disabled; directories are only served if they contain an index.html file.
+*/
+
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+)
+
+//go:embed "Web Files"
+var webFilesEmbedded embed.FS
+
+// webFilesSystem returns the file system to serve the web files from. The directory may be empty to only serve the embedded files.
+func webFilesSystem(directory string) http.FileSystem {
+	embedded, _ := fs.Sub(webFilesEmbedded, "Web Files")
+
+	var fileSystem http.FileSystem = http.FS(embedded)
+	if directory != "" {
+		fileSystem = overlayFileSystem{primary: http.Dir(directory), fallback: fileSystem}
+	}
+
+	return noListingFileSystem{fileSystem}
+}
+
+// overlayFileSystem serves files from the primary file system and falls back to the secondary if a file does not exist.
+type overlayFileSystem struct {
+	primary  http.FileSystem
+	fallback http.FileSystem
+}
+
+func (overlay overlayFileSystem) Open(name string) (http.File, error) {
+	file, err := overlay.primary.Open(name)
+	if err == nil {
+		return file, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return overlay.fallback.Open(name)
+}
+
+// noListingFileSystem prevents directory listings. Directories without index.html are reported as not existing.
+type noListingFileSystem struct {
+	http.FileSystem
+}
+
+func (noListing noListingFileSystem) Open(name string) (http.File, error) {
+	file, err := noListing.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if stat.IsDir() {
+		index, err := noListing.FileSystem.Open(path.Join(name, "index.html"))
+		if err != nil {
+			file.Close()
+			return nil, fs.ErrNotExist
+		}
+		index.Close()
+	}
+
+	return file, nil
+}
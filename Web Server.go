@@ -7,14 +7,18 @@ Author:     Peter Kleissner
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/PeernetOfficial/core"
 	"github.com/gorilla/mux"
+	"golang.org/x/crypto/acme"
 )
 
 func startStatisticsWebServer(backend *core.Backend) {
@@ -24,18 +28,43 @@ func startStatisticsWebServer(backend *core.Backend) {
 
 	router := mux.NewRouter()
 
-	router.Use(HeadersMiddleware(config.HTTPAccessAllow, config.UseSSL))
+	router.Use(HeadersMiddleware(config.UseSSL))
+	if config.HTTPCompression {
+		router.Use(CompressionMiddleware(config.HTTPCompressionMinSize))
+	}
 
 	router.HandleFunc("/stat/Daily Active Peers.csv", webStatDailyActive).Methods("GET")
 	router.HandleFunc("/stat/daily.json", webStatDailyJSON(backend)).Methods("GET")
 	router.HandleFunc("/stat/daily.json", CrossSiteOptionsResponse).Methods("OPTIONS")
 	router.HandleFunc("/stat/today.json", webStatTodayJSON(backend)).Methods("GET")
 	router.HandleFunc("/stat/today.json", CrossSiteOptionsResponse).Methods("OPTIONS")
+	router.HandleFunc("/stat/network.json", webStatNetworkJSON(backend)).Methods("GET")
+	router.HandleFunc("/stat/network.json", CrossSiteOptionsResponse).Methods("OPTIONS")
+	router.HandleFunc("/stat/sketch.json", webStatSketchJSON(backend)).Methods("GET")
+	router.HandleFunc("/stat/sketch.json", CrossSiteOptionsResponse).Methods("OPTIONS")
+	router.HandleFunc("/stat/sketch/hourly.json", webStatSketchHourlyJSON(backend)).Methods("GET")
+	router.HandleFunc("/stat/sketch/hourly.json", CrossSiteOptionsResponse).Methods("OPTIONS")
+	router.HandleFunc("/dashboard", webDashboard(backend)).Methods("GET")
+
+	router.PathPrefix("/").Handler(precompressedFileServer(webFilesSystem(config.WebFiles), config.HTTPCompression)).Methods("GET")
+
+	// The rate limiter wraps the router instead of being a router middleware, which only runs for matching routes.
+	// Requests to unknown paths are limited too.
+	var handler http.Handler = router
+	if len(config.RateLimit) > 0 {
+		var err error
+		if statRateLimiter, err = newRateLimiter(config.RateLimit, config.RateLimitAllow); err != nil {
+			log.Printf("Error initializing rate limiter: %v\n", err)
+		} else {
+			handler = RateLimitMiddleware(statRateLimiter)(handler)
+		}
+	}
 
-	router.PathPrefix("/").Handler(http.FileServer(http.Dir(config.WebFiles))).Methods("GET")
+	// HTTP-01 challenges of the ACME client are answered by the statistics web server.
+	handler = AccessLogMiddleware(accessLog, "Web")(acmeHTTPHandler(handler))
 
 	for _, listen := range config.WebListen {
-		go startWebServer(listen, config.UseSSL, config.CertificateFile, config.CertificateKey, router, "Web Listen", parseDuration(config.HTTPTimeoutRead), parseDuration(config.HTTPTimeoutWrite))
+		go startWebServer(listen, config.UseSSL, config.CertificateFile, config.CertificateKey, handler, "Web Listen", parseDuration(config.HTTPTimeoutRead), parseDuration(config.HTTPTimeoutWrite))
 	}
 }
 
@@ -54,19 +83,69 @@ func startWebServer(WebListen string, UseSSL bool, CertificateFile, CertificateK
 		TLSConfig: tlsConfig,
 	}
 
+	if UseSSL && CertificateFile == "" && acmeManager != nil {
+		// Certificates are provided by the built-in ACME client. The ALPN protocol is required for the TLS-ALPN-01 challenge.
+		tlsConfig.GetCertificate = acmeManager.GetCertificate
+		tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	} else if UseSSL {
+		// The certificate is provided via callback which allows reloading it without restart.
+		reloader, err := getCertificateReloader(CertificateFile, CertificateKey)
+		if err != nil {
+			log.Printf("Error loading certificate '%s' for '%s': %v\n", CertificateFile, WebListen, err)
+			return
+		}
+		tlsConfig.GetCertificate = reloader.GetCertificate
+	}
+
+	webServersMutex.Lock()
+	webServers = append(webServers, server)
+	webServersMutex.Unlock()
+
 	if UseSSL {
 		// HTTPS
-		if err := server.ListenAndServeTLS(CertificateFile, CertificateKey); err != nil {
+		if err := server.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Printf("Error listening on '%s': %v\n", WebListen, err)
 		}
 	} else {
 		// HTTP
-		if err := server.ListenAndServe(); err != nil {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Printf("Error listening on '%s': %v\n", WebListen, err)
 		}
 	}
 }
 
+// webServers contains all servers started via startWebServer. They are shut down on exit.
+var webServers []*http.Server
+var webServersMutex sync.Mutex
+
+// shutdownWebServers gracefully shuts down all web servers. Active requests are given until the timeout to complete, after which the connections are closed.
+func shutdownWebServers(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	webServersMutex.Lock()
+	servers := webServers
+	webServers = nil
+	webServersMutex.Unlock()
+
+	var wg sync.WaitGroup
+
+	for _, server := range servers {
+		wg.Add(1)
+
+		go func(server *http.Server) {
+			defer wg.Done()
+
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Error shutting down web server '%s': %v\n", server.Addr, err)
+				server.Close()
+			}
+		}(server)
+	}
+
+	wg.Wait()
+}
+
 // parseDuration is the same as time.ParseDuration without returning an error. Valid units are ms, s, m, h. For example "10s".
 func parseDuration(input string) (result time.Duration) {
 	result, _ = time.ParseDuration(input)
@@ -82,10 +161,12 @@ func CrossSiteOptionsResponse(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte{})
 }
 
-// HeadersMiddleware sets the CORS and HSTS headers according to the input. It returns a middleware function to be used with mux.Router.Use().
-func HeadersMiddleware(HTTPAccessAllow string, SetHSTS bool) func(http.Handler) http.Handler {
+// HeadersMiddleware sets the CORS and HSTS headers. The CORS header is taken from the current runtime settings. It returns a middleware function to be used with mux.Router.Use().
+func HeadersMiddleware(SetHSTS bool) func(http.Handler) http.Handler {
 	return (func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			HTTPAccessAllow := settings().HTTPAccessAllow
+
 			// Set CORS header
 			// Previously this code only set it when r.Header.Get("Origin") != "", however this screwed up HTTP/2 requests where the internal PUSH_PROMISE ommitted the Origin header
 			// and the client received the response then without the CORS header, resulting in refusal of the browser to show the content. Therefore, set it always.
@@ -4,11 +4,16 @@ go 1.19
 
 require (
 	github.com/PeernetOfficial/core v0.0.0-20221101165801-6989ef4a19c5
+	github.com/andybalholm/brotli v1.0.5
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/mux v1.8.1-0.20200912192056-d07530f46e1e
 	github.com/gorilla/websocket v1.5.0
 	github.com/qeesung/image2ascii v1.0.1
 	github.com/robfig/cron/v3 v3.0.1
+	golang.org/x/crypto v0.3.0
+	golang.org/x/term v0.10.0
+	gopkg.in/yaml.v3 v3.0.1
+	lukechampine.com/blake3 v1.1.7
 )
 
 require (
@@ -23,9 +28,7 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.5.0 // indirect
 	github.com/wayneashleyberry/terminal-dimensions v1.1.0 // indirect
-	golang.org/x/crypto v0.3.0 // indirect
 	golang.org/x/net v0.2.0 // indirect
-	golang.org/x/sys v0.2.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
-	lukechampine.com/blake3 v1.1.7 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/text v0.4.0 // indirect
 )